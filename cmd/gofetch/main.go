@@ -1,27 +1,112 @@
 package main
 
 import (
+	"fmt"
+	"net"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 
+	"github.com/Amirali-Amirifar/gofetch.git/internal/cli"
 	"github.com/Amirali-Amirifar/gofetch.git/internal/config"
+	"github.com/Amirali-Amirifar/gofetch.git/internal/controller"
+	"github.com/Amirali-Amirifar/gofetch.git/internal/daemon"
 	"github.com/Amirali-Amirifar/gofetch.git/internal/repository/json"
 	"github.com/Amirali-Amirifar/gofetch.git/internal/tui"
 	log "github.com/sirupsen/logrus"
 )
 
 func main() {
-	logFile, err := os.OpenFile("app.log", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	// The daemon owns the engine. With a subcommand gofetch works headless,
+	// for scripts and CI, and without one it opens the TUI; both are clients
+	// of the daemon, so downloads go on after they exit.
+	args := os.Args[1:]
+	switch {
+	case len(args) > 0 && args[0] == "daemon":
+		os.Exit(runDaemon(args[1:]))
+	case len(args) > 0 && cli.IsHelp(args[0]):
+		cli.Usage(os.Stdout)
+		return
+	case len(args) > 0 && !cli.IsCommand(args[0]):
+		cli.Usage(os.Stderr)
+		os.Exit(2)
+	}
+
+	// Clients add to the log of the daemon.
+	logFile, err := os.OpenFile("app.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 	if err != nil {
 		log.Fatal("Failed to open log file:", err)
 	}
 	log.SetOutput(logFile)
 
+	client, err := daemon.Connect(config.SocketFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gofetch: %v\n", err)
+		os.Exit(1)
+	}
+	defer client.Close()
+
+	if len(args) > 0 {
+		code := cli.Run(args, client)
+		client.Close()
+		os.Exit(code)
+	}
+
+	state, err := client.State()
+	if err != nil {
+		log.Fatalf("Failed to load app state: %v", err)
+	}
+
+	// Start the TUI
+	program := tui.GetTui(state, client)
+	log.Println("Starting TUI...")
+	_, err = program.Run() // Capture both return values, ignore the model with _
+	if err != nil {
+		log.Fatalf("Failed to start TUI: %v", err)
+	}
+}
+
+// runDaemon runs the engine until gofetch daemon stop or a signal stops it,
+// and returns the exit status.
+func runDaemon(args []string) int {
+	switch {
+	case len(args) == 1 && args[0] == "stop":
+		client, err := daemon.Dial(config.SocketFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "gofetch daemon: %v\n", err)
+			return 1
+		}
+		defer client.Close()
+		if err := client.Shutdown(); err != nil {
+			fmt.Fprintf(os.Stderr, "gofetch daemon: %v\n", err)
+			return 1
+		}
+		return 0
+	case len(args) != 0:
+		fmt.Fprintln(os.Stderr, "Usage: gofetch daemon [stop]")
+		return 2
+	}
+
+	logFile, err := os.OpenFile("app.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		log.Fatal("Failed to open log file:", err)
+	}
+	log.SetOutput(logFile)
+
+	// Claim the socket first, so a second daemon leaves the downloads alone.
+	listener, err := daemon.Listen(config.SocketFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gofetch daemon: %v\n", err)
+		return 1
+	}
+
 	// Initialize the database
 	_ = config.GetDB()
 	defer func() {
 		err := config.Close()
 		if err != nil {
-			log.Fatal("Failed to close DB:", err)
+			log.Errorf("Failed to close DB: %v", err)
 		}
 	}()
 
@@ -32,11 +117,42 @@ func main() {
 	}
 	log.Println("App state loaded successfully")
 
-	// Start the TUI
-	program := tui.GetTui(state)
-	log.Println("Starting TUI...")
-	_, err = program.Run() // Capture both return values, ignore the model with _
+	// Start a dispatcher per queue and continue downloads interrupted by the previous run
+	scheduler := controller.NewScheduler(state.Queues, state.GlobalBandwidthLimit)
+	// Runs before the database is closed above, and waits for the running
+	// downloads to stop writing to it.
+	defer scheduler.Stop()
+	scheduler.SetChecksumDiscovery(state.DiscoverChecksums)
+	scheduler.SetKeyring(state.Keyring)
+	scheduler.SetLocation(state.Location)
+	restored, err := scheduler.Restore()
 	if err != nil {
-		log.Fatalf("Failed to start TUI: %v", err)
+		log.Errorf("Failed to restore downloads: %v", err)
+	}
+	log.Printf("Restored %d interrupted downloads", restored)
+
+	server := daemon.NewServer(&state, scheduler)
+	if state.RPCPort != 0 {
+		// Only programs on this machine may reach it.
+		addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(state.RPCPort))
+		go func() {
+			if err := server.ServeAPI(addr, state.RPCSecret); err != nil {
+				log.Errorf("HTTP interfaces stopped: %v", err)
+			}
+		}()
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Infof("Daemon shutting down on %v", sig)
+		server.Shutdown()
+	}()
+
+	if err := server.Serve(listener); err != nil {
+		log.Errorf("Daemon failed: %v", err)
+		fmt.Fprintf(os.Stderr, "gofetch daemon: %v\n", err)
+		return 1
 	}
+	return 0
 }
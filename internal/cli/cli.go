@@ -0,0 +1,156 @@
+// Package cli implements the headless subcommands of gofetch, for scripts
+// and CI. Like the TUI they are clients of the daemon, which owns the
+// download engine, the SQLite store and the queues of state.json.
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/Amirali-Amirifar/gofetch.git/internal/daemon"
+)
+
+// env is what every command works with.
+type env struct {
+	client *daemon.Client
+	stdout io.Writer
+	stderr io.Writer
+}
+
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(e *env, args []string) error
+}
+
+var commands = []command{
+	{"add", "add [flags] <url>...", "hand downloads to their queue and return", runAdd},
+	{"get", "get [flags] <url>", "download in the foreground with a progress bar", runGet},
+	{"list", "list [-status s] [-queue q]", "list downloads", runList},
+	{"pause", "pause <id>...", "pause downloads", runPause},
+	{"resume", "resume <id>", "resume a download in the foreground", runResume},
+	{"cancel", "cancel <id>...", "cancel downloads", runCancel},
+	{"retry", "retry <id>", "retry a failed or canceled download in the foreground", runRetry},
+	{"run", "run", "wait until the queues have finished every queued download", runQueues},
+	{"queue", "queue list|create|edit|delete|move ...", "manage queues", runQueue},
+}
+
+// usageError is reported with exit status 2, like flag errors.
+type usageError struct{ msg string }
+
+func (e usageError) Error() string { return e.msg }
+
+func usagef(format string, args ...any) error {
+	return usageError{fmt.Sprintf(format, args...)}
+}
+
+// IsCommand reports whether name is a subcommand, so that main knows to
+// stay headless.
+func IsCommand(name string) bool {
+	_, ok := lookup(name)
+	return ok
+}
+
+// IsHelp reports whether name asks for the list of subcommands.
+func IsHelp(name string) bool {
+	switch name {
+	case "help", "-h", "-help", "--help":
+		return true
+	}
+	return false
+}
+
+func lookup(name string) (command, bool) {
+	for _, c := range commands {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return command{}, false
+}
+
+// Usage prints the list of subcommands.
+func Usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s [command]\n\nWithout a command gofetch opens the TUI. Both start the daemon when it is not\nrunning yet, and downloads continue in it after they exit. Commands:\n\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-36s %s\n", c.usage, c.summary)
+	}
+	fmt.Fprintf(w, "  %-36s %s\n", "daemon [stop]", "run the download engine in the foreground, or stop it")
+	fmt.Fprintf(w, "\nRun %s <command> -h for the flags of a command.\n", os.Args[0])
+}
+
+// Run executes the subcommand in args against the daemon and returns the
+// exit status: 0 on success, 1 when the command failed and 2 for invalid
+// arguments.
+func Run(args []string, client *daemon.Client) int {
+	e := &env{client: client, stdout: os.Stdout, stderr: os.Stderr}
+
+	c, ok := lookup(args[0])
+	if !ok {
+		Usage(e.stderr)
+		return 2
+	}
+
+	err := c.run(e, args[1:])
+	var usage usageError
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, flag.ErrHelp):
+		return 0
+	case errors.As(err, &usage):
+		fmt.Fprintf(e.stderr, "gofetch %s: %v\nUsage: gofetch %s\n", c.name, err, c.usage)
+		return 2
+	default:
+		fmt.Fprintf(e.stderr, "gofetch %s: %v\n", c.name, err)
+		return 1
+	}
+}
+
+// newFlagSet returns a flag set that reports errors instead of exiting.
+func newFlagSet(e *env, name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("gofetch "+name, flag.ContinueOnError)
+	fs.SetOutput(e.stderr)
+	return fs
+}
+
+// parseArgs parses flags placed before, between or after the positional
+// arguments, which it returns.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return nil, err
+			}
+			return nil, usageError{err.Error()}
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// parseIDs reads download ids given on the command line.
+func parseIDs(args []string) ([]int64, error) {
+	if len(args) == 0 {
+		return nil, usagef("missing download id")
+	}
+	ids := make([]int64, len(args))
+	for i, arg := range args {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil || id <= 0 {
+			return nil, usagef("%q is not a download id", arg)
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
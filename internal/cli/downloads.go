@@ -0,0 +1,270 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Amirali-Amirifar/gofetch.git/internal/config"
+	"github.com/Amirali-Amirifar/gofetch.git/internal/models"
+)
+
+// downloadOptions are the flags describing a new download.
+type downloadOptions struct {
+	queue     *string
+	out       *string
+	sha256    *string
+	checksum  *string
+	signature *string
+	mirrors   *string
+}
+
+func addDownloadFlags(fs *flag.FlagSet) *downloadOptions {
+	return &downloadOptions{
+		queue:     fs.String("queue", config.DefaultQueueName, "queue to add the download to"),
+		out:       fs.String("out", "", "file name, relative to the queue's storage folder or absolute"),
+		sha256:    fs.String("sha256", "", "expected SHA-256 digest of the file"),
+		checksum:  fs.String("checksum", "", "expected checksum as <algorithm>:<hex digest> (md5, sha1, sha256, sha512, blake2b)"),
+		signature: fs.String("signature", "", "detached OpenPGP signature, as a URL or file (default <url>.sig or <url>.asc)"),
+		mirrors:   fs.String("mirrors", "", "more URLs of the same file, separated by commas"),
+	}
+}
+
+// download builds the download of url. Options naming a single file need
+// the command to be given a single URL.
+func (o *downloadOptions) download(url string, urls int) (models.Download, error) {
+	if urls > 1 && (*o.out != "" || *o.sha256 != "" || *o.checksum != "" || *o.signature != "" || *o.mirrors != "") {
+		return models.Download{}, usagef("-out, -sha256, -checksum, -signature and -mirrors need exactly one URL")
+	}
+	checksum := *o.checksum
+	if *o.sha256 != "" {
+		if checksum != "" {
+			return models.Download{}, usagef("give either -sha256 or -checksum")
+		}
+		checksum = "sha256:" + *o.sha256
+	}
+	return models.Download{
+		URL:       url,
+		QueueName: *o.queue,
+		FileName:  *o.out,
+		Checksum:  checksum,
+		Signature: *o.signature,
+		Mirrors:   models.ParseMirrors(url, *o.mirrors),
+	}, nil
+}
+
+func runAdd(e *env, args []string) error {
+	fs := newFlagSet(e, "add")
+	options := addDownloadFlags(fs)
+	urls, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(urls) == 0 {
+		return usagef("missing URL")
+	}
+
+	failed := 0
+	for _, url := range urls {
+		download, err := options.download(url, len(urls))
+		if err != nil {
+			return err
+		}
+		downloads, err := e.client.Add(download)
+		for _, d := range downloads {
+			if d.Status == models.DownloadStatusQueued {
+				fmt.Fprintf(e.stdout, "%d\tqueued in %s\t%s\n", d.Id, d.QueueName, displayName(d.Download))
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(e.stderr, "gofetch add: %s: %v\n", url, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d URLs could not be added", failed, len(urls))
+	}
+	return nil
+}
+
+func runGet(e *env, args []string) error {
+	fs := newFlagSet(e, "get")
+	options := addDownloadFlags(fs)
+	urls, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(urls) != 1 {
+		return usagef("need exactly one URL")
+	}
+	download, err := options.download(urls[0], 1)
+	if err != nil {
+		return err
+	}
+
+	downloads, err := e.client.Add(download)
+	if err != nil {
+		return err
+	}
+	for _, d := range downloads {
+		if err := wait(e, d.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runList(e *env, args []string) error {
+	fs := newFlagSet(e, "list")
+	status := fs.String("status", "", "only list downloads with this status, e.g. FAILED")
+	queue := fs.String("queue", "", "only list downloads of this queue")
+	if rest, err := parseArgs(fs, args); err != nil {
+		return err
+	} else if len(rest) != 0 {
+		return usagef("unexpected argument %q", rest[0])
+	}
+
+	downloads, err := e.client.Downloads()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(e.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATUS\tPROGRESS\tSIZE\tQUEUE\tFILE")
+	for _, d := range downloads {
+		if *status != "" && !strings.EqualFold(string(d.Status), *status) {
+			continue
+		}
+		if *queue != "" && d.QueueName != *queue {
+			continue
+		}
+		fmt.Fprintf(w, "%d\t%s\t%d%%\t%s\t%s\t%s\n", d.Id, d.Status, d.Progress, formatBytes(d.ContentLength), d.QueueName, displayName(d.Download))
+	}
+	return w.Flush()
+}
+
+func runPause(e *env, args []string) error {
+	return eachDownload(e, args, func(id int64) error {
+		if _, err := e.client.Pause(id); err != nil {
+			return err
+		}
+		fmt.Fprintf(e.stdout, "%d\tpaused\n", id)
+		return nil
+	})
+}
+
+func runCancel(e *env, args []string) error {
+	return eachDownload(e, args, func(id int64) error {
+		if _, err := e.client.Cancel(id); err != nil {
+			return err
+		}
+		fmt.Fprintf(e.stdout, "%d\tcanceled\n", id)
+		return nil
+	})
+}
+
+func runResume(e *env, args []string) error {
+	id, err := oneDownload(args)
+	if err != nil {
+		return err
+	}
+	if _, err := e.client.Resume(id); err != nil {
+		return err
+	}
+	return wait(e, id)
+}
+
+func runRetry(e *env, args []string) error {
+	id, err := oneDownload(args)
+	if err != nil {
+		return err
+	}
+	if _, err := e.client.Retry(id); err != nil {
+		return err
+	}
+	return wait(e, id)
+}
+
+// runQueues waits until the daemon has worked through every queued
+// download, printing each as it stops.
+func runQueues(e *env, args []string) error {
+	fs := newFlagSet(e, "run")
+	if rest, err := parseArgs(fs, args); err != nil {
+		return err
+	} else if len(rest) != 0 {
+		return usagef("unexpected argument %q", rest[0])
+	}
+
+	reported := make(map[int64]models.DownloadStatus)
+	failed := 0
+	for first := true; ; first = false {
+		downloads, err := e.client.Downloads()
+		if err != nil {
+			return err
+		}
+		busy := false
+		for _, d := range downloads {
+			if !stopped(d.Status) || d.Running {
+				busy = true
+				continue
+			}
+			previous, seen := reported[d.Id]
+			reported[d.Id] = d.Status
+			// Downloads that had already stopped are not news.
+			if first || seen && previous == d.Status {
+				continue
+			}
+			fmt.Fprintf(e.stdout, "%d\t%s\t%s\n", d.Id, d.Status, displayName(d.Download))
+			if d.Status == models.DownloadStatusFailed || d.Status == models.DownloadStatusVerifyFailed {
+				failed++
+			}
+		}
+		if !busy {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d downloads failed", failed)
+	}
+	return nil
+}
+
+func oneDownload(args []string) (int64, error) {
+	ids, err := parseIDs(args)
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) != 1 {
+		return 0, usagef("need exactly one download id")
+	}
+	return ids[0], nil
+}
+
+// eachDownload applies action to every download named in args and fails if
+// any of them failed.
+func eachDownload(e *env, args []string, action func(id int64) error) error {
+	ids, err := parseIDs(args)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, id := range ids {
+		if err := action(id); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// displayName is the file name of a download, or its URL before one is known.
+func displayName(d models.Download) string {
+	if d.FileName != "" {
+		return filepath.Base(d.FileName)
+	}
+	return d.URL
+}
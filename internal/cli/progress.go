@@ -0,0 +1,180 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Amirali-Amirifar/gofetch.git/internal/daemon"
+	"github.com/Amirali-Amirifar/gofetch.git/internal/models"
+)
+
+const barWidth = 30
+
+// progressBar draws the progress of one download. On a terminal it redraws a
+// single line; in logs of scripts and CI it prints a line every 10%.
+type progressBar struct {
+	w        io.Writer
+	terminal bool
+	width    int // Length of the last line drawn, to blank it out when redrawing
+
+	lastBytes int64
+	lastTime  time.Time
+	speed     float64 // Bytes per second, smoothed
+	lastStep  int
+}
+
+func newProgressBar(w io.Writer) *progressBar {
+	terminal := false
+	if f, ok := w.(*os.File); ok {
+		if info, err := f.Stat(); err == nil {
+			terminal = info.Mode()&os.ModeCharDevice != 0
+		}
+	}
+	return &progressBar{w: w, terminal: terminal, lastStep: -1}
+}
+
+func (p *progressBar) draw(d models.Download) {
+	now := time.Now()
+	if !p.lastTime.IsZero() && now.After(p.lastTime) {
+		delta := d.CurrentProgress - p.lastBytes
+		if delta < 0 {
+			delta = 0
+		}
+		current := float64(delta) / now.Sub(p.lastTime).Seconds()
+		if p.speed == 0 {
+			p.speed = current
+		} else {
+			p.speed = 0.8*p.speed + 0.2*current
+		}
+	}
+	p.lastBytes, p.lastTime = d.CurrentProgress, now
+
+	var line string
+	if d.ContentLength > 0 {
+		fraction := min(float64(d.CurrentProgress)/float64(d.ContentLength), 1)
+		filled := int(fraction * barWidth)
+		eta := "--"
+		if p.speed > 0 {
+			remaining := float64(d.ContentLength - d.CurrentProgress)
+			eta = (time.Duration(remaining/p.speed) * time.Second).Round(time.Second).String()
+		}
+		line = fmt.Sprintf("[%s%s] %3d%% %s/%s %s/s ETA %s",
+			strings.Repeat("=", filled), strings.Repeat(" ", barWidth-filled), int(fraction*100),
+			formatBytes(d.CurrentProgress), formatBytes(d.ContentLength), formatBytes(int64(p.speed)), eta)
+
+		if !p.terminal {
+			step := int(fraction * 10)
+			if step == p.lastStep {
+				return
+			}
+			p.lastStep = step
+		}
+	} else {
+		// Without a known size there is nothing to fill the bar with.
+		line = fmt.Sprintf("%s %s/s", formatBytes(d.CurrentProgress), formatBytes(int64(p.speed)))
+		if !p.terminal {
+			return
+		}
+	}
+
+	if !p.terminal {
+		fmt.Fprintln(p.w, line)
+		return
+	}
+	padding := ""
+	if len(line) < p.width {
+		padding = strings.Repeat(" ", p.width-len(line))
+	}
+	p.width = len(line)
+	fmt.Fprintf(p.w, "\r%s%s", line, padding)
+}
+
+// finish ends the line a terminal bar was drawn on.
+func (p *progressBar) finish() {
+	if p.terminal && p.width > 0 {
+		fmt.Fprintln(p.w)
+	}
+}
+
+// wait follows the events of download id and draws its progress until it
+// stops, then turns any outcome but a completed download into an error.
+func wait(e *env, id int64) error {
+	events, err := e.client.Subscribe()
+	if err != nil {
+		return err
+	}
+	// Fetched after subscribing, so no change is missed in between.
+	d, err := e.client.Download(id)
+	if err != nil {
+		return err
+	}
+
+	bar := newProgressBar(e.stderr)
+	for !stopped(d.Status) || d.Running {
+		if d.Status == models.DownloadStatusDownloading {
+			bar.draw(d.Download)
+		}
+		event, ok := <-events
+		if !ok {
+			bar.finish()
+			return fmt.Errorf("lost connection to the daemon; download %d continues in it", id)
+		}
+		if event.Type == daemon.EventDownload && event.Download.Id == id {
+			d = *event.Download
+		}
+	}
+	if d.Status == models.DownloadStatusCompleted {
+		bar.draw(d.Download)
+	}
+	bar.finish()
+
+	switch d.Status {
+	case models.DownloadStatusCompleted:
+		fmt.Fprintf(e.stdout, "%d\tcompleted\t%s\n", d.Id, d.FileName)
+		if d.LastError != "" {
+			// A completed download only records an error when its signature
+			// did not check out.
+			return fmt.Errorf("download %d: %s", d.Id, d.LastError)
+		}
+		return nil
+	case models.DownloadStatusChanged:
+		return fmt.Errorf("download %d: %s; run gofetch resume %d to start it over", d.Id, d.LastError, d.Id)
+	case models.DownloadStatusVerifyFailed:
+		// Only piece checksums, which metalinks carry, locate the damage.
+		if d.Pieces == nil || len(d.Pieces.Hashes) == 0 {
+			return fmt.Errorf("download %d: %s; run gofetch resume %d to download the file again", d.Id, d.LastError, d.Id)
+		}
+		return fmt.Errorf("download %d: %s; run gofetch resume %d to fetch the corrupted pieces again", d.Id, d.LastError, d.Id)
+	case models.DownloadStatusFailed:
+		return fmt.Errorf("download %d failed: %s", d.Id, d.LastError)
+	default:
+		return fmt.Errorf("download %d is %s", d.Id, d.Status)
+	}
+}
+
+// stopped reports whether a download with the given status needs someone to
+// act before it moves again.
+func stopped(status models.DownloadStatus) bool {
+	switch status {
+	case models.DownloadStatusCompleted, models.DownloadStatusFailed, models.DownloadStatusCanceled,
+		models.DownloadStatusPaused, models.DownloadStatusChanged, models.DownloadStatusVerifyFailed:
+		return true
+	}
+	return false
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,195 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/Amirali-Amirifar/gofetch.git/internal/config"
+	"github.com/Amirali-Amirifar/gofetch.git/internal/models"
+)
+
+const queueUsage = "queue list | create <name> [flags] | edit <name> [-name new] [flags] | delete <name> [-cancel] | move <name> <position>"
+
+func runQueue(e *env, args []string) error {
+	if len(args) == 0 {
+		return usagef("missing queue command")
+	}
+	switch args[0] {
+	case "list":
+		return listQueues(e, args[1:])
+	case "create":
+		return createQueue(e, args[1:])
+	case "edit":
+		return editQueue(e, args[1:])
+	case "delete":
+		return deleteQueue(e, args[1:])
+	case "move":
+		return moveQueue(e, args[1:])
+	}
+	return usagef("unknown queue command %q, expected %s", args[0], queueUsage)
+}
+
+// queueSettings are the flags of create and edit, defaulting to queue.
+type queueSettings struct {
+	folder    *string
+	max       *int
+	speed     *int64
+	bandwidth *int64
+	start     *string
+	end       *string
+	retries   *int
+}
+
+func addQueueFlags(fs *flag.FlagSet, queue models.Queue) *queueSettings {
+	return &queueSettings{
+		folder:    fs.String("folder", queue.StorageFolder, "storage folder"),
+		max:       fs.Int("max", queue.MaxSimultaneous, fmt.Sprintf("downloads running at the same time, 0 = default of %d", config.DefaultMaxSimultaneous)),
+		speed:     fs.Int64("speed", queue.MaxDownloadSpeed, "speed limit of each download in KB/s, 0 = unlimited"),
+		bandwidth: fs.Int64("bandwidth", queue.BandwidthLimit, "speed limit shared by the queue in KB/s, 0 = unlimited"),
+		start:     fs.String("start", queue.ActiveTimeStart, "start of the active time as HH:MM, empty for always"),
+		end:       fs.String("end", queue.ActiveTimeEnd, "end of the active time as HH:MM, empty for always"),
+		retries:   fs.Int("retries", queue.MaxRetryAttempts, "retry attempts of failing downloads"),
+	}
+}
+
+func (s *queueSettings) apply(queue *models.Queue) {
+	queue.StorageFolder = *s.folder
+	queue.MaxSimultaneous = *s.max
+	queue.MaxDownloadSpeed = *s.speed
+	queue.BandwidthLimit = *s.bandwidth
+	queue.ActiveTimeStart = *s.start
+	queue.ActiveTimeEnd = *s.end
+	queue.MaxRetryAttempts = *s.retries
+}
+
+func listQueues(e *env, args []string) error {
+	if len(args) != 0 {
+		return usagef("unexpected argument %q", args[0])
+	}
+	state, err := e.client.State()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(e.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tFOLDER\tMAX\tSPEED\tBANDWIDTH\tACTIVE\tRETRIES")
+	for _, q := range state.Queues {
+		active := "always"
+		if q.ActiveTimeStart != "" {
+			active = q.ActiveTimeStart + "-" + q.ActiveTimeEnd
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%d\n", q.Name, q.StorageFolder, q.MaxSimultaneous,
+			formatLimit(q.MaxDownloadSpeed), formatLimit(q.BandwidthLimit), active, q.MaxRetryAttempts)
+	}
+	return w.Flush()
+}
+
+func createQueue(e *env, args []string) error {
+	queue := models.Queue{
+		StorageFolder:    config.DefaultDownloadFolder,
+		MaxSimultaneous:  config.DefaultMaxSimultaneous,
+		MaxRetryAttempts: config.DefaultMaxRetryAttempts,
+	}
+	fs := newFlagSet(e, "queue create")
+	settings := addQueueFlags(fs, queue)
+	rest, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 1 {
+		return usagef("need exactly one queue name")
+	}
+	queue.Name = rest[0]
+	settings.apply(&queue)
+
+	if _, err := e.client.SaveQueue("", queue); err != nil {
+		return err
+	}
+	fmt.Fprintf(e.stdout, "Created queue %s\n", queue.Name)
+	return nil
+}
+
+func editQueue(e *env, args []string) error {
+	if len(args) == 0 || len(args[0]) > 0 && args[0][0] == '-' {
+		return usagef("missing queue name")
+	}
+	name := args[0]
+	state, err := e.client.State()
+	if err != nil {
+		return err
+	}
+	i := findQueue(state, name)
+	if i < 0 {
+		return fmt.Errorf("no queue named %s", name)
+	}
+	queue := state.Queues[i]
+
+	// Flags default to the current settings, so only those given change.
+	fs := newFlagSet(e, "queue edit")
+	rename := fs.String("name", queue.Name, "new name of the queue")
+	settings := addQueueFlags(fs, queue)
+	if rest, err := parseArgs(fs, args[1:]); err != nil {
+		return err
+	} else if len(rest) != 0 {
+		return usagef("unexpected argument %q", rest[0])
+	}
+	queue.Name = *rename
+	settings.apply(&queue)
+
+	if _, err := e.client.SaveQueue(name, queue); err != nil {
+		return err
+	}
+	fmt.Fprintf(e.stdout, "Updated queue %s\n", queue.Name)
+	return nil
+}
+
+func deleteQueue(e *env, args []string) error {
+	fs := newFlagSet(e, "queue delete")
+	cancel := fs.Bool("cancel", false, "cancel the unfinished downloads of the queue instead of moving them to "+config.DefaultQueueName)
+	rest, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 1 {
+		return usagef("need exactly one queue name")
+	}
+	if _, err := e.client.DeleteQueue(rest[0], *cancel); err != nil {
+		return err
+	}
+	fmt.Fprintf(e.stdout, "Deleted queue %s\n", rest[0])
+	return nil
+}
+
+// moveQueue moves a queue to a position in the list, counted from 1 like
+// the rows of queue list.
+func moveQueue(e *env, args []string) error {
+	if len(args) != 2 {
+		return usagef("need a queue name and a position")
+	}
+	position, err := strconv.Atoi(args[1])
+	if err != nil || position < 1 {
+		return usagef("%q is not a position", args[1])
+	}
+	if _, err := e.client.MoveQueue(args[0], position-1); err != nil {
+		return err
+	}
+	fmt.Fprintf(e.stdout, "Moved queue %s to position %d\n", args[0], position)
+	return nil
+}
+
+func findQueue(state models.AppState, name string) int {
+	for i, q := range state.Queues {
+		if q.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func formatLimit(kbps int64) string {
+	if kbps == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d KB/s", kbps)
+}
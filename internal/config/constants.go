@@ -1,5 +1,7 @@
 package config
 
+import "time"
+
 const (
 	DefaultQueueName        = "Default"
 	DefaultDownloadFolder   = "~/Downloads/GoFetch/"
@@ -10,5 +12,17 @@ const (
 	DefaultMaxRetryAttempts = 3
 	StateFile               = "state.json"
 	databaseFile            = "sqlite3.db"
-	MaxConcurrentDownloads = 4
+	SocketFile              = "gofetch.sock" // Unix socket the daemon listens on for the TUI and CLI
+	MaxConcurrentDownloads  = 4
+)
+
+const (
+	RetryBaseDelay     = time.Second      // Delay before the first retry, doubled on every further attempt
+	RetryMaxDelay      = 30 * time.Second // Upper bound of the retry delay
+	RetryAfterMaxDelay = 5 * time.Minute  // Upper bound of a wait a server asks for in Retry-After
+)
+
+const (
+	MaxConnections = 16              // Upper bound of connections a parallel download grows to
+	MinSegmentSize = 1 * 1024 * 1024 // A remaining range is only split if both halves get at least this many bytes
 )
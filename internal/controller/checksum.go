@@ -0,0 +1,381 @@
+package controller
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/Amirali-Amirifar/gofetch.git/internal/models"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/blake2b"
+)
+
+// errVerification means the finished file does not match its checksum.
+// Fetching the same bytes again would not help, so it is never retried.
+var errVerification = errors.New("checksum mismatch")
+
+// hashes maps the supported algorithms to their constructors. Checksums are
+// written as "<algorithm>:<hex digest>".
+var hashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"blake2b": func() hash.Hash {
+		h, _ := blake2b.New512(nil)
+		return h
+	},
+}
+
+// normalizeAlgorithm maps spellings such as "SHA-256" to the keys of hashes.
+func normalizeAlgorithm(name string) string {
+	name = strings.ToLower(strings.ReplaceAll(name, "-", ""))
+	switch name {
+	case "sha":
+		return "sha1"
+	case "blake2b512":
+		return "blake2b"
+	}
+	return name
+}
+
+// ParseChecksum validates an expected checksum and returns it in the
+// "<algorithm>:<hex digest>" form. The algorithm may be omitted, in which
+// case it is inferred from the digest length (128 hex digits mean SHA-512).
+func ParseChecksum(value string) (string, error) {
+	algorithm, digest, err := splitChecksum(value)
+	if err != nil {
+		return "", err
+	}
+	return algorithm + ":" + hex.EncodeToString(digest), nil
+}
+
+func splitChecksum(value string) (string, []byte, error) {
+	value = strings.TrimSpace(value)
+	algorithm, digest, found := strings.Cut(value, ":")
+	if !found {
+		algorithm, digest, found = strings.Cut(value, "=")
+	}
+	if !found {
+		digest = value
+		switch len(value) {
+		case 32:
+			algorithm = "md5"
+		case 40:
+			algorithm = "sha1"
+		case 64:
+			algorithm = "sha256"
+		case 128:
+			algorithm = "sha512"
+		default:
+			return "", nil, fmt.Errorf("cannot tell the algorithm of checksum %q, write it as sha256:<digest>", value)
+		}
+	}
+
+	algorithm = normalizeAlgorithm(algorithm)
+	newHash, ok := hashes[algorithm]
+	if !ok {
+		return "", nil, fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+	}
+	sum, err := hex.DecodeString(strings.TrimSpace(digest))
+	if err != nil {
+		return "", nil, fmt.Errorf("checksum %q is not hexadecimal", digest)
+	}
+	if len(sum) != newHash().Size() {
+		return "", nil, fmt.Errorf("a %s checksum has %d hex digits, got %d", algorithm, 2*newHash().Size(), len(digest))
+	}
+	return algorithm, sum, nil
+}
+
+// checksumFromHeaders picks the strongest digest the server advertises for
+// the whole file, from Repr-Digest (RFC 9530), Digest (RFC 3230) or
+// Content-MD5. Content-MD5 covers only the body it came with, so it is
+// ignored on partial responses. Digests of an encoded body do not apply to
+// the decoded file and are ignored as well.
+func checksumFromHeaders(header http.Header, partial bool) string {
+	if encoding := header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return ""
+	}
+
+	found := make(map[string][]byte)
+	for _, field := range header.Values("Repr-Digest") {
+		for _, member := range strings.Split(field, ",") {
+			name, value, ok := strings.Cut(strings.TrimSpace(member), "=")
+			if !ok {
+				continue
+			}
+			value = strings.Trim(strings.TrimSpace(value), ":")
+			if sum, err := base64.StdEncoding.DecodeString(value); err == nil {
+				found[normalizeAlgorithm(name)] = sum
+			}
+		}
+	}
+	for _, field := range header.Values("Digest") {
+		for _, member := range strings.Split(field, ",") {
+			name, value, ok := strings.Cut(strings.TrimSpace(member), "=")
+			if !ok {
+				continue
+			}
+			if sum, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value)); err == nil {
+				found[normalizeAlgorithm(name)] = sum
+			}
+		}
+	}
+	if value := header.Get("Content-MD5"); value != "" && !partial {
+		if sum, err := base64.StdEncoding.DecodeString(value); err == nil {
+			found["md5"] = sum
+		}
+	}
+
+	for _, algorithm := range []string{"sha512", "sha256", "sha1", "md5"} {
+		if sum, ok := found[algorithm]; ok && len(sum) == hashes[algorithm]().Size() {
+			return algorithm + ":" + hex.EncodeToString(sum)
+		}
+	}
+	return ""
+}
+
+// verifier hashes a download while it is being written. Bytes written in
+// file order go straight into the hash. Bytes written ahead of that point by
+// other segments are read back once the hash reaches them, which happens
+// while they are still in the page cache, so there is no separate pass over
+// the finished file.
+type verifier struct {
+	mu        sync.Mutex // Guards hash and next, held only to hash bytes already in memory
+	algorithm string
+	want      []byte
+	hash      hash.Hash
+	next      int64 // First byte not hashed yet
+
+	// readMu is held while catchUp reads the file, so only one of them
+	// reads at a time. Writers feeding the hash do not wait for it.
+	readMu sync.Mutex
+}
+
+func newVerifier(checksum string) (*verifier, error) {
+	algorithm, want, err := splitChecksum(checksum)
+	if err != nil {
+		return nil, err
+	}
+	return &verifier{algorithm: algorithm, want: want, hash: hashes[algorithm]()}, nil
+}
+
+// rewind starts over when a transfer goes back to bytes already hashed.
+func (v *verifier) rewind(offset int64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if offset < v.next {
+		v.hash.Reset()
+		v.next = 0
+	}
+}
+
+// wrote is called once p is on disk at off. Only bytes continuing the hashed
+// prefix are taken; the others are read back by catchUp.
+func (v *verifier) wrote(p []byte, off int64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if off == v.next {
+		v.hash.Write(p)
+		v.next += int64(len(p))
+	}
+}
+
+// catchUpChunk is how much of the file catchUp reads before hashing it.
+const catchUpChunk = 256 * 1024
+
+// catchUpTo returns the end of the bytes on disk according to ranges that
+// follow without a gap from next, or -1 when next is not on disk yet.
+func catchUpTo(ranges []models.Range, next int64) int64 {
+	for _, r := range ranges {
+		if r.Start <= next && next < r.Offset {
+			return min(r.Offset, r.End+1)
+		}
+	}
+	return -1
+}
+
+// catchUp hashes bytes following the hashed prefix that are already on disk
+// according to ranges. The file is read without holding mu, so the
+// connections feeding the hash are not held up by the disk.
+func (v *verifier) catchUp(fileName string, ranges []models.Range) error {
+	v.readMu.Lock()
+	defer v.readMu.Unlock()
+
+	var file *os.File
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+
+	buf := make([]byte, catchUpChunk)
+	for {
+		v.mu.Lock()
+		next := v.next
+		v.mu.Unlock()
+		end := catchUpTo(ranges, next)
+		if end < 0 {
+			return nil
+		}
+
+		if file == nil {
+			var err error
+			if file, err = os.Open(fileName); err != nil {
+				return err
+			}
+		}
+		n, err := file.ReadAt(buf[:min(int64(len(buf)), end-next)], next)
+		if n == 0 && err != nil {
+			return err
+		}
+
+		v.mu.Lock()
+		// A writer continuing the prefix or a rewind got there first;
+		// the next round starts from where they left it.
+		if v.next == next {
+			v.hash.Write(buf[:n])
+			v.next += int64(n)
+		}
+		v.mu.Unlock()
+	}
+}
+
+// check compares the hash of the first size bytes with the expected one.
+func (v *verifier) check(size int64) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.next != size {
+		return fmt.Errorf("only %d of %d bytes were hashed", v.next, size)
+	}
+	if got := v.hash.Sum(nil); !bytes.Equal(got, v.want) {
+		return fmt.Errorf("%w: expected %s %x, got %x", errVerification, v.algorithm, v.want, got)
+	}
+	return nil
+}
+
+// digest feeds bytes just written at off to the verifier, if any.
+func (d *Download) digest(p []byte, off int64) {
+	if d.verifier != nil {
+		d.verifier.wrote(p, off)
+	}
+}
+
+// catchUp hashes whatever the segments have written past the hashed prefix.
+func (d *Download) catchUp() error {
+	if d.verifier == nil {
+		return nil
+	}
+	d.mu.Lock()
+	ranges := append([]models.Range(nil), d.Ranges...)
+	d.mu.Unlock()
+	return d.verifier.catchUp(d.FileName, ranges)
+}
+
+// verify compares the finished file with its expected checksum or, without
+// one, with its piece checksums.
+func (d *Download) verify(size int64) error {
+	if d.verifier == nil {
+		return d.verifyPieces()
+	}
+	if err := d.catchUp(); err != nil {
+		return permanent(fmt.Errorf("failed to read back %s: %w", d.FileName, err))
+	}
+	if err := d.verifier.check(size); err != nil {
+		return permanent(err)
+	}
+	log.Infof("Verified %s checksum of %s", d.verifier.algorithm, d.FileName)
+	return nil
+}
+
+func (d *Download) verifyPieces() error {
+	bad, err := d.badPieces()
+	if err != nil {
+		return permanent(fmt.Errorf("failed to check pieces of %s: %w", d.FileName, err))
+	}
+	if bad == nil {
+		return nil
+	}
+	if len(bad) != 0 {
+		return permanent(fmt.Errorf("%w: %d of %d pieces differ", errVerification, len(bad), len(d.Pieces.Hashes)))
+	}
+	log.Infof("Verified %d %s piece checksums of %s", len(d.Pieces.Hashes), d.Pieces.Algorithm, d.FileName)
+	return nil
+}
+
+// badPieces returns the indexes of the pieces that do not match their
+// checksums, or nil when the download has no usable piece checksums.
+func (d *Download) badPieces() ([]int, error) {
+	if d.Pieces == nil || d.Pieces.Length <= 0 || d.ContentLength <= 0 {
+		return nil, nil
+	}
+	newHash, ok := hashes[normalizeAlgorithm(d.Pieces.Algorithm)]
+	if !ok {
+		return nil, nil
+	}
+
+	file, err := os.Open(d.FileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	bad := []int{}
+	for i, want := range d.Pieces.Hashes {
+		start := int64(i) * d.Pieces.Length
+		if start >= d.ContentLength {
+			break
+		}
+		end := min(start+d.Pieces.Length, d.ContentLength)
+
+		h := newHash()
+		if _, err := io.Copy(h, io.NewSectionReader(file, start, end-start)); err != nil {
+			return nil, err
+		}
+		if hex.EncodeToString(h.Sum(nil)) != strings.ToLower(want) {
+			log.Warnf("Piece %d (bytes %d-%d) of %s is corrupted", i, start, end-1, d.FileName)
+			bad = append(bad, i)
+		}
+	}
+	return bad, nil
+}
+
+// corruptedRanges returns the segments to fetch again after a failed
+// verification. With piece checksums only the pieces that do not match are
+// fetched again and the rest of the file is kept; without them nothing
+// tells the good bytes from the bad ones, so the whole file is fetched.
+func (d *Download) corruptedRanges() ([]models.Range, error) {
+	bad, err := d.badPieces()
+	if err != nil || len(bad) == 0 {
+		// Without bad pieces nothing locates the damage.
+		return nil, err
+	}
+
+	var ranges []models.Range
+	var kept int64 // Start of the bytes not yet covered by ranges
+	for _, i := range bad {
+		start := int64(i) * d.Pieces.Length
+		end := min(start+d.Pieces.Length, d.ContentLength) - 1
+		if kept < start {
+			ranges = append(ranges, models.Range{Start: kept, End: start - 1, Offset: start})
+		}
+		ranges = append(ranges, models.Range{Start: start, End: end, Offset: start})
+		kept = end + 1
+	}
+	if kept < d.ContentLength {
+		ranges = append(ranges, models.Range{Start: kept, End: d.ContentLength - 1, Offset: d.ContentLength})
+	}
+	return ranges, nil
+}
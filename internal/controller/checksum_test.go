@@ -0,0 +1,49 @@
+package controller
+
+import "testing"
+
+const (
+	emptyMD5    = "d41d8cd98f00b204e9800998ecf8427e"
+	emptySHA1   = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+func TestParseChecksum(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{name: "tagged", value: "sha256:" + emptySHA256, want: "sha256:" + emptySHA256},
+		{name: "equals sign", value: "sha256=" + emptySHA256, want: "sha256:" + emptySHA256},
+		{name: "spelled with a dash", value: "SHA-256:" + emptySHA256, want: "sha256:" + emptySHA256},
+		{name: "sha alone is sha1", value: "sha:" + emptySHA1, want: "sha1:" + emptySHA1},
+		{name: "uppercase digest", value: "md5:D41D8CD98F00B204E9800998ECF8427E", want: "md5:" + emptyMD5},
+		{name: "surrounding space", value: "  sha256:" + emptySHA256 + "\n", want: "sha256:" + emptySHA256},
+		{name: "md5 by length", value: emptyMD5, want: "md5:" + emptyMD5},
+		{name: "sha1 by length", value: emptySHA1, want: "sha1:" + emptySHA1},
+		{name: "sha256 by length", value: emptySHA256, want: "sha256:" + emptySHA256},
+		{name: "unknown length", value: "abcdef", wantErr: true},
+		{name: "unsupported algorithm", value: "crc32:00000000", wantErr: true},
+		{name: "not hexadecimal", value: "md5:" + emptyMD5[:30] + "zz", wantErr: true},
+		{name: "wrong length for the algorithm", value: "sha256:" + emptyMD5, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseChecksum(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseChecksum(%q) = %q, want an error", tt.value, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseChecksum(%q): %v", tt.value, err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseChecksum(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
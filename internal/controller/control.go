@@ -0,0 +1,84 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/Amirali-Amirifar/gofetch.git/internal/models"
+)
+
+// controlSuffix is appended to a file name to get its control file.
+const controlSuffix = ".gofetch"
+
+// controlFile is the sidecar kept next to a partially downloaded file. It
+// records how far every segment got, so the transfer can be resumed from the
+// files alone even if the database row is lost.
+type controlFile struct {
+	URL           string         `json:"url"`
+	ContentLength int64          `json:"content_length"`
+	ETag          string         `json:"etag,omitempty"`
+	LastModified  string         `json:"last_modified,omitempty"`
+	Ranges        []models.Range `json:"ranges"`
+}
+
+func controlPath(fileName string) string {
+	return fileName + controlSuffix
+}
+
+// writeControl replaces the control file of fileName. It writes to a
+// temporary file first, so a crash never leaves a truncated control file.
+func writeControl(fileName string, c controlFile) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("error marshaling control file: %w", err)
+	}
+
+	tmp := controlPath(fileName) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("error writing control file: %w", err)
+	}
+	if err := os.Rename(tmp, controlPath(fileName)); err != nil {
+		return fmt.Errorf("error replacing control file: %w", err)
+	}
+	return nil
+}
+
+func readControl(fileName string) (controlFile, error) {
+	var c controlFile
+	data, err := os.ReadFile(controlPath(fileName))
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("error unmarshaling control file: %w", err)
+	}
+	return c, nil
+}
+
+func removeControl(fileName string) {
+	os.Remove(controlPath(fileName))
+}
+
+// openTarget opens the file all segments are written into, sizing it to
+// size on first use. Truncating to the final size allocates nothing on file
+// systems that support sparse files; the segments fill it in with WriteAt.
+func openTarget(fileName string, size int64) (*os.File, error) {
+	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.Size() != size {
+		if err := file.Truncate(size); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return file, nil
+}
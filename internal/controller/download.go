@@ -1,150 +1,456 @@
 package controller
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"mime"
 	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
-	"strconv"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/Amirali-Amirifar/gofetch.git/internal/config"
 	"github.com/Amirali-Amirifar/gofetch.git/internal/models"
+	"github.com/Amirali-Amirifar/gofetch.git/internal/queues"
+	"github.com/Amirali-Amirifar/gofetch.git/internal/repository/sqliteDb"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
 )
 
 type Download struct {
 	models.Download
+
+	// mu guards Status, Ranges and the progress fields, which are written by
+	// the part goroutines while the TUI and the database read them.
+	mu          sync.Mutex
+	lastPersist time.Time
+	persistMu   sync.Mutex // Held while persist writes, taken before mu
+
+	// runMu is held for the whole of a run, so a download resumed while its
+	// previous run is still unwinding waits for it instead of racing it.
+	runMu   sync.Mutex
+	cancel  context.CancelCauseFunc // Stops the current run, nil when idle
+	folder  string                  // Storage folder of the queue the download runs in, guarded by mu
+	running bool                    // Set while a queue slot is executing the download
+	halted  bool                    // Set when the daemon stops, after which no run starts
+	seg     *segmenter              // Connections of the current parallel run, nil otherwise
+
+	probe   *probeResponse // Full response of the probe, reused by a single-connection download
+	restart bool           // Probe again and start over on the next run, after the remote file changed
+	refetch bool           // Fetch the corrupted parts again on the next run, after a failed verification
+
+	verifier          *verifier       // Hashes the file as it is written, nil without a checksum
+	discoverChecksums bool            // Look for a published checksum file when created
+	keyring           string          // OpenPGP keys the finished file's signature is checked against
+	badMirrors        map[string]bool // Mirrors excluded during the current run
+
+	// The queue sets these under mu when it starts the download, possibly
+	// while the previous run is still unwinding, so they are read under mu.
+	limiter    *rate.Limiter   // Per-download speed cap, from the queue's MaxDownloadSpeed
+	limiters   []*rate.Limiter // Every bucket a read must pass: download, queue and global
+	maxRetries int             // Retries per segment, from the queue's MaxRetryAttempts
 }
 
-var db = config.GetDB()
+// db stores the downloads. NewScheduler opens it, so only the daemon, which
+// runs the engine, touches the database.
+var db *sqliteDb.SQLiteRepository
+
+// persistInterval is how often segment offsets are flushed to the database
+// while a download is running.
+const persistInterval = time.Second
+
+// Causes a run is stopped with. Neither is retried nor recorded as a failure.
+var (
+	errCanceled = errors.New("canceled")
+	errPaused   = errors.New("paused")
+)
 
-// PauseDownload sets the download state to paused.
+// PauseDownload stops the transfer and closes its connections. The segment
+// offsets are kept, so resuming re-opens them with Range requests.
 func (d *Download) PauseDownload() {
-	if d.Status == models.DownloadStatusDownloading {
-		d.updateStatus(models.DownloadStatusPaused)
-		log.Infof("Download paused for %s", d.URL)
+	d.mu.Lock()
+	if d.Status != models.DownloadStatusDownloading && d.Status != models.DownloadStatusQueued {
+		d.mu.Unlock()
+		return
+	}
+	d.Status = models.DownloadStatusPaused
+	cancel := d.cancel
+	d.mu.Unlock()
+
+	if cancel != nil {
+		cancel(errPaused)
 	}
+	d.persist()
+	log.Infof("Download paused for %s", d.URL)
 }
 
-// ResumeDownload resumes a paused download.
-func (d *Download) ResumeDownload() {
-	if d.Status == models.DownloadStatusPaused {
-		d.updateStatus(models.DownloadStatusDownloading)
-		log.Infof("Download resumed for %s", d.URL)
+// halt stops the current run when the daemon shuts down, and keeps a run
+// about to begin from starting. Unlike a pause it leaves the status alone,
+// so the next daemon continues the download from the persisted offsets.
+func (d *Download) halt() {
+	d.mu.Lock()
+	d.halted = true
+	cancel := d.cancel
+	d.mu.Unlock()
+
+	if cancel != nil {
+		cancel(errPaused)
 	}
 }
 
-// CancelDownload cancels the download.
+// CancelDownload cancels the download, aborting in-flight reads. It is safe
+// to call more than once and concurrently with completion.
 func (d *Download) CancelDownload() {
-	if d.Status != models.DownloadStatusCanceled && d.Status != models.DownloadStatusCompleted {
-		d.updateStatus(models.DownloadStatusCanceled)
-		if d.CancelChan != nil {
-			close(d.CancelChan)
-		}
-		log.Infof("Download canceled for %s", d.URL)
+	d.mu.Lock()
+	if d.Status == models.DownloadStatusCanceled || d.Status == models.DownloadStatusCompleted {
+		d.mu.Unlock()
+		return
 	}
+	d.Status = models.DownloadStatusCanceled
+	cancel := d.cancel
+	d.mu.Unlock()
+
+	if cancel != nil {
+		cancel(errCanceled)
+	}
+	d.persist()
+	log.Infof("Download canceled for %s", d.URL)
 }
 
-// Create gathers initial info (headers, inferred filename, etc.) and kicks off the download.
-func (d *Download) Create() {
-	fileUrl := d.URL
-	log.Infof("Creating download for URL: %s", fileUrl)
+// DeleteFiles deletes the file of a removed download and its control file.
+// A download that never started has none.
+func (d *Download) DeleteFiles() error {
+	d.mu.Lock()
+	fileName := d.FileName
+	d.mu.Unlock()
+	if !filepath.IsAbs(fileName) {
+		return nil
+	}
+	removeControl(fileName)
+	if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete %s: %w", fileName, err)
+	}
+	log.Infof("Deleted %s", fileName)
+	return nil
+}
 
-	// Make the request
-	response, err := http.Get(fileUrl)
-	if err != nil {
-		log.Errorf("Failed to fetch URL: %s, error: %v", fileUrl, err)
-		return
-	}
-	defer response.Body.Close()
+// Snapshot returns a copy of the download's fields, safe to read while the
+// download runs.
+func (d *Download) Snapshot() models.Download {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	snapshot := d.Download
+	snapshot.Ranges = append([]models.Range(nil), d.Ranges...)
+	return snapshot
+}
 
-	// Capture headers
-	d.Headers = response.Header
+// Running reports whether a queue slot is executing the download.
+func (d *Download) Running() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.running
+}
 
-	// Check status code
-	if response.StatusCode != http.StatusOK {
-		log.Errorf("Non-OK HTTP status: %d", response.StatusCode)
-		return
-	}
+// Connections returns the number of connections the download is fetching
+// over right now.
+func (d *Download) Connections() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch {
+	case d.seg != nil:
+		return d.seg.live
+	case d.running && d.Status == models.DownloadStatusDownloading:
+		return 1
+	}
+	return 0
+}
 
-	if contentLength := d.Headers.Get("Content-Length"); contentLength != "" {
-		d.ContentLength, err = strconv.ParseInt(contentLength, 10, 64)
-		if err != nil {
-			log.Errorf("Error parsing Content-Length: %v", err)
-			d.ContentLength = 0
+// ConnectionStatuses describes the connections of the current parallel run,
+// if there is one.
+func (d *Download) ConnectionStatuses() []ConnectionStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.seg == nil {
+		return nil
+	}
+	var statuses []ConnectionStatus
+	for _, c := range d.seg.conns {
+		if !c.retired {
+			statuses = append(statuses, ConnectionStatus{ID: c.id, Mirror: c.mirror, Segment: c.segment, Speed: int64(c.speed)})
 		}
-	} else {
-		log.Warn("Missing Content-Length header")
 	}
+	return statuses
+}
 
-	d.AcceptRanges = d.Headers.Get("Accept-Ranges") == "bytes"
+// Create gathers initial info (headers, inferred filename, etc.) and records
+// the download as queued. The Scheduler starts it once its queue has a slot.
+// A download whose URL cannot be fetched is recorded as failed.
+func (d *Download) Create() error {
+	log.Infof("Creating download for URL: %s", d.URL)
 
-	if contentDisposition := d.Headers.Get("Content-Disposition"); contentDisposition != "" {
-		_, params, err := mime.ParseMediaType(contentDisposition)
+	d.Status = models.DownloadStatusQueued
 
-		if err == nil {
-			if filename, exists := params["filename"]; exists {
-				d.FileName = filename
-				log.Infof("Extracted filename: %s", filename)
-			}
-		} else {
-			log.Warnf("Failed to parse Content-Disposition: %v", err)
+	ctx := context.Background()
+	inspectErr := d.inspect(ctx)
+	if inspectErr != nil && d.failover(ctx, inspectErr) {
+		inspectErr = nil
+	}
+	if inspectErr != nil {
+		log.Errorf("Failed to inspect %s: %v", d.URL, inspectErr)
+		d.Status = models.DownloadStatusFailed
+		d.LastError = inspectErr.Error()
+	} else {
+		log.Infof("Completed capturing initial info of %s: file %s, %d bytes, ranges %t", d.URL, d.FileName, d.ContentLength, d.AcceptRanges)
+		if d.Checksum == "" && d.discoverChecksums {
+			d.discoverChecksum()
 		}
 	}
+	if filepath.IsAbs(d.FileName) {
+		d.FileName = d.claimFilePath(d.FileName)
+	}
 
-	if d.FileName == "" {
-		parsedURL, err := url.Parse(d.URL)
-		if err == nil {
-			segments := strings.Split(parsedURL.Path, "/")
-			d.FileName = segments[len(segments)-1]
+	if err := db.AddNewDownload(&d.Download); err != nil {
+		return fmt.Errorf("failed to save download: %w", err)
+	}
+	return inspectErr
+}
+
+// start runs the download until it completes, fails, is paused or is
+// canceled. Any failure is recorded on the download, which then moves to
+// the failed state.
+func (d *Download) start() error {
+	d.runMu.Lock()
+	defer d.runMu.Unlock()
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	// Paused or canceled while waiting for a slot, or the daemon is stopping.
+	d.mu.Lock()
+	if d.halted || d.Status != models.DownloadStatusQueued && d.Status != models.DownloadStatusDownloading {
+		d.mu.Unlock()
+		return nil
+	}
+	d.Status = models.DownloadStatusDownloading
+	d.cancel = cancel
+	d.running = true
+	d.mu.Unlock()
+	d.persist()
+
+	defer func() {
+		d.mu.Lock()
+		d.cancel = nil
+		d.running = false
+		d.mu.Unlock()
+	}()
+
+	d.mu.Lock()
+	restart, refetch := d.restart, d.refetch
+	d.restart, d.refetch = false, false
+	d.badMirrors = nil
+	d.mu.Unlock()
+
+	var err error
+	if restart {
+		err = d.refresh(ctx)
+	} else if refetch {
+		err = d.resetCorrupted()
+	}
+	if err == nil {
+		err = d.transfer(ctx)
+	}
+	// A file that changed before any of its bytes were kept simply starts over.
+	if errors.Is(err, errChanged) && ctx.Err() == nil && d.written() == 0 {
+		log.Warnf("%s changed before the download began, starting over: %v", d.URL, err)
+		if err = d.refresh(ctx); err == nil {
+			err = d.transfer(ctx)
 		}
 	}
+	// Another mirror may have what this one failed to deliver.
+	for err != nil && ctx.Err() == nil && d.failover(ctx, err) {
+		err = d.transfer(ctx)
+	}
+	if err != nil && ctx.Err() != nil {
+		err = context.Cause(ctx)
+	}
+
+	switch {
+	case errors.Is(err, errPaused):
+		log.Infof("Download %s stopped after pausing at %d bytes", d.URL, d.written())
+		d.persist()
+		return nil
+	case errors.Is(err, errCanceled):
+		log.Infof("Download %s stopped after cancellation", d.URL)
+		d.persist()
+		return nil
+	case errors.Is(err, errVerification):
+		log.Errorf("Download %s failed verification: %v", d.URL, err)
+		d.mu.Lock()
+		d.LastError = err.Error()
+		d.mu.Unlock()
+		d.updateStatus(models.DownloadStatusVerifyFailed)
+		return nil
+	case errors.Is(err, errChanged):
+		log.Warnf("Download %s waits for confirmation to start over: %v", d.URL, err)
+		d.mu.Lock()
+		d.LastError = err.Error()
+		d.mu.Unlock()
+		d.updateStatus(models.DownloadStatusChanged)
+		return nil
+	case err != nil:
+		d.fail(err)
+		return err
+	}
+	d.checkSignature()
+	return nil
+}
 
-	if d.FileName == "" || !strings.Contains(d.FileName, ".") {
-		if contentType := d.Headers.Get("Content-Type"); contentType != "" {
-			ext, _ := mime.ExtensionsByType(contentType)
-			if len(ext) > 0 {
-				d.FileName = "download" + ext[0] // Default name with correct extension
-			}
+// transfer fetches whatever is missing of the file, over several connections
+// when the server and the size allow it.
+func (d *Download) transfer(ctx context.Context) error {
+	if err := d.resolveFilePath(); err != nil {
+		return err
+	}
+
+	d.verifier = nil
+	if d.Checksum != "" {
+		v, err := newVerifier(d.Checksum)
+		if err != nil {
+			return permanent(err)
 		}
+		d.verifier = v
 	}
 
-	log.Infof("Completed capturing initial info of %s, details: %#v", d.URL, d)
-	log.Infof("Starting the download process")
+	// Define a threshold for multipart downloads (e.g., 10 MB).
+	const multiPartThreshold int64 = 10 * 1024 * 1024
+	if d.AcceptRanges && d.ContentLength > multiPartThreshold && len(d.Ranges) != 1 {
+		log.Infof("Server supports multi-part and file size (%d bytes) exceeds threshold. Starting parallel download.", d.ContentLength)
+		return d.startParallel(ctx)
+	}
+	log.Infof("Starting single-threaded download")
+	return d.startSingleThread(ctx)
+}
 
-	d.CancelChan = make(chan struct{})
-	d.Status = models.DownloadStatusQueued
+// refresh forgets the segments and validators of a file that changed and
+// probes it again. The download keeps the path it is saved under.
+func (d *Download) refresh(ctx context.Context) error {
+	d.mu.Lock()
+	fileName := d.FileName
+	// A checksum the old version advertised does not apply to the new one.
+	if d.Checksum != "" && (d.Checksum == checksumFromHeaders(d.Headers, false) || d.Checksum == checksumFromHeaders(d.Headers, true)) {
+		d.Checksum = ""
+	}
+	d.Ranges, d.RangesCount = nil, 0
+	d.CurrentProgress, d.Progress = 0, 0
+	d.LastError = ""
+	d.mu.Unlock()
+
+	err := d.inspect(ctx)
+
+	d.mu.Lock()
+	d.FileName = fileName
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	d.persist()
+	return nil
+}
 
-	err = db.AddNewDownload(&d.Download)
+// resetCorrupted prepares a download that failed verification to fetch its
+// corrupted parts again.
+func (d *Download) resetCorrupted() error {
+	ranges, err := d.corruptedRanges()
 	if err != nil {
-		log.Errorf("Failed to save download: %v", err)
+		return permanent(fmt.Errorf("failed to check pieces of %s: %w", d.FileName, err))
 	}
-	d.start()
+
+	d.mu.Lock()
+	d.Ranges, d.RangesCount = ranges, len(ranges)
+	d.CurrentProgress, d.Progress = 0, 0
+	d.LastError = ""
+	d.mu.Unlock()
+	if ranges == nil {
+		log.Infof("Fetching all of %s again", d.URL)
+	}
+	d.persist()
+	return nil
 }
 
-func (d *Download) start() {
-	// Define a threshold for multipart downloads (e.g., 10 MB).
-	d.updateStatus(models.DownloadStatusDownloading)
-	err := db.UpdateDownload(&d.Download)
+func (d *Download) isRunning() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.running
+}
+
+func (d *Download) status() models.DownloadStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.Status
+}
+
+// resolveFilePath places a relative FileName inside the queue's storage
+// folder and creates that folder. Absolute names were claimed when the
+// download was created, and restored downloads carry the path they were
+// started with.
+func (d *Download) resolveFilePath() error {
+	if d.FileName == "" {
+		log.Errorf("No filename provided")
+		d.FileName = "GoFetch_Download.tmp"
+	}
+	if !filepath.IsAbs(d.FileName) {
+		d.mu.Lock()
+		folder := d.folder
+		d.mu.Unlock()
+		downloadFolder, err := queues.ExpandFolder(folder)
+		if err != nil {
+			return err
+		}
+		d.FileName = d.claimFilePath(filepath.Join(downloadFolder, d.FileName))
+	}
+
+	// Ensure parent directories exist
+	if err := os.MkdirAll(filepath.Dir(d.FileName), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", filepath.Dir(d.FileName), err)
+	}
+	return nil
+}
+
+// claimFilePath returns the path the download is written to when it asks
+// for filePath. A partial file of the same URL there is resumed; any other
+// existing file is kept, and the download gets a name like "file(1).ext"
+// instead.
+func (d *Download) claimFilePath(filePath string) string {
+	if d.adoptControl(filePath) {
+		return filePath
+	}
+	return uniqueFileName(filePath)
+}
+
+// adoptControl takes over the segment offsets recorded in the control file
+// of filePath, if it belongs to the same URL and size.
+func (d *Download) adoptControl(filePath string) bool {
+	c, err := readControl(filePath)
 	if err != nil {
-		log.Errorf("Failed to update download: %v", err)
-		return
+		return false
 	}
-	const multiPartThreshold int64 = 10 * 1024 * 1024
-	if d.AcceptRanges && d.ContentLength > multiPartThreshold {
-		log.Infof("Server supports multi-part and file size (%d bytes) exceeds threshold. Starting parallel download.", d.ContentLength)
-		d.startParallel()
-	} else {
-		log.Infof("Starting single-threaded download")
-		d.startSingleThread()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.Ranges) != 0 || c.URL != d.URL || c.ContentLength != d.ContentLength ||
+		c.ETag != d.ETag || c.LastModified != d.LastModified || len(c.Ranges) == 0 {
+		return false
 	}
+	d.Ranges = c.Ranges
+	d.RangesCount = len(c.Ranges)
+	log.Infof("Resuming %s from the control file of %s", d.URL, filePath)
+	return true
 }
+
 func uniqueFileName(filePath string) string {
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
 		return filePath
@@ -164,118 +470,159 @@ func uniqueFileName(filePath string) string {
 	}
 }
 
-func (d *Download) startSingleThread() {
-	if d.FileName == "" {
-		log.Errorf("No filename provided")
-		d.FileName = "GoFetch_Download.tmp"
+func (d *Download) startSingleThread(ctx context.Context) error {
+	// Only a server that honours ranges lets us pick up where we stopped.
+	d.mu.Lock()
+	if d.AcceptRanges && d.ContentLength > 0 && len(d.Ranges) == 0 {
+		d.Ranges = []models.Range{{Start: 0, End: d.ContentLength - 1}}
+		d.RangesCount = 1
 	}
+	// Record the start time.
+	d.StartTime = time.Now()
+	d.mu.Unlock()
 
-	// Ensure DefaultDownloadFolder is properly expanded
-	downloadFolder := config.DefaultDownloadFolder
-	if strings.HasPrefix(downloadFolder, "~") {
-		homeDir, err := os.UserHomeDir()
-		if err != nil {
-			log.Fatalf("Failed to get home directory: %v", err)
-		}
-		downloadFolder = filepath.Join(homeDir, downloadFolder[2:])
+	err := d.withRetry(ctx, "Download", func(ctx context.Context) error {
+		err := d.fetchSingle(ctx)
+		d.recordFailure(ctx, 0, err)
+		return err
+	})
+	if err != nil {
+		return err
 	}
 
-	// Set full file path
-	d.FileName = filepath.Join(downloadFolder, d.FileName)
+	size := d.ContentLength
+	if size <= 0 {
+		size = d.CurrentProgress
+	}
+	if err := d.verify(size); err != nil {
+		return err
+	}
 
-	// Ensure parent directories exist
-	err := os.MkdirAll(filepath.Dir(d.FileName), os.ModePerm)
-	if err != nil {
-		log.Fatalf("Failed to create directory %s: %v", filepath.Dir(d.FileName), err)
+	if d.complete() {
+		log.Infof("Finished download process for %s, total bytes written: %d", d.FileName, d.CurrentProgress)
 	}
+	return nil
+}
 
-	// Create the file
-	file, err := os.Create(d.FileName)
-	if err != nil {
-		log.Fatalf("Failed to create file %s: %v", d.FileName, err)
+// fetchSingle streams the whole file over one connection, starting at the
+// last written offset when the server supports ranges.
+func (d *Download) fetchSingle(ctx context.Context) error {
+	var offset int64
+	d.mu.Lock()
+	ranged := len(d.Ranges) == 1
+	if ranged {
+		offset = d.Ranges[0].Offset
 	}
-	defer file.Close()
+	d.mu.Unlock()
 
-	log.Infof("Created file %s", file.Name())
+	// A probe answered with the whole file already started the transfer.
+	var resp *http.Response
+	if offset == 0 {
+		resp = d.takeProbe(ctx)
+	}
+	if resp == nil {
+		req, err := http.NewRequestWithContext(ctx, "GET", d.URL, nil)
+		if err != nil {
+			return permanent(err)
+		}
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+			d.setIfRange(req)
+		}
 
-	// Get the HTTP response
-	resp, err := http.Get(d.URL)
-	if err != nil {
-		log.Fatalf("Failed to download %s: %v", d.URL, err)
+		// Get the HTTP response
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
 	}
 	defer resp.Body.Close()
 
-	// Record the start time and update status.
-	d.StartTime = time.Now()
-	d.updateStatus(models.DownloadStatusDownloading)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return newStatusError(resp)
+	}
+	if offset > 0 && resp.StatusCode != http.StatusPartialContent {
+		// A new version of the file must not be appended to the old bytes.
+		if d.ifRange() != "" {
+			return d.fullResponseError()
+		}
+		log.Warnf("Server ignored range request for %s, restarting from the beginning", d.URL)
+		offset = 0
+		d.mu.Lock()
+		d.Ranges[0].Offset = 0
+		d.mu.Unlock()
+	}
+	if resp.StatusCode == http.StatusPartialContent {
+		if err := d.checkValidators(resp.Header); err != nil {
+			return err
+		}
+		if err := d.checkContentRange(resp.Header, offset); err != nil {
+			return err
+		}
+	}
 
-	var totalWritten int64 = 0
-	buf := make([]byte, 32*1024) // 32KB buffer
+	// Without ranges there is nothing to resume, so the file starts empty.
+	var file *os.File
+	var err error
+	if ranged {
+		file, err = openTarget(d.FileName, d.ContentLength)
+	} else {
+		file, err = os.Create(d.FileName)
+	}
+	if err != nil {
+		return permanent(fmt.Errorf("failed to create file %s: %w", d.FileName, err))
+	}
+	defer file.Close()
 
-	for {
+	log.Infof("Created file %s, resuming at byte %d", file.Name(), offset)
 
-		select {
-		case <-d.CancelChan:
-			log.Infof("Download canceled for %s", d.URL)
-			return
-		default:
+	if d.verifier != nil {
+		d.verifier.rewind(offset)
+		if err := d.catchUp(); err != nil {
+			return permanent(fmt.Errorf("failed to read back %s: %w", d.FileName, err))
 		}
+	}
 
-		if d.Status == models.DownloadStatusPaused {
-			time.Sleep(300 * time.Millisecond)
-			continue
-		}
+	totalWritten := offset
+	d.updateProgress(totalWritten)
+	buf := make([]byte, 32*1024) // 32KB buffer
 
+	for {
 		n, err := resp.Body.Read(buf)
 		if n > 0 {
-			written, err2 := file.Write(buf[:n])
+			if err := d.throttle(ctx, n); err != nil {
+				return err
+			}
+			written, err2 := file.WriteAt(buf[:n], totalWritten)
 			if err2 != nil {
-				log.Fatalf("Error writing to file %s: %v", d.FileName, err2)
+				return permanent(fmt.Errorf("error writing to file %s: %w", d.FileName, err2))
 			}
+			d.digest(buf[:written], totalWritten)
 			totalWritten += int64(written)
+			d.mu.Lock()
+			if len(d.Ranges) == 1 {
+				d.Ranges[0].Offset += int64(written)
+			}
+			d.mu.Unlock()
 			d.updateProgress(totalWritten)
 		}
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			log.Fatalf("Error reading response body: %v", err)
+			return fmt.Errorf("error reading response body: %w", err)
 		}
 	}
 
-	if d.Status != models.DownloadStatusCanceled {
-		d.updateStatus(models.DownloadStatusCompleted)
-		log.Infof("Finished download process for %s, total bytes written: %d", file.Name(), totalWritten)
+	if d.ContentLength > 0 && totalWritten < d.ContentLength {
+		return fmt.Errorf("connection closed after %d of %d bytes", totalWritten, d.ContentLength)
 	}
+	return nil
 }
 
-func (d *Download) startParallel() {
-	if d.FileName == "" {
-		log.Errorf("No filename provided")
-		d.FileName = "GoFetch_Download.tmp"
-	}
-
-	// Expand the default download folder.
-	downloadFolder := config.DefaultDownloadFolder
-	if strings.HasPrefix(downloadFolder, "~") {
-		homeDir, err := os.UserHomeDir()
-		if err != nil {
-			log.Fatalf("Failed to get home directory: %v", err)
-		}
-		downloadFolder = filepath.Join(homeDir, downloadFolder[2:])
-	}
-
-	if !filepath.IsAbs(d.FileName) {
-		d.FileName = filepath.Join(downloadFolder, d.FileName)
-	}
-
-	if err := os.MkdirAll(filepath.Dir(d.FileName), os.ModePerm); err != nil {
-		log.Fatalf("Failed to create directory %s: %v", filepath.Dir(d.FileName), err)
-	}
-
-	// Ensure a unique filename.
-	d.FileName = uniqueFileName(d.FileName)
-
+// splitRanges divides the content into at most config.MaxConcurrentDownloads
+// segments of roughly equal size.
+func (d *Download) splitRanges() []models.Range {
 	// We use a 2MB chunk size.
 	const chunkSize int64 = 2 * 1024 * 1024
 	numParts := int(d.ContentLength / chunkSize)
@@ -287,13 +634,8 @@ func (d *Download) startParallel() {
 	if numParts > maxConc {
 		numParts = maxConc
 	}
-	log.Infof("Downloading in %d parts", numParts)
 
-	type byteRange struct {
-		start int64
-		end   int64
-	}
-	var ranges []byteRange
+	var ranges []models.Range
 	partSize := d.ContentLength / int64(numParts)
 	var startByte int64 = 0
 	for i := 0; i < numParts; i++ {
@@ -303,142 +645,153 @@ func (d *Download) startParallel() {
 		} else {
 			endByte = startByte + partSize - 1
 		}
-		ranges = append(ranges, byteRange{start: startByte, end: endByte})
+		ranges = append(ranges, models.Range{Start: startByte, End: endByte, Offset: startByte})
 		startByte = endByte + 1
 	}
+	return ranges
+}
 
-	// Prepare temporary filenames for each part.
-	tempFiles := make([]string, numParts)
-	var wg sync.WaitGroup
-	progressChan := make(chan int64)
-	errorChan := make(chan error, numParts)
-
-	// Record start time and update status.
-	d.StartTime = time.Now()
-	d.updateStatus(models.DownloadStatusDownloading)
-
-	// Start downloading each part concurrently.
-	for i, r := range ranges {
-		wg.Add(1)
-		tempFileName := fmt.Sprintf("%s.part_%d", d.FileName, i)
-		tempFiles[i] = tempFileName
-		go d.downloadPart(i, r.start, r.end, tempFileName, progressChan, &wg, errorChan)
-	}
-	totalProgress := int64(0)
-	// Aggregate progress from all parts.
-	go func() {
-		for p := range progressChan {
-			totalProgress += p
-			d.updateProgress(totalProgress)
-		}
-	}()
-
-	wg.Wait()
-	close(progressChan)
-
-	// Check for any errors.
-	select {
-	case err := <-errorChan:
-		if err != nil {
-			log.Errorf("Error during parallel download: %v", err)
-			return
-		}
-	default:
-		// No error.
+func (d *Download) startParallel(ctx context.Context) error {
+	// Segments survive restarts, so only split a download that has none yet.
+	d.mu.Lock()
+	if len(d.Ranges) == 0 {
+		d.Ranges = d.splitRanges()
+		d.RangesCount = len(d.Ranges)
 	}
+	numParts := len(d.Ranges)
+	d.mu.Unlock()
+	log.Infof("Downloading in %d parts", numParts)
 
-	// Merge all part files into the final file.
-	finalFile, err := os.Create(d.FileName)
+	// Every segment writes its bytes in place, so there is nothing to merge.
+	file, err := openTarget(d.FileName, d.ContentLength)
 	if err != nil {
-		log.Fatalf("Failed to create final file %s: %v", d.FileName, err)
+		return permanent(fmt.Errorf("failed to create file %s: %w", d.FileName, err))
 	}
-	defer finalFile.Close()
-
-	for i := 0; i < numParts; i++ {
-		partFile, err := os.Open(tempFiles[i])
-		if err != nil {
-			log.Fatalf("Failed to open part file %s: %v", tempFiles[i], err)
-		}
-		_, err = io.Copy(finalFile, partFile)
-		partFile.Close()
-		if err != nil {
-			log.Fatalf("Failed to merge part file %s: %v", tempFiles[i], err)
-		}
-		// Remove temporary part file.
-		os.Remove(tempFiles[i])
-	}
-
-	if d.Status != models.DownloadStatusCanceled {
-		d.updateStatus(models.DownloadStatusCompleted)
-		log.Infof("Finished parallel download for %s", d.FileName)
-	}
-}
-
-func (d *Download) downloadPart(index int, startByte, endByte int64, tempFileName string, progressChan chan<- int64, wg *sync.WaitGroup, errorChan chan error) {
-	defer wg.Done()
+	defer file.Close()
 
-	req, err := http.NewRequest("GET", d.URL, nil)
+	// Record start time.
+	d.mu.Lock()
+	d.StartTime = time.Now()
+	d.mu.Unlock()
+
+	seg := newSegmenter(ctx, d, file, config.MaxConcurrentDownloads)
+	d.mu.Lock()
+	d.seg = seg
+	d.mu.Unlock()
+	err = seg.run()
+	d.mu.Lock()
+	d.seg = nil
+	d.mu.Unlock()
 	if err != nil {
-		errorChan <- fmt.Errorf("part %d: %v", index, err)
-		return
+		return err
 	}
-	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", startByte, endByte))
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		errorChan <- fmt.Errorf("part %d: %v", index, err)
-		return
+	if err := d.verify(d.ContentLength); err != nil {
+		return err
 	}
-	defer resp.Body.Close()
 
-	file, err := os.Create(tempFileName)
-	if err != nil {
-		errorChan <- fmt.Errorf("part %d: %v", index, err)
-		return
+	if d.complete() {
+		log.Infof("Finished parallel download for %s in %d segments", d.FileName, d.RangesCount)
 	}
-	defer file.Close()
-
-	buf := make([]byte, 32*1024) // 32KB chunks
-	for {
-
-		select {
-		case <-d.CancelChan:
-			errorChan <- fmt.Errorf("part %d: canceled", index)
-			return
-		default:
-		}
+	return nil
+}
 
-		n, err := resp.Body.Read(buf)
-		if n > 0 {
-			written, err2 := file.Write(buf[:n])
-			if err2 != nil {
-				errorChan <- fmt.Errorf("part %d: %v", index, err2)
-				return
-			}
-			progressChan <- int64(written)
-		}
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			errorChan <- fmt.Errorf("part %d: %v", index, err)
-			return
-		}
-	}
+// fail records err on the download and moves it to the failed state.
+func (d *Download) fail(err error) {
+	d.mu.Lock()
+	d.LastError = err.Error()
+	d.mu.Unlock()
+	d.updateStatus(models.DownloadStatusFailed)
 }
 
 func (d *Download) updateStatus(status models.DownloadStatus) {
+	d.mu.Lock()
 	d.Status = status
-	func() {
-		err := db.UpdateDownload(&d.Download)
+	d.mu.Unlock()
+	d.persist()
+}
+
+// complete marks a finished transfer as completed. It reports false if the
+// download was paused or canceled while its last bytes were written.
+func (d *Download) complete() bool {
+	d.mu.Lock()
+	if d.Status != models.DownloadStatusDownloading {
+		d.mu.Unlock()
+		return false
+	}
+	d.Status = models.DownloadStatusCompleted
+	d.mu.Unlock()
+	d.persist()
+	return true
+}
+
+// persist writes the download, including its segment offsets, to the
+// database and to the control file next to the partial file. The control
+// file goes away once the download completes. The writes work on a copy,
+// so the connections are not held up while they wait for the disk.
+func (d *Download) persist() {
+	// persistMu is taken first, so a copy is never written over a newer one.
+	d.persistMu.Lock()
+	defer d.persistMu.Unlock()
+
+	d.mu.Lock()
+	d.lastPersist = time.Now()
+	download := d.Download
+	download.Ranges = slices.Clone(d.Ranges)
+	download.Mirrors = slices.Clone(d.Mirrors)
+	download.Redirects = slices.Clone(d.Redirects)
+	download.Headers = d.Headers.Clone()
+	d.mu.Unlock()
+
+	err := db.UpdateDownload(&download)
+	if err != nil {
+		log.Errorf("Failed to update download status: %v", err)
+	}
+
+	switch {
+	case download.Status == models.DownloadStatusCompleted:
+		removeControl(download.FileName)
+	case len(download.Ranges) > 0 && filepath.IsAbs(download.FileName):
+		err := writeControl(download.FileName, controlFile{
+			URL:           download.URL,
+			ContentLength: download.ContentLength,
+			ETag:          download.ETag,
+			LastModified:  download.LastModified,
+			Ranges:        download.Ranges,
+		})
 		if err != nil {
-			log.Errorf("Failed to update download status: %v", err)
+			log.Errorf("Failed to update control file of %s: %v", download.FileName, err)
 		}
-	}()
+	}
 }
 
 func (d *Download) updateProgress(totalWritten int64) {
+	d.mu.Lock()
 	d.CurrentProgress = totalWritten
 	if d.ContentLength != 0 {
-		d.Progress = int(totalWritten/d.ContentLength) * 100
+		d.Progress = int(totalWritten * 100 / d.ContentLength)
+	}
+	// The connection that finds the interval over claims the write, so the
+	// others seeing it at the same time do not write as well.
+	now := time.Now()
+	due := now.Sub(d.lastPersist) >= persistInterval
+	if due {
+		d.lastPersist = now
+	}
+	d.mu.Unlock()
+
+	if due {
+		d.persist()
+	}
+}
+
+// written returns the number of bytes already on disk according to the
+// persisted segment offsets.
+func (d *Download) written() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var total int64
+	for _, r := range d.Ranges {
+		total += r.Written()
 	}
+	return total
 }
@@ -0,0 +1,258 @@
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Amirali-Amirifar/gofetch.git/internal/config"
+	"github.com/Amirali-Amirifar/gofetch.git/internal/models"
+	"github.com/Amirali-Amirifar/gofetch.git/internal/repository/sqliteDb"
+	log "github.com/sirupsen/logrus"
+)
+
+// TestMain gives the engine a database of its own, which persist writes to.
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+
+	// The schema is read relative to the repository root, where gofetch runs.
+	if err := os.Chdir("../.."); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	dir, err := os.MkdirTemp("", "gofetch-test")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	// NewScheduler picks it up from the configuration.
+	config.DB, err = sqliteDb.New(filepath.Join(dir, "test.db"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	db = config.DB
+
+	code := m.Run()
+	db.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// modTime is the Last-Modified of the files test servers serve first.
+var modTime = time.Date(2026, time.January, 2, 3, 4, 5, 0, time.UTC)
+
+// testContent returns size bytes that differ between nearby offsets, so a
+// byte written at the wrong place shows.
+func testContent(size int) []byte {
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i*31 + i>>8)
+	}
+	return content
+}
+
+// fileServer serves content with range support, and records the Range
+// header of every GET it answers.
+type fileServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	content  []byte
+	etag     string // Sent when set, and then compared with If-Range
+	modified time.Time
+	ranges   []string
+	// handle, if set, may answer GET number attempt, counted from 1, in
+	// place of the content. It reports whether it did.
+	handle func(w http.ResponseWriter, r *http.Request, attempt int) bool
+}
+
+func newFileServer(t *testing.T, content []byte) *fileServer {
+	t.Helper()
+	s := &fileServer{content: content, modified: modTime}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fileServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	handle := s.handle
+	attempt := 0
+	if r.Method == http.MethodGet {
+		s.ranges = append(s.ranges, r.Header.Get("Range"))
+		attempt = len(s.ranges)
+	}
+	s.mu.Unlock()
+
+	if handle != nil && attempt > 0 && handle(w, r, attempt) {
+		return
+	}
+	s.serveContent(w, r)
+}
+
+// serveContent answers r with the content, or the part of it r asks for.
+func (s *fileServer) serveContent(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	content, etag, modified := s.content, s.etag, s.modified
+	s.mu.Unlock()
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	http.ServeContent(w, r, "file.bin", modified, bytes.NewReader(content))
+}
+
+// replace publishes a new version of the file.
+func (s *fileServer) replace(content []byte, etag string, modified time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.content, s.etag, s.modified = content, etag, modified
+}
+
+// requested returns the Range headers of the GETs answered so far.
+func (s *fileServer) requested() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.ranges...)
+}
+
+// newTestDownload probes the file of s and records it as a new download
+// saved in a temporary folder, ready to start.
+func newTestDownload(t *testing.T, s *fileServer) *Download {
+	t.Helper()
+	d := &Download{Download: models.Download{
+		URL:      s.URL + "/file.bin",
+		FileName: filepath.Join(t.TempDir(), "file.bin"),
+	}}
+	if err := d.Create(); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	return d
+}
+
+// prepare sets up a download interrupted at the offsets of ranges: the
+// bytes before every offset are on disk, and nothing after them.
+func prepare(t *testing.T, d *Download, content []byte, ranges []models.Range) {
+	t.Helper()
+	partial := make([]byte, len(content))
+	for _, r := range ranges {
+		copy(partial[r.Start:r.Offset], content[r.Start:r.Offset])
+	}
+	if err := os.WriteFile(d.FileName, partial, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	d.Ranges = slices.Clone(ranges)
+	d.RangesCount = len(ranges)
+}
+
+// checkFile fails the test unless the file of d holds want.
+func checkFile(t *testing.T, d *Download, want []byte) {
+	t.Helper()
+	got, err := os.ReadFile(d.FileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		i := 0
+		for i < min(len(got), len(want)) && got[i] == want[i] {
+			i++
+		}
+		t.Fatalf("file has %d bytes and differs from the expected %d bytes at offset %d", len(got), len(want), i)
+	}
+}
+
+// parseRange returns the first and last byte of a "bytes=a-b" or "bytes=a-"
+// request header, the last being size-1 for an open range.
+func parseRange(t *testing.T, header string, size int64) (int64, int64) {
+	t.Helper()
+	first, last, ok := strings.Cut(strings.TrimPrefix(header, "bytes="), "-")
+	if !ok {
+		t.Fatalf("malformed Range header %q", header)
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		t.Fatalf("malformed Range header %q", header)
+	}
+	if last == "" {
+		return start, size - 1
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil {
+		t.Fatalf("malformed Range header %q", header)
+	}
+	return start, end
+}
+
+func TestResumeFromOffsets(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		ranges func(size int64) []models.Range
+	}{
+		{
+			name: "single connection",
+			size: 1 << 20,
+			ranges: func(size int64) []models.Range {
+				return []models.Range{{Start: 0, End: size - 1, Offset: size / 3}}
+			},
+		},
+		{
+			name: "parallel segments",
+			size: 12 << 20,
+			ranges: func(size int64) []models.Range {
+				quarter := size / 4
+				return []models.Range{
+					{Start: 0, End: quarter - 1, Offset: quarter - 1},
+					{Start: quarter, End: 2*quarter - 1, Offset: quarter + 12345},
+					{Start: 2 * quarter, End: 3*quarter - 1, Offset: 3 * quarter},
+					{Start: 3 * quarter, End: size - 1, Offset: 3 * quarter},
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := testContent(tt.size)
+			s := newFileServer(t, content)
+			d := newTestDownload(t, s)
+			size := int64(tt.size)
+			ranges := tt.ranges(size)
+			prepare(t, d, content, ranges)
+
+			if err := d.start(); err != nil {
+				t.Fatalf("start: %v", err)
+			}
+			if d.Status != models.DownloadStatusCompleted {
+				t.Fatalf("status = %s, want %s: %s", d.Status, models.DownloadStatusCompleted, d.LastError)
+			}
+			checkFile(t, d, content)
+
+			requested := s.requested()
+			if len(requested) == 0 {
+				t.Fatal("nothing was requested")
+			}
+			// No request may ask again for bytes that were already on disk.
+			for _, header := range requested {
+				first, last := parseRange(t, header, size)
+				for _, r := range ranges {
+					if first < r.Offset && last >= r.Start {
+						t.Errorf("%s fetches bytes %d-%d again", header, max(first, r.Start), min(last, r.Offset-1))
+					}
+				}
+			}
+			if _, err := os.Stat(controlPath(d.FileName)); !os.IsNotExist(err) {
+				t.Errorf("control file left behind after completion: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package controller
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/Amirali-Amirifar/gofetch.git/internal/models"
+)
+
+// maxMetalinkSize caps how much of a metalink is read. Piece hashes of large
+// files make these much bigger than checksum files.
+const maxMetalinkSize = 16 << 20
+
+// defaultPriority ranks mirrors that state no priority below all others, as
+// RFC 5854 allows priorities from 1 to 999999.
+const defaultPriority = 999999
+
+// metalink covers both RFC 5854 (metalink 4) and metalink 3 documents.
+// Elements are matched by local name, so either namespace is accepted.
+type metalink struct {
+	Files   []metalinkFile `xml:"file"`       // Metalink 4
+	V3Files []metalinkFile `xml:"files>file"` // Metalink 3
+}
+
+type metalinkFile struct {
+	Name   string           `xml:"name,attr"`
+	Size   int64            `xml:"size"`
+	Hashes []metalinkHash   `xml:"hash"`
+	Pieces []metalinkPieces `xml:"pieces"`
+	URLs   []metalinkURL    `xml:"url"`
+
+	// Metalink 3 nests the same information one level deeper.
+	Verification struct {
+		Hashes []metalinkHash   `xml:"hash"`
+		Pieces []metalinkPieces `xml:"pieces"`
+	} `xml:"verification"`
+	Resources struct {
+		URLs []metalinkURL `xml:"url"`
+	} `xml:"resources"`
+}
+
+type metalinkHash struct {
+	Type  string `xml:"type,attr"`
+	Piece int    `xml:"piece,attr"` // Metalink 3 numbers piece hashes
+	Value string `xml:",chardata"`
+}
+
+type metalinkPieces struct {
+	Type   string         `xml:"type,attr"`
+	Length int64          `xml:"length,attr"`
+	Hashes []metalinkHash `xml:"hash"`
+}
+
+type metalinkURL struct {
+	Type       string `xml:"type,attr"`       // Metalink 3: http, ftp, bittorrent...
+	Location   string `xml:"location,attr"`   // ISO 3166-1 country code
+	Priority   int    `xml:"priority,attr"`   // Metalink 4: 1 is the most preferred
+	Preference int    `xml:"preference,attr"` // Metalink 3: 100 is the most preferred
+	Value      string `xml:",chardata"`
+}
+
+// IsMetalink reports whether source, a URL or a local path, names a
+// metalink file.
+func IsMetalink(source string) bool {
+	name := source
+	if u, err := url.Parse(source); err == nil && u.Scheme != "" {
+		name = u.Path
+	}
+	name = strings.ToLower(name)
+	return strings.HasSuffix(name, ".meta4") || strings.HasSuffix(name, ".metalink")
+}
+
+// readMetalink loads a metalink from a URL or a local path and returns one
+// download per file it describes. Mirrors are ordered by priority, and
+// mirrors in one of locations come first among those of equal priority.
+func readMetalink(source string, locations []string) ([]models.Download, error) {
+	var data []byte
+	if IsURL(source) {
+		body, err := fetchText(source, maxMetalinkSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch metalink %s: %w", source, err)
+		}
+		data = []byte(body)
+	} else {
+		var err error
+		if data, err = os.ReadFile(source); err != nil {
+			return nil, fmt.Errorf("failed to read metalink: %w", err)
+		}
+	}
+
+	var doc metalink
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse metalink %s: %w", source, err)
+	}
+
+	var downloads []models.Download
+	for _, f := range append(doc.Files, doc.V3Files...) {
+		download, err := f.download(locations)
+		if err != nil {
+			return nil, fmt.Errorf("metalink %s: %w", source, err)
+		}
+		downloads = append(downloads, download)
+	}
+	if len(downloads) == 0 {
+		return nil, fmt.Errorf("metalink %s lists no files", source)
+	}
+	return downloads, nil
+}
+
+func (f metalinkFile) download(locations []string) (models.Download, error) {
+	var mirrors []models.Mirror
+	for _, u := range append(f.URLs, f.Resources.URLs...) {
+		value := strings.TrimSpace(u.Value)
+		if !strings.HasPrefix(value, "http://") && !strings.HasPrefix(value, "https://") {
+			continue
+		}
+		priority := u.Priority
+		if u.Preference > 0 {
+			priority = 101 - min(u.Preference, 100)
+		}
+		if priority <= 0 {
+			priority = defaultPriority
+		}
+		mirrors = append(mirrors, models.Mirror{URL: value, Priority: priority, Location: strings.ToLower(u.Location)})
+	}
+	if len(mirrors) == 0 {
+		return models.Download{}, fmt.Errorf("file %q has no HTTP mirror", f.Name)
+	}
+	sortMirrors(mirrors, locations)
+
+	download := models.Download{
+		URL:           mirrors[0].URL,
+		Mirrors:       mirrors,
+		FileName:      ConfineName(f.Name),
+		ContentLength: f.Size,
+	}
+	download.Checksum = strongestHash(append(f.Hashes, f.Verification.Hashes...))
+	download.Pieces = strongestPieces(append(f.Pieces, f.Verification.Pieces...))
+	return download, nil
+}
+
+// sortMirrors orders mirrors by priority, preferring those in one of
+// locations when priorities are equal.
+func sortMirrors(mirrors []models.Mirror, locations []string) {
+	preferred := func(m models.Mirror) bool {
+		for _, location := range locations {
+			if m.Location != "" && strings.EqualFold(m.Location, location) {
+				return true
+			}
+		}
+		return false
+	}
+	sort.SliceStable(mirrors, func(i, j int) bool {
+		if mirrors[i].Priority != mirrors[j].Priority {
+			return mirrors[i].Priority < mirrors[j].Priority
+		}
+		return preferred(mirrors[i]) && !preferred(mirrors[j])
+	})
+}
+
+// ConfineName keeps the relative directories of a file name from a metalink
+// or a remote client, but never lets them leave the storage folder. A name
+// without a file in it is dropped, so the download is named after its URL
+// instead.
+func ConfineName(name string) string {
+	clean := path.Clean(strings.ReplaceAll(name, "\\", "/"))
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		clean = path.Base(clean)
+	}
+	switch clean {
+	case ".", "..", "/":
+		return ""
+	}
+	return clean
+}
+
+// metalinkStrength lists the hash types of metalinks, strongest first.
+var metalinkStrength = []string{"sha512", "sha256", "sha1", "md5"}
+
+func strongestHash(hashes []metalinkHash) string {
+	for _, algorithm := range metalinkStrength {
+		for _, h := range hashes {
+			if normalizeAlgorithm(h.Type) != algorithm {
+				continue
+			}
+			if checksum, err := ParseChecksum(algorithm + ":" + strings.TrimSpace(h.Value)); err == nil {
+				return checksum
+			}
+		}
+	}
+	return ""
+}
+
+func strongestPieces(pieces []metalinkPieces) *models.Pieces {
+	for _, algorithm := range metalinkStrength {
+		for _, p := range pieces {
+			if normalizeAlgorithm(p.Type) != algorithm || p.Length <= 0 || len(p.Hashes) == 0 {
+				continue
+			}
+			hashes, err := pieceHashes(p.Hashes)
+			if err != nil {
+				continue
+			}
+			return &models.Pieces{Algorithm: algorithm, Length: p.Length, Hashes: hashes}
+		}
+	}
+	return nil
+}
+
+// pieceHashes returns the hashes in file order. Metalink 4 lists them in
+// order; metalink 3 numbers them.
+func pieceHashes(entries []metalinkHash) ([]string, error) {
+	numbered := false
+	for _, h := range entries {
+		numbered = numbered || h.Piece != 0
+	}
+
+	hashes := make([]string, len(entries))
+	for i, h := range entries {
+		index := i
+		if numbered {
+			index = h.Piece
+		}
+		if index < 0 || index >= len(hashes) || hashes[index] != "" {
+			return nil, errors.New("piece hashes are not numbered 0 to n-1")
+		}
+		hashes[index] = strings.ToLower(strings.TrimSpace(h.Value))
+	}
+	return hashes, nil
+}
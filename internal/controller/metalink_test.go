@@ -0,0 +1,184 @@
+package controller
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Amirali-Amirifar/gofetch.git/internal/models"
+)
+
+const metalink4 = `<?xml version="1.0" encoding="UTF-8"?>
+<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <file name="../../etc/passwd">
+    <size>4096</size>
+    <hash type="md5">` + emptyMD5 + `</hash>
+    <hash type="sha-256">` + emptySHA256 + `</hash>
+    <pieces type="sha-1" length="1024">
+      <hash>AA</hash>
+      <hash>bb</hash>
+    </pieces>
+    <url priority="2">http://b.example.com/passwd</url>
+    <url priority="1" location="de">https://a.example.com/passwd</url>
+    <url>http://c.example.com/passwd</url>
+    <url priority="2" location="fr">http://d.example.com/passwd</url>
+    <url priority="1">ftp://a.example.com/passwd</url>
+  </file>
+</metalink>`
+
+const metalink3 = `<?xml version="1.0" encoding="UTF-8"?>
+<metalink version="3.0" xmlns="http://www.metalinker.org/">
+  <files>
+    <file name="dist/app.iso">
+      <size>2048</size>
+      <verification>
+        <hash type="sha1">` + emptySHA1 + `</hash>
+        <pieces type="sha1" length="1024">
+          <hash piece="1">22</hash>
+          <hash piece="0">11</hash>
+        </pieces>
+      </verification>
+      <resources>
+        <url type="http" preference="50">http://low.example.com/app.iso</url>
+        <url type="http" preference="100" location="us">http://high.example.com/app.iso</url>
+        <url type="http">http://any.example.com/app.iso</url>
+      </resources>
+    </file>
+  </files>
+</metalink>`
+
+func writeMetalink(t *testing.T, name, content string) string {
+	t.Helper()
+	fileName := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(fileName, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func TestReadMetalink(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		locations []string
+		want      []models.Download
+	}{
+		{
+			name:      "metalink 4",
+			content:   metalink4,
+			locations: []string{"FR"},
+			want: []models.Download{{
+				URL:           "https://a.example.com/passwd",
+				FileName:      "passwd",
+				ContentLength: 4096,
+				Checksum:      "sha256:" + emptySHA256,
+				Pieces:        &models.Pieces{Algorithm: "sha1", Length: 1024, Hashes: []string{"aa", "bb"}},
+				Mirrors: []models.Mirror{
+					{URL: "https://a.example.com/passwd", Priority: 1, Location: "de"},
+					{URL: "http://d.example.com/passwd", Priority: 2, Location: "fr"},
+					{URL: "http://b.example.com/passwd", Priority: 2},
+					{URL: "http://c.example.com/passwd", Priority: defaultPriority},
+				},
+			}},
+		},
+		{
+			name:    "metalink 3",
+			content: metalink3,
+			want: []models.Download{{
+				URL:           "http://high.example.com/app.iso",
+				FileName:      "dist/app.iso",
+				ContentLength: 2048,
+				Checksum:      "sha1:" + emptySHA1,
+				Pieces:        &models.Pieces{Algorithm: "sha1", Length: 1024, Hashes: []string{"11", "22"}},
+				Mirrors: []models.Mirror{
+					{URL: "http://high.example.com/app.iso", Priority: 1, Location: "us"},
+					{URL: "http://low.example.com/app.iso", Priority: 51},
+					{URL: "http://any.example.com/app.iso", Priority: defaultPriority},
+				},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readMetalink(writeMetalink(t, "test.meta4", tt.content), tt.locations)
+			if err != nil {
+				t.Fatalf("readMetalink: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readMetalink() =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadMetalinkErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "not XML", content: "not a metalink"},
+		{name: "no files", content: `<metalink xmlns="urn:ietf:params:xml:ns:metalink"></metalink>`},
+		{name: "no HTTP mirror", content: `<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <file name="a.bin"><url>ftp://example.com/a.bin</url></file>
+</metalink>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := readMetalink(writeMetalink(t, "test.meta4", tt.content), nil); err == nil {
+				t.Errorf("readMetalink() = %+v, want an error", got)
+			}
+		})
+	}
+}
+
+func TestConfineName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "app.iso", want: "app.iso"},
+		{name: "dist/app.iso", want: "dist/app.iso"},
+		{name: "dist/./old/../app.iso", want: "dist/app.iso"},
+		{name: "../app.iso", want: "app.iso"},
+		{name: "../../etc/passwd", want: "passwd"},
+		{name: "dist/../../app.iso", want: "app.iso"},
+		{name: "/etc/passwd", want: "passwd"},
+		{name: `..\..\windows\system.ini`, want: "system.ini"},
+		{name: "..", want: ""},
+		{name: "/", want: ""},
+		{name: "", want: ""},
+		{name: ".", want: ""},
+	}
+	for _, tt := range tests {
+		if got := ConfineName(tt.name); got != tt.want {
+			t.Errorf("ConfineName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPieceHashes(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []metalinkHash
+		want    []string
+		wantErr bool
+	}{
+		{name: "in order", entries: []metalinkHash{{Value: "a"}, {Value: "b"}}, want: []string{"a", "b"}},
+		{name: "numbered", entries: []metalinkHash{{Piece: 2, Value: "c"}, {Piece: 0, Value: "a"}, {Piece: 1, Value: "b"}}, want: []string{"a", "b", "c"}},
+		{name: "duplicate number", entries: []metalinkHash{{Piece: 1, Value: "a"}, {Piece: 1, Value: "b"}}, wantErr: true},
+		{name: "number out of range", entries: []metalinkHash{{Piece: 0, Value: "a"}, {Piece: 5, Value: "b"}}, wantErr: true},
+		{name: "negative number", entries: []metalinkHash{{Piece: -1, Value: "a"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := pieceHashes(tt.entries)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("pieceHashes() error = %v, want an error: %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pieceHashes() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errMirrorMismatch means a mirror serves another file than the download:
+// a different size, or a different version than it served before.
+var errMirrorMismatch = errors.New("mirror serves a different file")
+
+// mirrorFault reports whether err is the fault of the server the download
+// talked to, so that another mirror might do better.
+func mirrorFault(err error) bool {
+	if errors.Is(err, errCanceled) || errors.Is(err, errPaused) || errors.Is(err, errRetired) ||
+		errors.Is(err, errChanged) || errors.Is(err, errVerification) {
+		return false
+	}
+	// Errors writing the file are not the mirror's fault.
+	var pathErr *os.PathError
+	return !errors.As(err, &pathErr)
+}
+
+// usableMirrorsLocked returns the mirror URLs not excluded during this run,
+// preferred first. A download without mirrors only has its URL.
+func (d *Download) usableMirrorsLocked() []string {
+	if len(d.Mirrors) == 0 {
+		return []string{d.URL}
+	}
+	var urls []string
+	for _, m := range d.Mirrors {
+		if !d.badMirrors[m.URL] {
+			urls = append(urls, m.URL)
+		}
+	}
+	return urls
+}
+
+func (d *Download) excludeMirrorLocked(url string, err error) {
+	if d.badMirrors == nil {
+		d.badMirrors = make(map[string]bool)
+	}
+	if !d.badMirrors[url] {
+		d.badMirrors[url] = true
+		log.Warnf("Excluding mirror %s: %v", url, err)
+	}
+}
+
+// failover moves the download to its next usable mirror after its URL
+// failed with cause. The mirror is probed first and skipped unless it
+// serves a file of the same size. It reports false when no mirror is left,
+// or when ctx is done before one is found.
+func (d *Download) failover(ctx context.Context, cause error) bool {
+	if len(d.Mirrors) == 0 || !mirrorFault(cause) {
+		return false
+	}
+
+	d.mu.Lock()
+	d.excludeMirrorLocked(d.URL, cause)
+	d.mu.Unlock()
+
+	for {
+		d.mu.Lock()
+		next := ""
+		for _, u := range d.usableMirrorsLocked() {
+			if u != d.URL {
+				next = u
+				break
+			}
+		}
+		if next == "" {
+			d.mu.Unlock()
+			return false
+		}
+		old := d.probedLocked()
+		d.URL = next
+		// Validators of one server say nothing about the copy on another.
+		d.ETag, d.LastModified = "", ""
+		d.mu.Unlock()
+
+		err := d.inspect(ctx)
+
+		d.mu.Lock()
+		if ctx.Err() != nil {
+			// Stopped while probing: the mirror is not to blame.
+			d.restoreLocked(old)
+			d.mu.Unlock()
+			return false
+		}
+		if old.FileName != "" {
+			d.FileName = old.FileName
+		}
+		if err == nil && old.ContentLength > 0 && d.ContentLength != old.ContentLength {
+			err = fmt.Errorf("%w: %d bytes instead of %d", errMirrorMismatch, d.ContentLength, old.ContentLength)
+		}
+		if err != nil {
+			d.excludeMirrorLocked(next, err)
+			// Back on the old server, its validators still guard a resume
+			// against a changed file.
+			d.restoreLocked(old)
+			d.mu.Unlock()
+			continue
+		}
+		d.mu.Unlock()
+		log.Warnf("Switching from %s to mirror %s: %v", old.URL, next, cause)
+		return true
+	}
+}
+
+// probed is what inspect learns about the file on a server.
+type probed struct {
+	URL           string
+	FileName      string
+	Headers       http.Header
+	ContentLength int64
+	ContentType   string
+	AcceptRanges  bool
+	ETag          string
+	LastModified  string
+	Checksum      string
+	Redirects     []string
+}
+
+func (d *Download) probedLocked() probed {
+	return probed{
+		URL:           d.URL,
+		FileName:      d.FileName,
+		Headers:       d.Headers,
+		ContentLength: d.ContentLength,
+		ContentType:   d.ContentType,
+		AcceptRanges:  d.AcceptRanges,
+		ETag:          d.ETag,
+		LastModified:  d.LastModified,
+		Checksum:      d.Checksum,
+		Redirects:     d.Redirects,
+	}
+}
+
+// restoreLocked puts back what was learned about the file before a mirror
+// was probed, and drops a response that mirror may have left to reuse.
+func (d *Download) restoreLocked(p probed) {
+	d.URL, d.FileName = p.URL, p.FileName
+	d.Headers = p.Headers
+	d.ContentLength, d.ContentType, d.AcceptRanges = p.ContentLength, p.ContentType, p.AcceptRanges
+	d.ETag, d.LastModified = p.ETag, p.LastModified
+	d.Checksum = p.Checksum
+	d.Redirects = p.Redirects
+	if d.probe != nil {
+		d.probe.timer.Stop()
+		d.probe.close()
+		d.probe = nil
+	}
+}
+
+// checkMirrorLocked compares a partial response of a mirror other than the
+// main URL with the download. The mirror must serve a file of the same
+// size, and the same version of it throughout the run.
+func (s *segmenter) checkMirrorLocked(url string, header http.Header) error {
+	if size, ok := parseContentRange(header.Get("Content-Range")); ok && s.d.ContentLength > 0 && size != s.d.ContentLength {
+		return fmt.Errorf("%w: %d bytes instead of %d", errMirrorMismatch, size, s.d.ContentLength)
+	}
+	etag := header.Get("ETag")
+	if etag == "" {
+		return nil
+	}
+	if seen, ok := s.etags[url]; ok && seen != etag {
+		return fmt.Errorf("%w: ETag %s is now %s", errMirrorMismatch, seen, etag)
+	}
+	s.etags[url] = etag
+	return nil
+}
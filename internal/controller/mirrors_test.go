@@ -0,0 +1,55 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/Amirali-Amirifar/gofetch.git/internal/models"
+)
+
+func TestFailoverRestoresProbe(t *testing.T) {
+	content := testContent(1 << 20)
+	primary := newFileServer(t, content)
+	primary.etag = `"v1"`
+
+	// The other mirror has another file, behind a redirect, and answers the
+	// probe with all of it.
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/moved":
+			http.Redirect(w, r, "/other.bin", http.StatusFound)
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("ETag", `"other"`)
+			w.Header().Set("X-Mirror", "other")
+			w.Write(content[:1000])
+		}
+	}))
+	defer other.Close()
+
+	d := newTestDownload(t, primary)
+	d.Mirrors = []models.Mirror{{URL: d.URL}, {URL: other.URL + "/moved"}}
+	d.mu.Lock()
+	want := d.probedLocked()
+	d.mu.Unlock()
+
+	if d.failover(context.Background(), errors.New("connection reset")) {
+		t.Fatalf("failover switched to %s, which serves a different file", d.URL)
+	}
+	d.mu.Lock()
+	got := d.probedLocked()
+	probe := d.probe
+	d.mu.Unlock()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("after a failed failover the download has\n%+v\nwant\n%+v", got, want)
+	}
+	if probe != nil {
+		t.Error("the response of the rejected mirror is kept for reuse")
+	}
+}
@@ -0,0 +1,281 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// probeTimeout bounds how long a probe waits for response headers.
+	probeTimeout = 30 * time.Second
+	// probeKeepAlive is how long the body of a probe that turned out to be a
+	// full transfer is kept for the download to consume. After that the
+	// connection is closed and the download issues a new request.
+	probeKeepAlive = 10 * time.Second
+)
+
+// probeResponse is the body of a GET probe the server answered with the whole
+// file. Single-connection downloads continue from it instead of asking again.
+type probeResponse struct {
+	resp   *http.Response
+	cancel context.CancelFunc
+	timer  *time.Timer
+}
+
+func (p *probeResponse) close() {
+	p.resp.Body.Close()
+	p.cancel()
+}
+
+// inspect probes the URL to capture its headers, size, range support and a
+// file name without transferring the content. It tries HEAD first and falls
+// back to a GET of the first byte when HEAD is refused or does not show
+// range support. Failed probes are retried like segments until ctx is done.
+func (d *Download) inspect(ctx context.Context) error {
+	return d.withRetry(ctx, "Probe", func(ctx context.Context) error {
+		headCtx, cancel := context.WithCancel(ctx)
+		resp, err := d.request(headCtx, cancel, http.MethodHead, nil)
+		cancel()
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK && resp.Header.Get("Accept-Ranges") == "bytes" && resp.ContentLength > 0 {
+				d.capture(resp.Header, resp.ContentLength, true, false)
+				return nil
+			}
+			log.Infof("HEAD %s answered %s, probing with a ranged GET", d.URL, resp.Status)
+		} else if ctx.Err() != nil {
+			return err
+		} else {
+			log.Infof("HEAD %s failed, probing with a ranged GET: %v", d.URL, err)
+		}
+		return d.probeRange(ctx)
+	})
+}
+
+// probeRange asks for the first byte of the file. A 206 response for that
+// byte proves range support and carries the total size in Content-Range. A
+// 200 response is the whole file, whose body is kept for the download to
+// reuse.
+func (d *Download) probeRange(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	resp, err := d.request(ctx, cancel, http.MethodGet, http.Header{"Range": {"bytes=0-0"}})
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		cancel()
+		// A range other than the first byte means the server cannot be
+		// trusted with ranges, nor with the size it reports along with it.
+		value := resp.Header.Get("Content-Range")
+		if start, size, ok := parseByteRange(value); ok && start == 0 {
+			d.capture(resp.Header, size, true, true)
+		} else {
+			log.Warnf("Server answered the first byte of %s with Content-Range %q, not using ranges", d.URL, value)
+			d.capture(resp.Header, -1, false, true)
+		}
+		return nil
+	case http.StatusOK:
+		d.capture(resp.Header, resp.ContentLength, false, false)
+		d.keepProbe(resp, cancel)
+		return nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Not even the first byte exists: the file is empty.
+		resp.Body.Close()
+		cancel()
+		if size, _ := parseContentRange(resp.Header.Get("Content-Range")); size == 0 {
+			d.capture(resp.Header, 0, false, false)
+			return nil
+		}
+		return newStatusError(resp)
+	default:
+		resp.Body.Close()
+		cancel()
+		d.Headers = resp.Header
+		return newStatusError(resp)
+	}
+}
+
+// request sends a probe and waits at most probeTimeout for its headers,
+// calling cancel, which must cancel ctx, when they take longer.
+func (d *Download) request(ctx context.Context, cancel context.CancelFunc, method string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, d.URL, nil)
+	if err != nil {
+		return nil, permanent(err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	timer := time.AfterFunc(probeTimeout, cancel)
+	defer timer.Stop()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch URL: %w", err)
+	}
+	d.mu.Lock()
+	d.Redirects = redirects(resp)
+	d.mu.Unlock()
+	return resp, nil
+}
+
+// redirects returns the locations the client followed to get resp, in the
+// order it followed them.
+func redirects(resp *http.Response) []string {
+	var locations []string
+	for req := resp.Request; req.Response != nil; req = req.Response.Request {
+		locations = append(locations, req.URL.String())
+	}
+	slices.Reverse(locations)
+	return locations
+}
+
+// capture records what a probe learned about the file. size is negative
+// when the server did not tell; partial is set for a 206 response.
+func (d *Download) capture(header http.Header, size int64, acceptRanges, partial bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.Headers = header
+	d.ETag = header.Get("ETag")
+	d.LastModified = header.Get("Last-Modified")
+	d.ContentLength = max(size, 0)
+	if size <= 0 {
+		log.Warn("Missing Content-Length header")
+	}
+	d.AcceptRanges = acceptRanges && size > 0
+	d.ContentType = header.Get("Content-Type")
+	if d.Checksum == "" {
+		if d.Checksum = checksumFromHeaders(header, partial); d.Checksum != "" {
+			log.Infof("Using checksum %s advertised for %s", d.Checksum, d.URL)
+		}
+	}
+
+	if contentDisposition := header.Get("Content-Disposition"); contentDisposition != "" {
+		_, params, err := mime.ParseMediaType(contentDisposition)
+
+		if err == nil {
+			if filename, exists := params["filename"]; exists {
+				d.FileName = filename
+				log.Infof("Extracted filename: %s", filename)
+			}
+		} else {
+			log.Warnf("Failed to parse Content-Disposition: %v", err)
+		}
+	}
+
+	if d.FileName == "" {
+		parsedURL, err := url.Parse(d.URL)
+		if err == nil {
+			segments := strings.Split(parsedURL.Path, "/")
+			d.FileName = segments[len(segments)-1]
+		}
+	}
+
+	if d.FileName == "" || !strings.Contains(d.FileName, ".") {
+		if contentType := header.Get("Content-Type"); contentType != "" {
+			ext, _ := mime.ExtensionsByType(contentType)
+			if len(ext) > 0 {
+				d.FileName = "download" + ext[0] // Default name with correct extension
+			}
+		}
+	}
+}
+
+// parseContentRange returns the total size from a "bytes 0-0/1234" header.
+func parseContentRange(value string) (int64, bool) {
+	_, total, found := strings.Cut(value, "/")
+	if !found || total == "*" {
+		return -1, false
+	}
+	size, err := strconv.ParseInt(total, 10, 64)
+	if err != nil || size < 0 {
+		return -1, false
+	}
+	if size == 0 {
+		return 0, false
+	}
+	return size, true
+}
+
+// parseByteRange returns the first byte and the total size from a
+// "bytes 100-199/1234" header. Unsatisfied ranges and unknown totals are
+// not accepted.
+func parseByteRange(value string) (int64, int64, bool) {
+	spec, found := strings.CutPrefix(value, "bytes ")
+	if !found {
+		return -1, -1, false
+	}
+	span, total, found := strings.Cut(spec, "/")
+	if !found {
+		return -1, -1, false
+	}
+	first, last, found := strings.Cut(span, "-")
+	if !found {
+		return -1, -1, false
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return -1, -1, false
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return -1, -1, false
+	}
+	size, err := strconv.ParseInt(total, 10, 64)
+	if err != nil || size <= end {
+		return -1, -1, false
+	}
+	return start, size, true
+}
+
+// keepProbe holds on to a full response until the download starts or
+// probeKeepAlive passes.
+func (d *Download) keepProbe(resp *http.Response, cancel context.CancelFunc) {
+	p := &probeResponse{resp: resp, cancel: cancel}
+	p.timer = time.AfterFunc(probeKeepAlive, func() {
+		d.mu.Lock()
+		expired := d.probe == p
+		if expired {
+			d.probe = nil
+		}
+		d.mu.Unlock()
+		if expired {
+			p.close()
+		}
+	})
+
+	d.mu.Lock()
+	d.probe = p
+	d.mu.Unlock()
+}
+
+// takeProbe hands the kept probe response to the download, if it is still
+// there. Canceling ctx closes it.
+func (d *Download) takeProbe(ctx context.Context) *http.Response {
+	d.mu.Lock()
+	p := d.probe
+	d.probe = nil
+	d.mu.Unlock()
+	if p == nil {
+		return nil
+	}
+
+	p.timer.Stop()
+	context.AfterFunc(ctx, p.cancel)
+	return p.resp
+}
@@ -0,0 +1,134 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Amirali-Amirifar/gofetch.git/internal/models"
+)
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		value  string
+		want   int64
+		wantOK bool
+	}{
+		{value: "bytes 0-0/1234", want: 1234, wantOK: true},
+		{value: "bytes 100-199/200", want: 200, wantOK: true},
+		{value: "bytes */1234", want: 1234, wantOK: true},
+		{value: "bytes 0-99/*", want: -1},
+		{value: "bytes 0-0/0", want: 0},
+		{value: "bytes */0", want: 0},
+		{value: "bytes 0-99/-5", want: -1},
+		{value: "bytes 0-99/abc", want: -1},
+		{value: "bytes 0-99/ 100", want: -1},
+		{value: "bytes 0-99/9223372036854775808", want: -1},
+		{value: "bytes 0-99", want: -1},
+		{value: "", want: -1},
+	}
+	for _, tt := range tests {
+		got, ok := parseContentRange(tt.value)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("parseContentRange(%q) = %d, %v, want %d, %v", tt.value, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestParseByteRange(t *testing.T) {
+	tests := []struct {
+		value     string
+		wantStart int64
+		wantSize  int64
+		wantOK    bool
+	}{
+		{value: "bytes 0-0/1234", wantStart: 0, wantSize: 1234, wantOK: true},
+		{value: "bytes 100-199/200", wantStart: 100, wantSize: 200, wantOK: true},
+		{value: "bytes 100-199/*", wantStart: -1, wantSize: -1},
+		{value: "bytes */1234", wantStart: -1, wantSize: -1},
+		{value: "bytes 100-199/150", wantStart: -1, wantSize: -1},
+		{value: "bytes 199-100/200", wantStart: -1, wantSize: -1},
+		{value: "bytes -1-5/200", wantStart: -1, wantSize: -1},
+		{value: "items 0-0/1234", wantStart: -1, wantSize: -1},
+		{value: "bytes 0-99", wantStart: -1, wantSize: -1},
+		{value: "", wantStart: -1, wantSize: -1},
+	}
+	for _, tt := range tests {
+		start, size, ok := parseByteRange(tt.value)
+		if start != tt.wantStart || size != tt.wantSize || ok != tt.wantOK {
+			t.Errorf("parseByteRange(%q) = %d, %d, %v, want %d, %d, %v",
+				tt.value, start, size, ok, tt.wantStart, tt.wantSize, tt.wantOK)
+		}
+	}
+}
+
+func TestProbeRange(t *testing.T) {
+	const size = 1 << 20
+	content := testContent(size)
+
+	tests := []struct {
+		name         string
+		contentRange string
+		wantRanges   bool
+		wantSize     int64
+	}{
+		{name: "first byte", contentRange: fmt.Sprintf("bytes 0-0/%d", size), wantRanges: true, wantSize: size},
+		{name: "another byte", contentRange: fmt.Sprintf("bytes 100-100/%d", size)},
+		{name: "unknown size", contentRange: "bytes 0-0/*"},
+		{name: "missing", contentRange: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// HEAD is refused, so the probe has to ask for the first byte.
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.Method == http.MethodHead:
+					w.WriteHeader(http.StatusMethodNotAllowed)
+				case r.Header.Get("Range") == "bytes=0-0":
+					if tt.contentRange != "" {
+						w.Header().Set("Content-Range", tt.contentRange)
+					}
+					w.WriteHeader(http.StatusPartialContent)
+					w.Write(content[:1])
+				default:
+					w.Write(content)
+				}
+			}))
+			defer s.Close()
+
+			d := &Download{Download: models.Download{URL: s.URL + "/file.bin"}}
+			if err := d.inspect(context.Background()); err != nil {
+				t.Fatalf("inspect: %v", err)
+			}
+			if d.AcceptRanges != tt.wantRanges || d.ContentLength != tt.wantSize {
+				t.Errorf("AcceptRanges = %v, ContentLength = %d, want %v, %d",
+					d.AcceptRanges, d.ContentLength, tt.wantRanges, tt.wantSize)
+			}
+		})
+	}
+}
+
+func TestInspectStopsWithContext(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer s.Close()
+
+	d := &Download{Download: models.Download{URL: s.URL + "/file.bin"}, maxRetries: 5}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	begin := time.Now()
+	err := d.inspect(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("inspect() = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(begin); elapsed > 5*time.Second {
+		t.Errorf("inspect kept retrying for %v after its context was canceled", elapsed)
+	}
+}
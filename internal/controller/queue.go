@@ -1,66 +1,210 @@
 package controller
 
 import (
-	"github.com/Amirali-Amirifar/gofetch.git/internal/models"
-	log "github.com/sirupsen/logrus"
+	"slices"
 	"sync"
 	"time"
+
+	"github.com/Amirali-Amirifar/gofetch.git/internal/config"
+	"github.com/Amirali-Amirifar/gofetch.git/internal/models"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
 )
 
+// activeTimeCheckInterval is how often a queue re-evaluates its active time
+// range when nothing else wakes it up.
+const activeTimeCheckInterval = 30 * time.Second
+
 // QueueManager represents a queue of downloads with constraints on simultaneous downloads
 // and active time range
 type QueueManager struct {
 	models.Queue
 	ActiveDownloads int           // Current active downloads
-	DownloadChannel chan struct{} // Channel for managing active downloads
+	DownloadChannel chan struct{} // Wakes the dispatcher when work arrives or a slot frees up
 	mu              sync.Mutex    // Mutex to ensure safe concurrent access to ActiveDownloads
-	DownloadLimiter chan struct{} // Token channel for limiting download speed (throttling)
+	DownloadLimiter *rate.Limiter // Token bucket shared by every download of the queue (throttling)
+
+	global  *rate.Limiter          // Token bucket shared by every queue
+	pending []*Download            // Downloads waiting for a free slot, in submission order
+	active  map[*Download]struct{} // Downloads currently holding a slot
+	stop    chan struct{}
+}
+
+func newQueueManager(queue models.Queue, global *rate.Limiter) *QueueManager {
+	q := &QueueManager{
+		Queue:           queue,
+		DownloadChannel: make(chan struct{}, 1),
+		DownloadLimiter: newLimiter(queue.BandwidthLimit),
+		global:          global,
+		active:          make(map[*Download]struct{}),
+		stop:            make(chan struct{}),
+	}
+	go q.run()
+	return q
 }
 
 // CanStartDownload checks whether a new download can be started
 // based on the time range and max simultaneous downloads constraints
 func (q *QueueManager) CanStartDownload() bool {
-	currentTime := time.Now()
-	start, _ := time.Parse("15:04", q.ActiveTimeStart)
-	end, _ := time.Parse("15:04", q.ActiveTimeEnd)
-
-	if q.ActiveTimeStart != "" && q.ActiveTimeEnd != "" {
-		if currentTime.Before(start) || currentTime.After(end) {
-			log.Infof("Can't start download until %s", end)
-			return false
-		}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.canStartLocked(time.Now())
+}
+
+func (q *QueueManager) canStartLocked(now time.Time) bool {
+	if !q.inActiveTime(now) {
+		return false
 	}
 
-	// Locking the mutex to safely check and modify the number of active downloads
+	maxSimultaneous := q.MaxSimultaneous
+	if maxSimultaneous <= 0 {
+		maxSimultaneous = config.DefaultMaxSimultaneous
+	}
+	return q.ActiveDownloads < maxSimultaneous
+}
+
+// inActiveTime reports whether now falls inside the queue's active time range.
+// A range whose end is before its start wraps around midnight.
+func (q *QueueManager) inActiveTime(now time.Time) bool {
+	if q.ActiveTimeStart == "" || q.ActiveTimeEnd == "" {
+		return true
+	}
+
+	start, err := time.Parse("15:04", q.ActiveTimeStart)
+	if err != nil {
+		log.Warnf("Queue %s has an invalid start time %q: %v", q.Name, q.ActiveTimeStart, err)
+		return true
+	}
+	end, err := time.Parse("15:04", q.ActiveTimeEnd)
+	if err != nil {
+		log.Warnf("Queue %s has an invalid end time %q: %v", q.Name, q.ActiveTimeEnd, err)
+		return true
+	}
+
+	minute := now.Hour()*60 + now.Minute()
+	startMinute := start.Hour()*60 + start.Minute()
+	endMinute := end.Hour()*60 + end.Minute()
+	if startMinute <= endMinute {
+		return minute >= startMinute && minute < endMinute
+	}
+	return minute >= startMinute || minute < endMinute
+}
+
+// Enqueue marks the download as queued and hands it to the dispatcher, which
+// starts it as soon as the queue constraints allow. A download paused or
+// canceled while waiting is still pending, and keeps its place instead of
+// being added twice.
+func (q *QueueManager) Enqueue(d *Download) {
+	d.updateStatus(models.DownloadStatusQueued)
+
 	q.mu.Lock()
-	canStart := q.ActiveDownloads < q.MaxSimultaneous
+	d.mu.Lock()
+	d.folder = q.StorageFolder
+	d.mu.Unlock()
+	if !slices.Contains(q.pending, d) {
+		q.pending = append(q.pending, d)
+	}
 	q.mu.Unlock()
 
-	return canStart
+	log.Infof("Download %s queued in %s", d.URL, q.Name)
+	q.wake()
 }
 
-// StartDownload initiates a download process if allowed by the queue constraints
-func (q *QueueManager) StartDownload(d *Download) {
-	if !q.CanStartDownload() {
-		log.Infof("Download %s is queued due to queue restrictions", d.URL)
-		d.Status = models.DownloadStatusQueued
-		return
+// remove takes a download out of the queue before it got a slot. It reports
+// false when the download was not waiting in this queue.
+func (q *QueueManager) remove(d *Download) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, pending := range q.pending {
+		if pending == d {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			return true
+		}
 	}
+	return false
+}
 
-	// Locking the mutex to safely modify the active downloads count
+// update replaces the queue settings, e.g. after an edit in the Queue List.
+// New speed limits apply to running transfers immediately.
+func (q *QueueManager) update(queue models.Queue) {
 	q.mu.Lock()
-	q.ActiveDownloads++
+	q.Queue = queue
+	setLimit(q.DownloadLimiter, queue.BandwidthLimit)
+	for d := range q.active {
+		d.mu.Lock()
+		limiter := d.limiter
+		d.mu.Unlock()
+		setLimit(limiter, queue.MaxDownloadSpeed)
+	}
 	q.mu.Unlock()
+	q.wake()
+}
+
+func (q *QueueManager) wake() {
+	select {
+	case q.DownloadChannel <- struct{}{}:
+	default:
+	}
+}
+
+// run promotes pending downloads whenever a slot frees up, new work arrives
+// or the active time range may have opened.
+func (q *QueueManager) run() {
+	ticker := time.NewTicker(activeTimeCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-q.DownloadChannel:
+		case <-ticker.C:
+		}
+		q.promote()
+	}
+}
+
+func (q *QueueManager) promote() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.pending) > 0 && q.canStartLocked(time.Now()) {
+		d := q.pending[0]
+		q.pending = q.pending[1:]
 
-	q.DownloadChannel <- struct{}{}
-	d.Status = models.DownloadStatusDownloading
+		// Downloads canceled or paused while waiting simply leave the queue.
+		if d.status() != models.DownloadStatusQueued {
+			continue
+		}
+
+		q.ActiveDownloads++
+		q.active[d] = struct{}{}
+		limiter := newLimiter(q.MaxDownloadSpeed)
+		d.mu.Lock()
+		d.limiter = limiter
+		d.limiters = []*rate.Limiter{limiter, q.DownloadLimiter, q.global}
+		d.maxRetries = q.MaxRetryAttempts
+		d.mu.Unlock()
+		go q.StartDownload(d)
+	}
+}
+
+// StartDownload runs a promoted download to completion and releases its slot.
+func (q *QueueManager) StartDownload(d *Download) {
 	log.Infof("Starting download: %s", d.URL)
-	//d.start(q) TODO enable queue
+	if err := d.start(); err != nil {
+		log.Errorf("Download %s failed: %v", d.URL, err)
+	}
 
-	// Decrement active downloads after completion
 	q.mu.Lock()
 	q.ActiveDownloads--
+	delete(q.active, d)
 	q.mu.Unlock()
 
-	<-q.DownloadChannel
+	q.wake()
+}
+
+// Stop halts the dispatcher. Running downloads are not interrupted.
+func (q *QueueManager) Stop() {
+	close(q.stop)
 }
@@ -0,0 +1,157 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Amirali-Amirifar/gofetch.git/internal/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// statusError is an unexpected HTTP response status.
+type statusError struct {
+	Status     string
+	StatusCode int
+	RetryAfter time.Duration // Parsed from the Retry-After header, if any
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected HTTP status %s", e.Status)
+}
+
+func newStatusError(resp *http.Response) *statusError {
+	return &statusError{
+		Status:     resp.Status,
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+// permanentError wraps failures that another attempt cannot fix, such as
+// local file errors.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// retryable reports whether another attempt might succeed after err.
+func retryable(err error) bool {
+	if errors.Is(err, errCanceled) || errors.Is(err, errPaused) || errors.Is(err, errRetired) ||
+		errors.Is(err, errChanged) || errors.Is(err, errVerification) {
+		return false
+	}
+	var perm *permanentError
+	if errors.As(err, &perm) {
+		return false
+	}
+	var status *statusError
+	if errors.As(err, &status) {
+		switch status.StatusCode {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests:
+			return true
+		}
+		return status.StatusCode >= 500
+	}
+	// Network and read errors are worth another try.
+	return true
+}
+
+// parseRetryAfter accepts both forms of the Retry-After header: a number of
+// seconds or an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0)
+	}
+	return 0
+}
+
+// backoff returns the delay before retry number attempt (starting at 1):
+// an exponentially growing delay with jitter, capped at config.RetryMaxDelay.
+func backoff(attempt int) time.Duration {
+	delay := config.RetryBaseDelay << (attempt - 1)
+	if delay <= 0 || delay > config.RetryMaxDelay {
+		delay = config.RetryMaxDelay
+	}
+	// Spread retries of concurrent segments over [delay/2, delay).
+	half := delay / 2
+	return half + rand.N(half+1)
+}
+
+// retryDelay returns how long to wait before retry number attempt after err.
+// A busy server's Retry-After is honoured up to config.RetryAfterMaxDelay, so
+// a far-off date cannot stall the download; otherwise the delay backs off.
+func retryDelay(err error, attempt int) time.Duration {
+	var status *statusError
+	if errors.As(err, &status) && status.RetryAfter > 0 &&
+		(status.StatusCode == http.StatusTooManyRequests || status.StatusCode == http.StatusServiceUnavailable) {
+		return min(status.RetryAfter, config.RetryAfterMaxDelay)
+	}
+	return backoff(attempt)
+}
+
+// withRetry runs attempt until it succeeds, fails permanently or the retry
+// budget of the download's queue is spent. Each attempt resumes from the
+// offset the previous one reached, so only missing bytes are fetched again.
+func (d *Download) withRetry(ctx context.Context, what string, attempt func(context.Context) error) error {
+	d.mu.Lock()
+	maxRetries := d.maxRetries
+	d.mu.Unlock()
+	if maxRetries < 0 {
+		maxRetries = 0
+	}
+
+	for retry := 0; ; retry++ {
+		err := attempt(ctx)
+		// A paused or canceled run is not a failed attempt.
+		if err != nil && ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+		if err == nil || !retryable(err) || retry >= maxRetries {
+			return err
+		}
+
+		delay := retryDelay(err, retry+1)
+		log.Warnf("%s of %s failed (attempt %d of %d), retrying in %s: %v", what, d.URL, retry+1, maxRetries+1, delay, err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return context.Cause(ctx)
+		case <-timer.C:
+		}
+	}
+}
+
+// recordFailure notes a failed attempt at fetching segment index, unless the
+// run was stopped or the connection retired on purpose.
+func (d *Download) recordFailure(ctx context.Context, index int, err error) {
+	if err == nil || ctx.Err() != nil || errors.Is(err, errRetired) {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if index < len(d.Ranges) {
+		d.Ranges[index].Failures++
+		d.Ranges[index].LastError = err.Error()
+		now := time.Now()
+		d.Ranges[index].FailedAt = &now
+	}
+}
@@ -0,0 +1,191 @@
+package controller
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Amirali-Amirifar/gofetch.git/internal/config"
+	"github.com/Amirali-Amirifar/gofetch.git/internal/models"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		delay   time.Duration
+	}{
+		{attempt: 1, delay: config.RetryBaseDelay},
+		{attempt: 2, delay: 2 * config.RetryBaseDelay},
+		{attempt: 3, delay: 4 * config.RetryBaseDelay},
+		{attempt: 10, delay: config.RetryMaxDelay},
+		// Large attempts overflow the shift and must still be capped.
+		{attempt: 64, delay: config.RetryMaxDelay},
+		{attempt: 1000, delay: config.RetryMaxDelay},
+	}
+	for _, tt := range tests {
+		for range 100 {
+			if got := backoff(tt.attempt); got < tt.delay/2 || got > tt.delay {
+				t.Fatalf("backoff(%d) = %v, want within [%v, %v]", tt.attempt, got, tt.delay/2, tt.delay)
+			}
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{value: "", want: 0},
+		{value: "120", want: 2 * time.Minute},
+		{value: "0", want: 0},
+		{value: "-5", want: 0},
+		{value: "soon", want: 0},
+		{value: "Wed, 21 Oct 2015 07:28:00 GMT", want: 0}, // In the past
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+
+	at := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(at); got <= 58*time.Minute || got > time.Hour {
+		t.Errorf("parseRetryAfter(%q) = %v, want about an hour", at, got)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		min, max time.Duration
+	}{
+		{
+			name: "retry after",
+			err:  &statusError{StatusCode: http.StatusServiceUnavailable, RetryAfter: 2 * time.Minute},
+			min:  2 * time.Minute,
+			max:  2 * time.Minute,
+		},
+		{
+			name: "retry after far off",
+			err:  &statusError{StatusCode: http.StatusTooManyRequests, RetryAfter: 24 * time.Hour},
+			min:  config.RetryAfterMaxDelay,
+			max:  config.RetryAfterMaxDelay,
+		},
+		{
+			name: "retry after of another status",
+			err:  &statusError{StatusCode: http.StatusInternalServerError, RetryAfter: 24 * time.Hour},
+			min:  config.RetryBaseDelay / 2,
+			max:  config.RetryBaseDelay,
+		},
+		{
+			name: "no retry after",
+			err:  &statusError{StatusCode: http.StatusServiceUnavailable},
+			min:  config.RetryBaseDelay / 2,
+			max:  config.RetryBaseDelay,
+		},
+	}
+	for _, tt := range tests {
+		if got := retryDelay(tt.err, 1); got < tt.min || got > tt.max {
+			t.Errorf("%s: retryDelay() = %v, want within [%v, %v]", tt.name, got, tt.min, tt.max)
+		}
+	}
+}
+
+func TestRetryLoop(t *testing.T) {
+	const size = 1 << 20
+	const cut = 300 << 10
+	content := testContent(size)
+
+	tests := []struct {
+		name       string
+		maxRetries int
+		handle     func(w http.ResponseWriter, r *http.Request, attempt int) bool
+		want       models.DownloadStatus
+		attempts   int
+		resumeFrom int64 // Upper bound of where the second attempt continues, 0 to start over
+	}{
+		{
+			name:       "recovers within the budget",
+			maxRetries: 2,
+			handle: func(w http.ResponseWriter, r *http.Request, attempt int) bool {
+				if attempt > 1 {
+					return false
+				}
+				http.Error(w, "busy", http.StatusServiceUnavailable)
+				return true
+			},
+			want:     models.DownloadStatusCompleted,
+			attempts: 2,
+		},
+		{
+			name:       "gives up once the budget is spent",
+			maxRetries: 1,
+			handle: func(w http.ResponseWriter, r *http.Request, attempt int) bool {
+				http.Error(w, "broken", http.StatusInternalServerError)
+				return true
+			},
+			want:     models.DownloadStatusFailed,
+			attempts: 2,
+		},
+		{
+			name:       "client errors are not retried",
+			maxRetries: 3,
+			handle: func(w http.ResponseWriter, r *http.Request, attempt int) bool {
+				http.NotFound(w, r)
+				return true
+			},
+			want:     models.DownloadStatusFailed,
+			attempts: 1,
+		},
+		{
+			name:       "resumes where a broken connection stopped",
+			maxRetries: 1,
+			handle: func(w http.ResponseWriter, r *http.Request, attempt int) bool {
+				if attempt > 1 {
+					return false
+				}
+				w.Header().Set("Content-Length", strconv.Itoa(size))
+				w.Write(content[:cut])
+				w.(http.Flusher).Flush()
+				panic(http.ErrAbortHandler)
+			},
+			want:       models.DownloadStatusCompleted,
+			attempts:   2,
+			resumeFrom: cut,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			s := newFileServer(t, content)
+			s.handle = tt.handle
+			d := newTestDownload(t, s)
+			d.maxRetries = tt.maxRetries
+
+			d.start()
+			if d.Status != tt.want {
+				t.Fatalf("status = %s, want %s: %s", d.Status, tt.want, d.LastError)
+			}
+			requested := s.requested()
+			if len(requested) != tt.attempts {
+				t.Fatalf("%d attempts %q, want %d", len(requested), requested, tt.attempts)
+			}
+			if tt.want != models.DownloadStatusCompleted {
+				if d.LastError == "" {
+					t.Error("the failure is not recorded")
+				}
+				return
+			}
+			checkFile(t, d, content)
+			// A retry continues from the offset the last attempt reached.
+			if tt.resumeFrom > 0 {
+				if first, _ := parseRange(t, requested[1], size); first == 0 || first > tt.resumeFrom {
+					t.Errorf("retry asked for %s, want to continue from at most byte %d", requested[1], tt.resumeFrom)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,501 @@
+package controller
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Amirali-Amirifar/gofetch.git/internal/config"
+	"github.com/Amirali-Amirifar/gofetch.git/internal/models"
+	"github.com/Amirali-Amirifar/gofetch.git/internal/queues"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// Scheduler owns one QueueManager per queue and is the single entry point
+// for submitting and controlling downloads.
+type Scheduler struct {
+	mu        sync.Mutex
+	queues    map[string]*QueueManager
+	downloads map[int64]*Download
+	global    *rate.Limiter // Caps the combined speed of every queue
+	discover  bool          // Look for published checksum files of new downloads
+	keyring   string        // OpenPGP keyring completed downloads are verified against
+	locations []string      // Preferred mirror locations, as country codes
+}
+
+// NewScheduler starts a dispatcher for every queue. A Default queue is
+// created from the configuration defaults when the state has none.
+// globalLimit caps the combined speed of all queues in KB/s, 0 meaning unlimited.
+// It opens the database the downloads are stored in.
+func NewScheduler(settings []models.Queue, globalLimit int64) *Scheduler {
+	db = config.GetDB()
+	s := &Scheduler{
+		queues:    make(map[string]*QueueManager),
+		downloads: make(map[int64]*Download),
+		global:    newLimiter(globalLimit),
+	}
+
+	for _, queue := range settings {
+		s.queues[queue.Name] = newQueueManager(queue, s.global)
+	}
+	if _, ok := s.queues[config.DefaultQueueName]; !ok {
+		s.queues[config.DefaultQueueName] = newQueueManager(queues.Default(), s.global)
+	}
+	return s
+}
+
+func (s *Scheduler) queue(name string) (*QueueManager, error) {
+	if name == "" {
+		name = config.DefaultQueueName
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, ok := s.queues[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown queue %q", name)
+	}
+	return q, nil
+}
+
+// Submit validates the queue of download and hands it to that queue. The
+// initial request and queuing happen in the background, so the returned
+// Download can be tracked right away.
+//
+// A metalink URL or path is expanded by SubmitMetalink, and the download of
+// its first file is returned.
+func (s *Scheduler) Submit(download models.Download) (*Download, error) {
+	if IsMetalink(download.URL) {
+		downloads, err := s.SubmitMetalink(download.URL, download)
+		if err != nil {
+			return nil, err
+		}
+		return downloads[0], nil
+	}
+
+	d, q, err := s.prepare(download)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		err := d.Create()
+		if d.Id != 0 {
+			s.register(d)
+		}
+		if err != nil {
+			log.Errorf("Download %s could not be queued: %v", d.URL, err)
+			return
+		}
+		q.Enqueue(d)
+	}()
+	return d, nil
+}
+
+// Add hands a download to its queue like Submit, but waits for the initial
+// request, so the returned downloads have their ids and a URL that cannot be
+// fetched is reported right away. A metalink adds a download for every file
+// it lists.
+func (s *Scheduler) Add(download models.Download) ([]*Download, error) {
+	files := []models.Download{download}
+	if IsMetalink(download.URL) {
+		var err error
+		if files, err = s.expandMetalink(download.URL, download); err != nil {
+			return nil, err
+		}
+	}
+
+	var downloads []*Download
+	for _, file := range files {
+		d, q, err := s.prepare(file)
+		if err != nil {
+			return downloads, err
+		}
+		err = d.Create()
+		if d.Id != 0 {
+			s.register(d)
+			downloads = append(downloads, d)
+		}
+		if err != nil {
+			return downloads, err
+		}
+		q.Enqueue(d)
+	}
+	return downloads, nil
+}
+
+// prepare validates download and binds it to its queue.
+func (s *Scheduler) prepare(download models.Download) (*Download, *QueueManager, error) {
+	q, err := s.queue(download.QueueName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if download.Checksum != "" {
+		checksum, err := ParseChecksum(download.Checksum)
+		if err != nil {
+			return nil, nil, err
+		}
+		download.Checksum = checksum
+	}
+
+	download.Mirrors = models.NormalizeMirrors(download.URL, download.Mirrors)
+	d := &Download{Download: download}
+	d.QueueID = q.Id
+	d.QueueName = q.Name
+	s.mu.Lock()
+	d.discoverChecksums = s.discover
+	d.keyring = s.keyring
+	s.mu.Unlock()
+	q.mu.Lock()
+	d.maxRetries = q.MaxRetryAttempts
+	q.mu.Unlock()
+	return d, q, nil
+}
+
+// SubmitMetalink reads a metalink from a URL or a local path and submits a
+// download for every file it lists, spreading the segments of each over its
+// mirrors. The queue is taken from template, and so are the file name,
+// checksum and signature when set there and the metalink lists one file.
+func (s *Scheduler) SubmitMetalink(source string, template models.Download) ([]*Download, error) {
+	files, err := s.expandMetalink(source, template)
+	if err != nil {
+		return nil, err
+	}
+
+	var downloads []*Download
+	for _, download := range files {
+		d, err := s.Submit(download)
+		if err != nil {
+			return downloads, err
+		}
+		downloads = append(downloads, d)
+	}
+	return downloads, nil
+}
+
+func (s *Scheduler) expandMetalink(source string, template models.Download) ([]models.Download, error) {
+	if _, err := s.queue(template.QueueName); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	locations := s.locations
+	s.mu.Unlock()
+
+	files, err := readMetalink(source, locations)
+	if err != nil {
+		return nil, err
+	}
+	for i := range files {
+		download := &files[i]
+		download.QueueName = template.QueueName
+		if len(files) == 1 {
+			if template.FileName != "" {
+				download.FileName = template.FileName
+			}
+			if template.Checksum != "" {
+				download.Checksum = template.Checksum
+			}
+			download.Signature = template.Signature
+		}
+		log.Infof("Metalink %s lists %s with %d mirrors", source, download.FileName, len(download.Mirrors))
+	}
+	return files, nil
+}
+
+// Restore rehydrates downloads left unfinished by the previous run. Running
+// and queued downloads go back to their queues and continue from the
+// persisted segment offsets; paused ones and those whose remote file changed
+// or that failed verification wait for Resume.
+func (s *Scheduler) Restore() (int, error) {
+	rows, err := db.GetDownloadsByStatus(
+		models.DownloadStatusDownloading,
+		models.DownloadStatusQueued,
+		models.DownloadStatusPaused,
+		models.DownloadStatusChanged,
+		models.DownloadStatusVerifyFailed,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load interrupted downloads: %w", err)
+	}
+
+	// Downloads that were already running get their slots back first.
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].Status == models.DownloadStatusDownloading && rows[j].Status != models.DownloadStatusDownloading
+	})
+
+	for _, row := range rows {
+		d := s.adopt(row)
+		log.Infof("Restoring download %d (%s) at %d/%d bytes", d.Id, d.URL, d.written(), d.ContentLength)
+
+		switch d.Status {
+		case models.DownloadStatusPaused, models.DownloadStatusChanged, models.DownloadStatusVerifyFailed:
+			continue
+		}
+		q, err := s.queue(d.QueueName)
+		if err != nil {
+			log.Warnf("Download %d belongs to %v, moving it to %s", d.Id, err, config.DefaultQueueName)
+			q, _ = s.queue(config.DefaultQueueName)
+			d.QueueName = q.Name
+			d.QueueID = q.Id
+		}
+		q.Enqueue(d)
+	}
+	return len(rows), nil
+}
+
+// NotFoundError is returned for a download that does not exist.
+type NotFoundError struct {
+	ID int64
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("no download with id %d", e.ID)
+}
+
+// Lookup returns the download with the given id, loading it from the
+// database when this session has not seen it yet.
+func (s *Scheduler) Lookup(id int64) (*Download, error) {
+	if d, ok := s.Get(id); ok {
+		return d, nil
+	}
+	row, err := db.GetDownload(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, &NotFoundError{ID: id}
+		}
+		return nil, fmt.Errorf("failed to load download %d: %w", id, err)
+	}
+	return s.adopt(row), nil
+}
+
+// adopt registers a download loaded from the database.
+func (s *Scheduler) adopt(row models.Download) *Download {
+	d := &Download{Download: row}
+	s.mu.Lock()
+	d.keyring = s.keyring
+	s.mu.Unlock()
+	s.register(d)
+	return d
+}
+
+// Resume puts a paused download back in its queue. Its segments continue
+// with Range requests from the offsets reached before pausing. Resuming a
+// download whose remote file changed confirms starting it over, and resuming
+// one that failed verification fetches its corrupted pieces again, or the
+// whole file when it has no piece checksums.
+func (s *Scheduler) Resume(d *Download) {
+	switch d.status() {
+	case models.DownloadStatusPaused:
+	case models.DownloadStatusChanged:
+		d.mu.Lock()
+		d.restart = true
+		d.mu.Unlock()
+	case models.DownloadStatusVerifyFailed:
+		d.mu.Lock()
+		d.refetch = true
+		d.mu.Unlock()
+	default:
+		return
+	}
+
+	q, err := s.queue(d.QueueName)
+	if err != nil {
+		log.Errorf("Cannot resume download %d: %v", d.Id, err)
+		return
+	}
+	q.Enqueue(d)
+}
+
+// Retry puts a failed or canceled download back in its queue. It continues
+// from the bytes already on disk; a download whose initial request failed
+// is probed again first.
+func (s *Scheduler) Retry(d *Download) error {
+	switch status := d.status(); status {
+	case models.DownloadStatusFailed, models.DownloadStatusCanceled:
+	default:
+		return fmt.Errorf("download %d is %s, only failed and canceled downloads can be retried", d.Id, status)
+	}
+
+	q, err := s.queue(d.QueueName)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.LastError = ""
+	d.restart = d.Headers == nil
+	d.mu.Unlock()
+	q.Enqueue(d)
+	return nil
+}
+
+// Move hands a download to another queue. A download waiting for a slot
+// waits in the new queue instead; a running one keeps its slot and uses the
+// new queue from its next run on. Paused, canceled and failed downloads
+// keep their status and stay where they are until resumed or retried.
+func (s *Scheduler) Move(d *Download, queue string) error {
+	to, err := s.queue(queue)
+	if err != nil {
+		return err
+	}
+	from, _ := s.queue(d.QueueName)
+
+	d.mu.Lock()
+	d.QueueName = to.Name
+	d.QueueID = to.Id
+	d.mu.Unlock()
+
+	// A download paused or canceled while waiting is still pending in the
+	// old queue, but must not be queued again in the new one.
+	if from != nil && from != to && from.remove(d) && d.status() == models.DownloadStatusQueued {
+		to.Enqueue(d)
+		return nil
+	}
+	d.persist()
+	return nil
+}
+
+// Remove stops a download, waits for it to wind down and deletes it from the
+// database; Forget then drops it from the engine. Its file stays on disk, and
+// a partial file keeps its control file, so adding the same URL again later
+// resumes it; DeleteFiles deletes both.
+func (s *Scheduler) Remove(d *Download) error {
+	if q, err := s.queue(d.QueueName); err == nil {
+		q.remove(d)
+	}
+	d.CancelDownload()
+	// A run, or the signature check after it, may still be unwinding.
+	d.runMu.Lock()
+	defer d.runMu.Unlock()
+
+	if err := db.DeleteDownload(d.Id); err != nil {
+		return fmt.Errorf("failed to remove download %d: %w", d.Id, err)
+	}
+	log.Infof("Download %d removed", d.Id)
+	return nil
+}
+
+// Forget drops a removed download from the engine, so Downloads no longer
+// lists it.
+func (s *Scheduler) Forget(d *Download) {
+	s.mu.Lock()
+	delete(s.downloads, d.Id)
+	s.mu.Unlock()
+}
+
+// RemoveQueue stops the dispatcher of a deleted queue. Its downloads must
+// have been moved or canceled first.
+func (s *Scheduler) RemoveQueue(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if q, ok := s.queues[name]; ok {
+		q.Stop()
+		delete(s.queues, name)
+	}
+}
+
+// UpdateQueue applies edited settings to the queue previously called name.
+func (s *Scheduler) UpdateQueue(name string, queue models.Queue) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q, ok := s.queues[name]
+	if !ok {
+		s.queues[queue.Name] = newQueueManager(queue, s.global)
+		return
+	}
+	if name != queue.Name {
+		delete(s.queues, name)
+		s.queues[queue.Name] = q
+	}
+	q.update(queue)
+}
+
+// SetGlobalLimit changes the combined speed cap of all queues in KB/s,
+// 0 meaning unlimited. Running transfers slow down or speed up right away.
+func (s *Scheduler) SetGlobalLimit(kbps int64) {
+	setLimit(s.global, kbps)
+}
+
+// SetChecksumDiscovery turns the lookup of published checksum files, such
+// as SHA256SUMS next to the artifact, on or off for downloads added later.
+func (s *Scheduler) SetChecksumDiscovery(on bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.discover = on
+}
+
+// SetKeyring sets the file of OpenPGP public keys that the detached
+// signatures of completed downloads are checked against. An empty path turns
+// signature checking off.
+func (s *Scheduler) SetKeyring(fileName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keyring = fileName
+}
+
+// SetLocation sets the preferred mirror locations of metalinks submitted
+// later, as comma separated ISO 3166-1 country codes such as "de,nl".
+func (s *Scheduler) SetLocation(locations string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.locations = nil
+	for _, location := range strings.Split(locations, ",") {
+		if location = strings.TrimSpace(location); location != "" {
+			s.locations = append(s.locations, strings.ToLower(location))
+		}
+	}
+}
+
+// Get returns the download with the given id, if the scheduler knows it.
+func (s *Scheduler) Get(id int64) (*Download, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.downloads[id]
+	return d, ok
+}
+
+// Downloads returns every download submitted or restored in this session.
+func (s *Scheduler) Downloads() []*Download {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	downloads := make([]*Download, 0, len(s.downloads))
+	for _, d := range s.downloads {
+		downloads = append(downloads, d)
+	}
+	sort.Slice(downloads, func(i, j int) bool { return downloads[i].Id < downloads[j].Id })
+	return downloads
+}
+
+// Stop halts every queue dispatcher and interrupts the running downloads.
+// It returns once their runs have saved their offsets, so the database can
+// be closed. The downloads keep their status and continue on Restore.
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	for _, q := range s.queues {
+		q.Stop()
+	}
+	downloads := make([]*Download, 0, len(s.downloads))
+	for _, d := range s.downloads {
+		downloads = append(downloads, d)
+	}
+	s.mu.Unlock()
+
+	for _, d := range downloads {
+		d.halt()
+	}
+	for _, d := range downloads {
+		d.runMu.Lock()
+		d.runMu.Unlock()
+	}
+}
+
+func (s *Scheduler) register(d *Download) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.downloads[d.Id] = d
+}
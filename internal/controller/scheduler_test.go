@@ -0,0 +1,133 @@
+package controller
+
+import (
+	"net/http"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Amirali-Amirifar/gofetch.git/internal/models"
+)
+
+// closedQueue returns a queue whose active time range is over for now, so
+// downloads wait in it.
+func closedQueue(name string) models.Queue {
+	now := time.Now()
+	return models.Queue{
+		Name:            name,
+		ActiveTimeStart: now.Add(time.Hour).Format("15:04"),
+		ActiveTimeEnd:   now.Add(2 * time.Hour).Format("15:04"),
+	}
+}
+
+func TestMove(t *testing.T) {
+	tests := []struct {
+		name string
+		stop func(d *Download)
+		want models.DownloadStatus
+	}{
+		{name: "queued", stop: func(*Download) {}, want: models.DownloadStatusQueued},
+		{name: "paused while waiting", stop: (*Download).PauseDownload, want: models.DownloadStatusPaused},
+		{name: "canceled while waiting", stop: (*Download).CancelDownload, want: models.DownloadStatusCanceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewScheduler([]models.Queue{closedQueue("from"), closedQueue("to")}, 0)
+			t.Cleanup(s.Stop)
+			from, _ := s.queue("from")
+			to, _ := s.queue("to")
+
+			d := &Download{Download: models.Download{URL: "http://example.com/file.bin", QueueName: "from"}}
+			if err := db.AddNewDownload(&d.Download); err != nil {
+				t.Fatal(err)
+			}
+			from.Enqueue(d)
+			tt.stop(d)
+
+			if err := s.Move(d, "to"); err != nil {
+				t.Fatalf("Move: %v", err)
+			}
+			if status := d.status(); status != tt.want {
+				t.Errorf("status = %s, want %s", status, tt.want)
+			}
+			from.mu.Lock()
+			inFrom := slices.Contains(from.pending, d)
+			from.mu.Unlock()
+			to.mu.Lock()
+			inTo := slices.Contains(to.pending, d)
+			to.mu.Unlock()
+			if inFrom {
+				t.Error("the download still waits in its old queue")
+			}
+			if wantInTo := tt.want == models.DownloadStatusQueued; inTo != wantInTo {
+				t.Errorf("waiting in the new queue = %v, want %v", inTo, wantInTo)
+			}
+
+			row, err := db.GetDownload(d.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if row.QueueName != "to" || row.Status != tt.want {
+				t.Errorf("stored as %s in queue %q, want %s in queue %q", row.Status, row.QueueName, tt.want, "to")
+			}
+		})
+	}
+}
+
+func TestStop(t *testing.T) {
+	content := testContent(4 << 20)
+	fs := newFileServer(t, content)
+	// Every response trickles in, so the download is still running when
+	// the daemon stops.
+	fs.handle = func(w http.ResponseWriter, r *http.Request, attempt int) bool {
+		fs.serveContent(slowWriter{ResponseWriter: w, chunk: 16 << 10, pause: 20 * time.Millisecond}, r)
+		return true
+	}
+
+	s := NewScheduler([]models.Queue{{Name: "open"}}, 0)
+	downloads, err := s.Add(models.Download{
+		URL:       fs.URL + "/file.bin",
+		FileName:  filepath.Join(t.TempDir(), "file.bin"),
+		QueueName: "open",
+	})
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	d := downloads[0]
+	for deadline := time.Now().Add(5 * time.Second); d.written() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the download did not start")
+		}
+	}
+
+	s.Stop()
+
+	d.mu.Lock()
+	running, status := d.running, d.Status
+	d.mu.Unlock()
+	if running {
+		t.Error("the download still runs after Stop returned")
+	}
+	if status != models.DownloadStatusDownloading {
+		t.Errorf("status = %s, want %s for the next daemon to continue", status, models.DownloadStatusDownloading)
+	}
+	written := d.written()
+	row, err := db.GetDownload(d.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := int64(0)
+	for _, r := range row.Ranges {
+		stored += r.Offset - r.Start
+	}
+	if row.Status != models.DownloadStatusDownloading || stored != written {
+		t.Errorf("stored as %s with %d bytes written, want %s with %d", row.Status, stored, models.DownloadStatusDownloading, written)
+	}
+
+	// Nothing is written once Stop has returned.
+	time.Sleep(100 * time.Millisecond)
+	if later := d.written(); later != written {
+		t.Errorf("%d bytes written after Stop returned", later-written)
+	}
+}
@@ -0,0 +1,534 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Amirali-Amirifar/gofetch.git/internal/config"
+	"github.com/Amirali-Amirifar/gofetch.git/internal/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// tuneInterval is how often the segmenter measures connection throughput.
+// Every tuneWindow measurements it decides whether to add or drop a
+// connection.
+const (
+	tuneInterval = time.Second
+	tuneWindow   = 3
+)
+
+// errRetired stops a connection the segmenter no longer needs. Its segment
+// is left for the remaining connections.
+var errRetired = errors.New("connection retired")
+
+// connection is one worker of a parallel download.
+type connection struct {
+	id      int
+	mirror  string  // URL the connection fetches from
+	segment int     // Index into Download.Ranges, -1 while idle
+	bytes   int64   // Written since the last measurement
+	speed   float64 // Bytes per second, smoothed over the measurements
+	retired bool
+}
+
+// ConnectionStatus describes a live connection of a parallel download.
+type ConnectionStatus struct {
+	ID      int    `json:"id"`
+	Mirror  string `json:"mirror"`  // URL the connection fetches from
+	Segment int    `json:"segment"` // Index into Ranges, -1 while between segments
+	Speed   int64  `json:"speed"`   // Bytes per second, measured every tuneInterval
+}
+
+// segmenter spreads the ranges of a parallel download over a changing set of
+// connections. A connection that runs out of work steals the second half of
+// the largest remaining range, so one slow connection no longer dictates
+// when the download finishes. The number of connections is tuned at runtime:
+// it grows while more connections raise the total throughput and shrinks
+// back once they stop helping.
+//
+// Downloads with mirrors spread their connections over them, filling the
+// preferred mirrors first. A mirror that keeps failing is dropped and its
+// connections move on to the others.
+//
+// Ranges, their owners, the connections and the mirrors are guarded by the
+// download's mu.
+type segmenter struct {
+	d      *Download
+	file   *os.File
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	owner   map[int]*connection // Segment index to the connection fetching it
+	conns   []*connection
+	mirrors []string          // Usable mirror URLs, preferred first
+	load    map[string]int    // Live connections per mirror
+	etags   map[string]string // ETag each mirror first answered with
+	target  int               // Number of connections wanted
+	live    int               // Number of connections running
+	nextID  int               // Id of the next connection
+	written int64             // Bytes on disk across all segments
+	done    chan struct{}
+
+	// Hill climbing state of tune.
+	windowBytes int64
+	ticks       int
+	lastRate    float64
+	grew        bool
+	settled     bool
+}
+
+func newSegmenter(ctx context.Context, d *Download, file *os.File, connections int) *segmenter {
+	s := &segmenter{
+		d:      d,
+		file:   file,
+		owner:  make(map[int]*connection),
+		load:   make(map[string]int),
+		etags:  make(map[string]string),
+		target: max(connections, 1),
+		done:   make(chan struct{}),
+	}
+	d.mu.Lock()
+	s.mirrors = d.usableMirrorsLocked()
+	d.mu.Unlock()
+	s.ctx, s.cancel = context.WithCancelCause(ctx)
+	for _, r := range d.Ranges {
+		s.written += r.Written()
+	}
+	return s
+}
+
+// run fetches every range and returns once all are done or one failed.
+func (s *segmenter) run() error {
+	defer s.cancel(nil)
+
+	s.d.updateProgress(s.written)
+
+	s.d.mu.Lock()
+	s.spawnLocked()
+	idle := s.live == 0
+	s.d.mu.Unlock()
+	if idle {
+		return nil
+	}
+
+	ticker := time.NewTicker(tuneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			if s.ctx.Err() != nil {
+				return context.Cause(s.ctx)
+			}
+			return s.check()
+		case <-ticker.C:
+			s.tune()
+		}
+	}
+}
+
+// check confirms every range was fetched after the last connection left.
+func (s *segmenter) check() error {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	for i, r := range s.d.Ranges {
+		if !r.Done() {
+			return fmt.Errorf("segment %d stopped %d bytes before its end", i, r.End-r.Offset+1)
+		}
+	}
+	return nil
+}
+
+// spawnLocked starts connections until the target is met or no work is left
+// to hand out.
+func (s *segmenter) spawnLocked() {
+	for s.live < s.target && s.hasWorkLocked() {
+		c := &connection{id: s.nextID, mirror: s.pickMirrorLocked(), segment: -1}
+		s.load[c.mirror]++
+		s.nextID++
+		s.conns = append(s.conns, c)
+		s.live++
+		go s.work(c)
+	}
+}
+
+// hasWorkLocked reports whether a new connection would find something to do.
+func (s *segmenter) hasWorkLocked() bool {
+	for i, r := range s.d.Ranges {
+		if r.Done() {
+			continue
+		}
+		if _, owned := s.owner[i]; !owned || r.End-r.Offset+1 >= 2*config.MinSegmentSize {
+			return true
+		}
+	}
+	return false
+}
+
+// work fetches segments on one connection until no work is left, the
+// connection is retired or a segment fails for good.
+func (s *segmenter) work(c *connection) {
+	for {
+		index, ok := s.claim(c)
+		if !ok {
+			return
+		}
+
+		err := s.d.withRetry(s.ctx, fmt.Sprintf("Segment %d", index), func(ctx context.Context) error {
+			err := s.fetch(ctx, c, index)
+			s.d.recordFailure(ctx, index, err)
+			return err
+		})
+		s.release(c, index)
+		if err == nil {
+			// Hash what the other segments wrote past this one while it is cached.
+			if err := s.d.catchUp(); err != nil {
+				log.Warnf("Failed to hash %s after segment %d: %v", s.d.FileName, index, err)
+			}
+		}
+
+		switch {
+		case errors.Is(err, errRetired):
+			s.leave(c)
+			return
+		case err != nil && s.dropMirror(c, err):
+			continue
+		case err != nil:
+			s.cancel(fmt.Errorf("segment %d: %w", index, err))
+			s.leave(c)
+			return
+		}
+	}
+}
+
+// claim hands c an unowned segment or, failing that, splits the largest
+// remaining one. It retires c when there is nothing left worth splitting or
+// the segmenter wants fewer connections.
+func (s *segmenter) claim(c *connection) (int, bool) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+
+	if s.ctx.Err() == nil && s.live <= s.target {
+		for i, r := range s.d.Ranges {
+			if _, owned := s.owner[i]; !owned && !r.Done() {
+				s.ownLocked(c, i)
+				return i, true
+			}
+		}
+		if i, ok := s.splitLocked(c); ok {
+			s.ownLocked(c, i)
+			return i, true
+		}
+	}
+
+	s.leaveLocked(c)
+	return -1, false
+}
+
+// splitLocked cuts the tail off the owned segment with the most bytes left
+// and appends it as a new segment. The cut is placed so that both
+// connections finish at about the same time given their measured speeds.
+func (s *segmenter) splitLocked(c *connection) (int, bool) {
+	largest, remaining := -1, int64(0)
+	for i, r := range s.d.Ranges {
+		if left := r.End - r.Offset + 1; !r.Done() && left > remaining {
+			largest, remaining = i, left
+		}
+	}
+	if largest < 0 || remaining < 2*config.MinSegmentSize {
+		return -1, false
+	}
+
+	keep := remaining / 2
+	if victim := s.owner[largest]; victim != nil {
+		mine := c.speed
+		if mine == 0 {
+			mine = s.averageSpeedLocked()
+		}
+		if victim.speed > 0 && mine > 0 {
+			keep = int64(float64(remaining) * victim.speed / (victim.speed + mine))
+		}
+	}
+	// The owner writes at most one buffer past the offset it last saw, which
+	// is always well before the cut.
+	keep = min(max(keep, config.MinSegmentSize), remaining-config.MinSegmentSize)
+
+	r := &s.d.Ranges[largest]
+	cut := r.Offset + keep
+	s.d.Ranges = append(s.d.Ranges, models.Range{Start: cut, End: r.End, Offset: cut})
+	s.d.Ranges[largest].End = cut - 1
+	s.d.RangesCount = len(s.d.Ranges)
+	log.Infof("Connection %d took bytes %d-%d of segment %d of %s", c.id, cut, s.d.Ranges[len(s.d.Ranges)-1].End, largest, s.d.URL)
+	return len(s.d.Ranges) - 1, true
+}
+
+func (s *segmenter) averageSpeedLocked() float64 {
+	var total float64
+	var n int
+	for _, c := range s.conns {
+		if !c.retired && c.speed > 0 {
+			total += c.speed
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return total / float64(n)
+}
+
+func (s *segmenter) ownLocked(c *connection, index int) {
+	s.owner[index] = c
+	c.segment = index
+}
+
+func (s *segmenter) release(c *connection, index int) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	if s.owner[index] == c {
+		delete(s.owner, index)
+	}
+	c.segment = -1
+}
+
+// retire reports whether c should stop because there are more connections
+// than wanted, and if so takes it out of the count. The segment it leaves
+// behind is picked up by the others.
+func (s *segmenter) retire(c *connection) bool {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	if c.retired || s.live <= s.target {
+		return false
+	}
+	s.leaveLocked(c)
+	return true
+}
+
+func (s *segmenter) leave(c *connection) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	s.leaveLocked(c)
+}
+
+func (s *segmenter) leaveLocked(c *connection) {
+	if c.retired {
+		return
+	}
+	c.retired = true
+	s.load[c.mirror]--
+	s.live--
+	if s.live == 0 {
+		close(s.done)
+	}
+}
+
+// pickMirrorLocked returns the preferred mirror among those with the fewest
+// connections.
+func (s *segmenter) pickMirrorLocked() string {
+	best := s.mirrors[0]
+	for _, m := range s.mirrors[1:] {
+		if s.load[m] < s.load[best] {
+			best = m
+		}
+	}
+	return best
+}
+
+// dropMirror stops using the mirror of c after a failure that retries did
+// not fix, or after it turned out to serve another file, and moves c to
+// another mirror. It reports false when the failure is not the mirror's
+// fault or no other mirror is left, and the download has to fail.
+func (s *segmenter) dropMirror(c *connection, err error) bool {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	if s.ctx.Err() != nil || !mirrorFault(err) {
+		return false
+	}
+
+	for i, m := range s.mirrors {
+		if m == c.mirror {
+			s.d.excludeMirrorLocked(m, err)
+			if len(s.mirrors) == 1 {
+				return false
+			}
+			s.mirrors = append(s.mirrors[:i:i], s.mirrors[i+1:]...)
+			break
+		}
+	}
+	s.load[c.mirror]--
+	c.mirror = s.pickMirrorLocked()
+	s.load[c.mirror]++
+	return true
+}
+
+// fetch downloads the unfinished bytes of a segment straight to their place
+// in the file. The segment may shrink while it is fetched, when another
+// connection steals its tail; fetch then stops at the new end. The
+// validators of the probe only hold for the main URL; the content of the
+// other mirrors is checked against the checksums of the download.
+func (s *segmenter) fetch(ctx context.Context, c *connection, index int) error {
+	s.d.mu.Lock()
+	r := s.d.Ranges[index]
+	s.d.mu.Unlock()
+	if r.Done() {
+		return nil
+	}
+
+	primary := c.mirror == s.d.URL
+	req, err := http.NewRequestWithContext(ctx, "GET", c.mirror, nil)
+	if err != nil {
+		return permanent(err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", r.Offset, r.End))
+	if primary {
+		s.d.setIfRange(req)
+	} else {
+		s.d.mu.Lock()
+		etag := s.etags[c.mirror]
+		s.d.mu.Unlock()
+		if etag != "" && !strings.HasPrefix(etag, "W/") {
+			req.Header.Set("If-Range", etag)
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		if resp.StatusCode == http.StatusOK && primary {
+			return s.d.fullResponseError()
+		}
+		if resp.StatusCode == http.StatusOK {
+			return permanent(fmt.Errorf("%w: answered the range request in full", errMirrorMismatch))
+		}
+		return newStatusError(resp)
+	}
+	if primary {
+		if err := s.d.checkValidators(resp.Header); err != nil {
+			return err
+		}
+	} else {
+		s.d.mu.Lock()
+		err := s.checkMirrorLocked(c.mirror, resp.Header)
+		s.d.mu.Unlock()
+		if err != nil {
+			return permanent(err)
+		}
+	}
+	if err := s.d.checkContentRange(resp.Header, r.Offset); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 32*1024) // 32KB chunks
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if err := s.d.throttle(ctx, n); err != nil {
+				return err
+			}
+
+			s.d.mu.Lock()
+			r = s.d.Ranges[index]
+			s.d.mu.Unlock()
+			if left := r.End - r.Offset + 1; int64(n) > left {
+				n = int(left)
+			}
+
+			written, err2 := s.file.WriteAt(buf[:n], r.Offset)
+			if err2 != nil {
+				return permanent(err2)
+			}
+
+			s.d.digest(buf[:written], r.Offset)
+
+			s.d.mu.Lock()
+			s.d.Ranges[index].Offset += int64(written)
+			r = s.d.Ranges[index]
+			c.bytes += int64(written)
+			s.written += int64(written)
+			total := s.written
+			s.d.mu.Unlock()
+			s.d.updateProgress(total)
+
+			if r.Done() {
+				return nil
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		if s.retire(c) {
+			return errRetired
+		}
+	}
+
+	if !r.Done() {
+		return fmt.Errorf("connection closed %d bytes before the end of the segment", r.End-r.Offset+1)
+	}
+	return nil
+}
+
+// tune updates the speed of every connection and, once per window, adjusts
+// the number of connections: another one is added while the previous
+// addition raised the total throughput by at least a tenth, otherwise the
+// last addition is taken back and the count stays where it is.
+func (s *segmenter) tune() {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+
+	seconds := tuneInterval.Seconds()
+	for _, c := range s.conns {
+		if c.retired {
+			continue
+		}
+		speed := float64(c.bytes) / seconds
+		if c.speed == 0 {
+			c.speed = speed
+		} else {
+			c.speed = 0.7*c.speed + 0.3*speed
+		}
+		s.windowBytes += c.bytes
+		c.bytes = 0
+	}
+
+	s.ticks++
+	if s.ticks < tuneWindow {
+		return
+	}
+	rate := float64(s.windowBytes) / (float64(s.ticks) * seconds)
+	s.ticks, s.windowBytes = 0, 0
+
+	if s.settled {
+		return
+	}
+	// A window in which connections ran out of work says nothing about how
+	// many of them the server can feed.
+	if s.live < s.target {
+		s.grew, s.lastRate = false, 0
+		return
+	}
+	if s.grew && rate < s.lastRate*1.1 {
+		s.target--
+		s.settled = true
+		log.Infof("Settled on %d connections for %s at %.0f KB/s", s.target, s.d.URL, rate/1024)
+		return
+	}
+	s.grew = false
+	if s.target < config.MaxConnections && s.live >= s.target && s.hasWorkLocked() {
+		s.target++
+		s.grew = true
+		log.Infof("Growing to %d connections for %s at %.0f KB/s", s.target, s.d.URL, rate/1024)
+		s.spawnLocked()
+	}
+	s.lastRate = rate
+}
@@ -0,0 +1,140 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Amirali-Amirifar/gofetch.git/internal/models"
+)
+
+// slowWriter sends a response in small chunks with a pause after each.
+type slowWriter struct {
+	http.ResponseWriter
+	chunk int
+	pause time.Duration
+}
+
+func (w slowWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n, err := w.ResponseWriter.Write(p[:min(w.chunk, len(p))])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		w.ResponseWriter.(http.Flusher).Flush()
+		p = p[n:]
+		time.Sleep(w.pause)
+	}
+	return written, nil
+}
+
+func TestWorkStealing(t *testing.T) {
+	const size = 12 << 20
+	content := testContent(size)
+	s := newFileServer(t, content)
+	// The first segment trickles in while the others arrive at once, so the
+	// connections that finish early have to take over its tail.
+	s.handle = func(w http.ResponseWriter, r *http.Request, attempt int) bool {
+		if !strings.HasPrefix(r.Header.Get("Range"), "bytes=0-") {
+			return false
+		}
+		s.serveContent(slowWriter{ResponseWriter: w, chunk: 32 << 10, pause: 20 * time.Millisecond}, r)
+		return true
+	}
+	d := newTestDownload(t, s)
+
+	if err := d.start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if d.Status != models.DownloadStatusCompleted {
+		t.Fatalf("status = %s, want %s: %s", d.Status, models.DownloadStatusCompleted, d.LastError)
+	}
+	checkFile(t, d, content)
+
+	ranges := slices.Clone(d.Ranges)
+	slices.SortFunc(ranges, func(a, b models.Range) int { return int(a.Start - b.Start) })
+	split := false
+	next := int64(0)
+	for _, r := range ranges {
+		if r.Start != next {
+			t.Fatalf("segments %v do not tile the file: expected one to start at %d", ranges, next)
+		}
+		if !r.Done() {
+			t.Errorf("segment %d-%d is not done", r.Start, r.End)
+		}
+		next = r.End + 1
+		// The first segment initially covers the first quarter of the file.
+		split = split || (r.Start > 0 && r.Start < size/4)
+	}
+	if next != size {
+		t.Errorf("segments end at %d, want %d", next, size)
+	}
+	if !split {
+		t.Errorf("the slow first segment was never split: %v", ranges)
+	}
+}
+
+func TestContentRangeChecked(t *testing.T) {
+	const size = 12 << 20
+	content := testContent(size)
+
+	tests := []struct {
+		name    string
+		respond func(w http.ResponseWriter, start, end int64)
+	}{
+		{
+			name: "wrong start",
+			respond: func(w http.ResponseWriter, start, end int64) {
+				n := end - start + 1
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", n-1, size))
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(content[:n])
+			},
+		},
+		{
+			name: "wrong total",
+			respond: func(w http.ResponseWriter, start, end int64) {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, 2*size))
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(content[start : end+1])
+			},
+		},
+		{
+			name: "no Content-Range",
+			respond: func(w http.ResponseWriter, start, end int64) {
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(content[start : end+1])
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			s := newFileServer(t, content)
+			// The segments after the first are answered badly.
+			s.handle = func(w http.ResponseWriter, r *http.Request, attempt int) bool {
+				header := r.Header.Get("Range")
+				if header == "" || strings.HasPrefix(header, "bytes=0-") {
+					return false
+				}
+				start, end := parseRange(t, header, size)
+				tt.respond(w, start, end)
+				return true
+			}
+			d := newTestDownload(t, s)
+
+			d.start()
+			if d.Status == models.DownloadStatusCompleted {
+				t.Fatal("download completed from misplaced bytes")
+			}
+			if d.LastError == "" {
+				t.Error("the failure is not recorded")
+			}
+		})
+	}
+}
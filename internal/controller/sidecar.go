@@ -0,0 +1,162 @@
+package controller
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxSidecarSize caps how much of a checksum file is read. SUMS files of
+// large mirrors list many artifacts but stay well below this.
+const maxSidecarSize = 1 << 20
+
+// sidecar is a checksum file published next to an artifact.
+type sidecar struct {
+	url       string
+	algorithm string // Algorithm of entries without their own tag, empty to infer it from the digest length
+	single    bool   // Describes only this artifact, so an entry without a matching name still applies
+}
+
+// sidecars lists the checksum files to look for, strongest first: files named
+// after the artifact, then the SUMS files of its directory.
+func sidecars(u *url.URL) []sidecar {
+	var candidates []sidecar
+	for _, c := range []struct{ ext, algorithm string }{
+		{".sha512", "sha512"}, {".sha256", "sha256"}, {".sha1", "sha1"}, {".md5", "md5"},
+	} {
+		file := *u
+		file.Path += c.ext
+		file.RawPath = ""
+		candidates = append(candidates, sidecar{url: file.String(), algorithm: c.algorithm, single: true})
+	}
+	for _, c := range []struct{ name, algorithm string }{
+		{"SHA512SUMS", "sha512"}, {"SHA256SUMS", "sha256"}, {"SHA1SUMS", "sha1"}, {"MD5SUMS", "md5"},
+	} {
+		file := *u
+		file.Path = path.Join(path.Dir(u.Path), c.name)
+		file.RawPath = ""
+		file.RawQuery = ""
+		candidates = append(candidates, sidecar{url: file.String(), algorithm: c.algorithm})
+	}
+	return candidates
+}
+
+// discoverChecksum looks for a published checksum of the download and adopts
+// the first one found. Missing or unreadable sidecars are not an error.
+func (d *Download) discoverChecksum() {
+	u, err := url.Parse(d.URL)
+	if err != nil || u.Path == "" || strings.HasSuffix(u.Path, "/") {
+		return
+	}
+
+	names := []string{path.Base(u.Path)}
+	if d.FileName != "" && d.FileName != names[0] {
+		names = append(names, path.Base(d.FileName))
+	}
+
+	for _, c := range sidecars(u) {
+		body, err := fetchText(c.url, maxSidecarSize)
+		if err != nil {
+			log.Debugf("No checksum file at %s: %v", c.url, err)
+			continue
+		}
+		checksum, ok := findChecksum(body, c, names)
+		if !ok {
+			continue
+		}
+		d.Checksum = checksum
+		log.Infof("Using checksum %s of %s from %s", checksum, d.URL, c.url)
+		return
+	}
+}
+
+// fetchText reads a small text resource such as a checksum or metalink file,
+// up to limit bytes.
+func fetchText(rawURL string, limit int64) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", newStatusError(resp)
+	}
+	// Some mirrors answer missing files with an HTML page.
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		return "", fmt.Errorf("got an HTML page")
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// bsdLine matches the BSD format: "SHA256 (name) = digest".
+var bsdLine = regexp.MustCompile(`^([A-Za-z0-9-]+) ?\((.*)\) ?= ?([0-9A-Fa-f]+)$`)
+
+// findChecksum looks for the entry of one of names in a checksum file in GNU
+// ("digest  name", "digest *name") or BSD format. A sidecar of a single
+// artifact may also hold just the digest.
+func findChecksum(body string, c sidecar, names []string) (string, bool) {
+	var unnamed []string
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		algorithm, digest, name := c.algorithm, "", ""
+		if m := bsdLine.FindStringSubmatch(line); m != nil {
+			algorithm, name, digest = m[1], m[2], m[3]
+		} else {
+			fields := strings.Fields(line)
+			digest = fields[0]
+			if len(fields) > 1 {
+				name = strings.TrimPrefix(strings.Join(fields[1:], " "), "*")
+			}
+		}
+
+		checksum := digest
+		if algorithm != "" {
+			checksum = algorithm + ":" + digest
+		}
+		checksum, err := ParseChecksum(checksum)
+		if err != nil {
+			continue
+		}
+
+		name = strings.TrimPrefix(name, "./")
+		for _, want := range names {
+			if name == want || path.Base(name) == want {
+				return checksum, true
+			}
+		}
+		if c.single {
+			unnamed = append(unnamed, checksum)
+		}
+	}
+
+	// Without a matching name, only a sidecar holding one digest is trusted.
+	if c.single && len(unnamed) == 1 {
+		return unnamed[0], true
+	}
+	return "", false
+}
@@ -0,0 +1,121 @@
+package controller
+
+import "testing"
+
+func TestFindChecksum(t *testing.T) {
+	sums := sidecar{algorithm: "sha256"}
+	single := sidecar{algorithm: "sha256", single: true}
+	names := []string{"app.tar.gz"}
+
+	tests := []struct {
+		name   string
+		body   string
+		c      sidecar
+		want   string
+		wantOK bool
+	}{
+		{
+			name:   "GNU text mode",
+			body:   emptySHA256 + "  app.tar.gz\n",
+			c:      sums,
+			want:   "sha256:" + emptySHA256,
+			wantOK: true,
+		},
+		{
+			name:   "GNU binary marker",
+			body:   emptySHA256 + " *app.tar.gz\n",
+			c:      sums,
+			want:   "sha256:" + emptySHA256,
+			wantOK: true,
+		},
+		{
+			name:   "among other files, with comments and blank lines",
+			body:   "# release checksums\n\n" + emptyMD5 + emptyMD5 + "  other.zip\n" + emptySHA256 + "  app.tar.gz\n",
+			c:      sums,
+			want:   "sha256:" + emptySHA256,
+			wantOK: true,
+		},
+		{
+			name:   "relative path",
+			body:   emptySHA256 + "  ./dist/app.tar.gz\n",
+			c:      sums,
+			want:   "sha256:" + emptySHA256,
+			wantOK: true,
+		},
+		{
+			name:   "BSD tag",
+			body:   "SHA256 (app.tar.gz) = " + emptySHA256 + "\n",
+			c:      sums,
+			want:   "sha256:" + emptySHA256,
+			wantOK: true,
+		},
+		{
+			name:   "BSD tag overrides the sidecar algorithm",
+			body:   "MD5 (app.tar.gz) = " + emptyMD5 + "\n",
+			c:      sums,
+			want:   "md5:" + emptyMD5,
+			wantOK: true,
+		},
+		{
+			name:   "BSD tag without spaces",
+			body:   "SHA1(app.tar.gz)=" + emptySHA1 + "\n",
+			c:      sums,
+			want:   "sha1:" + emptySHA1,
+			wantOK: true,
+		},
+		{
+			name:   "invalid digest is skipped",
+			body:   "xyz  app.tar.gz\n" + emptySHA256 + "  app.tar.gz\n",
+			c:      sums,
+			want:   "sha256:" + emptySHA256,
+			wantOK: true,
+		},
+		{
+			name:   "other file only",
+			body:   emptySHA256 + "  other.zip\n",
+			c:      sums,
+			wantOK: false,
+		},
+		{
+			name:   "bare digest in a single sidecar",
+			body:   emptySHA256 + "\n",
+			c:      single,
+			want:   "sha256:" + emptySHA256,
+			wantOK: true,
+		},
+		{
+			name:   "bare digest in a SUMS file",
+			body:   emptySHA256 + "\n",
+			c:      sums,
+			wantOK: false,
+		},
+		{
+			name:   "single sidecar naming another file",
+			body:   emptySHA256 + "  renamed.tar.gz\n",
+			c:      single,
+			want:   "sha256:" + emptySHA256,
+			wantOK: true,
+		},
+		{
+			name:   "single sidecar with several unnamed digests",
+			body:   emptySHA256 + "  a.tar.gz\n" + emptySHA256 + "  b.tar.gz\n",
+			c:      single,
+			wantOK: false,
+		},
+		{
+			name:   "algorithm inferred from the length",
+			body:   emptySHA1 + "  app.tar.gz\n",
+			c:      sidecar{},
+			want:   "sha1:" + emptySHA1,
+			wantOK: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := findChecksum(tt.body, tt.c, names)
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("findChecksum() = %q, %v, want %q, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package controller
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/Amirali-Amirifar/gofetch.git/internal/models"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	log "github.com/sirupsen/logrus"
+)
+
+// checkSignature verifies the detached OpenPGP signature of a completed
+// download against the configured keyring and records the outcome and the
+// signing key on the row. Without a signature given by the user, one
+// published as <url>.sig or <url>.asc is used; when there is none, the
+// download is simply left unsigned.
+func (d *Download) checkSignature() {
+	d.mu.Lock()
+	keyring, source, completed := d.keyring, d.Signature, d.Status == models.DownloadStatusCompleted
+	d.mu.Unlock()
+	if !completed || (keyring == "" && source == "") {
+		return
+	}
+
+	status, signer, err := d.verifySignature(keyring, source)
+	if status == "" {
+		return
+	}
+	if err != nil {
+		log.Warnf("Signature of %s: %s: %v", d.FileName, status, err)
+	} else {
+		log.Infof("Signature of %s is good, made by %s", d.FileName, signer)
+	}
+
+	d.mu.Lock()
+	d.SignatureStatus = status
+	d.Signer = signer
+	if err != nil {
+		d.LastError = "signature: " + err.Error()
+	}
+	d.mu.Unlock()
+	d.persist()
+}
+
+// verifySignature returns an empty status when no signature was found.
+func (d *Download) verifySignature(keyring, source string) (models.SignatureStatus, string, error) {
+	if keyring == "" {
+		return models.SignatureError, "", errors.New("no keyring configured")
+	}
+	keys, err := readKeyring(keyring)
+	if err != nil {
+		return models.SignatureError, "", err
+	}
+
+	signature, err := d.loadSignature(source)
+	if err != nil {
+		return models.SignatureError, "", err
+	}
+	if signature == nil {
+		return "", "", nil
+	}
+	if signature, err = dearmor(signature, openpgp.SignatureType); err != nil {
+		return models.SignatureError, "", err
+	}
+
+	file, err := os.Open(d.FileName)
+	if err != nil {
+		return models.SignatureError, "", err
+	}
+	defer file.Close()
+
+	_, signer, err := openpgp.VerifyDetachedSignature(keys, file, bytes.NewReader(signature), nil)
+	switch {
+	case err == nil:
+		return models.SignatureGood, fingerprint(signer), nil
+	case errors.Is(err, pgperrors.ErrUnknownIssuer):
+		return models.SignatureUnknownKey, issuer(signature), err
+	case signer != nil:
+		// Expired or revoked keys still identify who signed.
+		return models.SignatureBad, fingerprint(signer), err
+	default:
+		return models.SignatureBad, issuer(signature), err
+	}
+}
+
+// IsURL reports whether source, a signature or a metalink, is fetched from
+// a web server rather than read from a local path.
+func IsURL(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// loadSignature reads the signature from source, a URL or a local path, or
+// looks for one published next to the download when source is empty.
+func (d *Download) loadSignature(source string) ([]byte, error) {
+	if source != "" {
+		if IsURL(source) {
+			body, err := fetchText(source, maxSidecarSize)
+			if err != nil {
+				return nil, fmt.Errorf("failed to fetch signature %s: %w", source, err)
+			}
+			return []byte(body), nil
+		}
+		return os.ReadFile(source)
+	}
+
+	u, err := url.Parse(d.URL)
+	if err != nil || u.Path == "" || strings.HasSuffix(u.Path, "/") {
+		return nil, nil
+	}
+	for _, ext := range []string{".sig", ".asc"} {
+		file := *u
+		file.Path += ext
+		file.RawPath = ""
+		body, err := fetchText(file.String(), maxSidecarSize)
+		if err != nil {
+			log.Debugf("No signature at %s: %v", file.String(), err)
+			continue
+		}
+		d.mu.Lock()
+		d.Signature = file.String()
+		d.mu.Unlock()
+		return []byte(body), nil
+	}
+	return nil, nil
+}
+
+// readKeyring loads public keys exported with gpg --export, armored or not.
+func readKeyring(fileName string) (openpgp.EntityList, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyring: %w", err)
+	}
+	if data, err = dearmor(data, openpgp.PublicKeyType); err != nil {
+		return nil, fmt.Errorf("failed to read keyring: %w", err)
+	}
+	keys, err := openpgp.ReadKeyRing(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyring %s: %w", fileName, err)
+	}
+	return keys, nil
+}
+
+// dearmor returns the binary packets of an ASCII armored block of the given
+// type, and binary input as it is.
+func dearmor(data []byte, blockType string) ([]byte, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN ")) {
+		return data, nil
+	}
+	block, err := armor.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if block.Type != blockType {
+		return nil, fmt.Errorf("expected %s, got %s", blockType, block.Type)
+	}
+	return io.ReadAll(block.Body)
+}
+
+func fingerprint(e *openpgp.Entity) string {
+	return fmt.Sprintf("%X", e.PrimaryKey.Fingerprint)
+}
+
+// issuer names the key a signature claims to be made by, for signatures that
+// could not be checked against it.
+func issuer(signature []byte) string {
+	p, err := packet.NewReader(bytes.NewReader(signature)).Next()
+	if err != nil {
+		return ""
+	}
+	sig, ok := p.(*packet.Signature)
+	switch {
+	case !ok:
+		return ""
+	case len(sig.IssuerFingerprint) != 0:
+		return fmt.Sprintf("%X", sig.IssuerFingerprint)
+	case sig.IssuerKeyId != nil:
+		return fmt.Sprintf("%016X", *sig.IssuerKeyId)
+	}
+	return ""
+}
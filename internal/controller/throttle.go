@@ -0,0 +1,46 @@
+package controller
+
+import (
+	"context"
+
+	"golang.org/x/time/rate"
+)
+
+// throttleBurst is the largest number of bytes a limiter hands out at once.
+// It matches the read buffer, so a single read never exceeds the burst.
+const throttleBurst = 32 * 1024
+
+// newLimiter returns a token bucket refilled at kbps kilobytes per second,
+// or an unlimited one when kbps is not positive.
+func newLimiter(kbps int64) *rate.Limiter {
+	l := rate.NewLimiter(rate.Inf, throttleBurst)
+	setLimit(l, kbps)
+	return l
+}
+
+// setLimit changes the refill rate of l. Transfers waiting on the limiter
+// pick up the new rate with their next read.
+func setLimit(l *rate.Limiter, kbps int64) {
+	if kbps <= 0 {
+		l.SetLimit(rate.Inf)
+		return
+	}
+	l.SetLimit(rate.Limit(kbps * 1024))
+}
+
+// throttle blocks until every limiter of the download allows n more bytes.
+// It returns early with the cause if ctx is done while waiting.
+func (d *Download) throttle(ctx context.Context, n int) error {
+	d.mu.Lock()
+	limiters := d.limiters
+	d.mu.Unlock()
+	for _, l := range limiters {
+		if err := l.WaitN(ctx, n); err != nil {
+			if ctx.Err() != nil {
+				return context.Cause(ctx)
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// errChanged means the remote file is no longer the one the kept bytes came
+// from. Stitching the two together would corrupt the file, so it is never
+// retried.
+var errChanged = errors.New("remote file changed")
+
+// ifRange returns the validator to send in If-Range: the ETag if it is a
+// strong one, else Last-Modified. Weak ETags are not allowed in If-Range.
+func (d *Download) ifRange() string {
+	if d.ETag != "" && !strings.HasPrefix(d.ETag, "W/") {
+		return d.ETag
+	}
+	return d.LastModified
+}
+
+// setIfRange makes a ranged request conditional on the file being unchanged.
+// A server that sees a different version answers with the whole file.
+func (d *Download) setIfRange(req *http.Request) {
+	if validator := d.ifRange(); validator != "" {
+		req.Header.Set("If-Range", validator)
+	}
+}
+
+// checkValidators compares the validators of a partial response with the
+// ones recorded when the download was probed.
+func (d *Download) checkValidators(header http.Header) error {
+	if etag := header.Get("ETag"); d.ETag != "" && etag != "" && etag != d.ETag {
+		return fmt.Errorf("%w: ETag %s is now %s", errChanged, d.ETag, etag)
+	}
+	if modified := header.Get("Last-Modified"); d.LastModified != "" && modified != "" && modified != d.LastModified {
+		return fmt.Errorf("%w: last modified %s, now %s", errChanged, d.LastModified, modified)
+	}
+	return nil
+}
+
+// checkContentRange makes sure a partial response starts at offset and is
+// part of a file of the recorded size. Writing a body that starts elsewhere
+// would put its bytes in the wrong place.
+func (d *Download) checkContentRange(header http.Header, offset int64) error {
+	value := header.Get("Content-Range")
+	start, size, ok := parseByteRange(value)
+	if !ok {
+		return permanent(fmt.Errorf("malformed Content-Range %q", value))
+	}
+	if start != offset {
+		return permanent(fmt.Errorf("server sent bytes from %d instead of %d", start, offset))
+	}
+	if d.ContentLength > 0 && size != d.ContentLength {
+		return fmt.Errorf("%w: %d bytes instead of %d", errChanged, size, d.ContentLength)
+	}
+	return nil
+}
+
+// fullResponseError explains a 200 answer to a ranged request. With a
+// validator in If-Range it means the file changed, otherwise the server
+// does not honour ranges for this file after all.
+func (d *Download) fullResponseError() error {
+	if d.ifRange() != "" {
+		return fmt.Errorf("%w: server sent a new version in full", errChanged)
+	}
+	return permanent(fmt.Errorf("server ignored the range request"))
+}
@@ -0,0 +1,131 @@
+package controller
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Amirali-Amirifar/gofetch.git/internal/models"
+)
+
+func TestIfRange(t *testing.T) {
+	const small, large = 1 << 20, 12 << 20
+	later := modTime.Add(time.Hour)
+
+	tests := []struct {
+		name        string
+		size        int
+		etag        string // ETag of the first version, empty to rely on Last-Modified
+		newETag     string
+		newModified time.Time
+		want        models.DownloadStatus
+		wantIfRange string
+	}{
+		{
+			name:        "unchanged",
+			size:        small,
+			etag:        `"v1"`,
+			newETag:     `"v1"`,
+			newModified: modTime,
+			want:        models.DownloadStatusCompleted,
+			wantIfRange: `"v1"`,
+		},
+		{
+			name:        "new ETag",
+			size:        small,
+			etag:        `"v1"`,
+			newETag:     `"v2"`,
+			newModified: modTime,
+			want:        models.DownloadStatusChanged,
+			wantIfRange: `"v1"`,
+		},
+		{
+			name:        "new Last-Modified",
+			size:        small,
+			newModified: later,
+			want:        models.DownloadStatusChanged,
+			wantIfRange: modTime.Format(http.TimeFormat),
+		},
+		{
+			name:        "new ETag, parallel segments",
+			size:        large,
+			etag:        `"v1"`,
+			newETag:     `"v2"`,
+			newModified: modTime,
+			want:        models.DownloadStatusChanged,
+			wantIfRange: `"v1"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := testContent(tt.size)
+			s := newFileServer(t, content)
+			s.replace(content, tt.etag, modTime)
+			var ifRange []string
+			s.handle = func(w http.ResponseWriter, r *http.Request, attempt int) bool {
+				s.mu.Lock()
+				ifRange = append(ifRange, r.Header.Get("If-Range"))
+				s.mu.Unlock()
+				return false
+			}
+			d := newTestDownload(t, s)
+
+			size := int64(tt.size)
+			half := size / 2
+			ranges := []models.Range{{Start: 0, End: size - 1, Offset: half}}
+			if tt.size == large {
+				ranges = []models.Range{
+					{Start: 0, End: half - 1, Offset: half / 2},
+					{Start: half, End: size - 1, Offset: half + half/2},
+				}
+			}
+			prepare(t, d, content, ranges)
+			before, err := os.ReadFile(d.FileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			newContent := content
+			if tt.want == models.DownloadStatusChanged {
+				newContent = bytes.Repeat([]byte{0xAA}, tt.size)
+			}
+			s.replace(newContent, tt.newETag, tt.newModified)
+
+			d.start()
+			if d.Status != tt.want {
+				t.Fatalf("status = %s, want %s: %s", d.Status, tt.want, d.LastError)
+			}
+			s.mu.Lock()
+			sent := append([]string(nil), ifRange...)
+			s.mu.Unlock()
+			if len(sent) == 0 {
+				t.Fatal("nothing was requested")
+			}
+			for _, v := range sent {
+				if v != tt.wantIfRange {
+					t.Errorf("If-Range = %q, want %q", v, tt.wantIfRange)
+				}
+			}
+
+			if tt.want == models.DownloadStatusCompleted {
+				checkFile(t, d, content)
+				return
+			}
+			// None of the new version may be mixed into the old bytes.
+			after, err := os.ReadFile(d.FileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range ranges {
+				if !bytes.Equal(after[r.Start:r.Offset], before[r.Start:r.Offset]) {
+					t.Errorf("bytes %d-%d kept before the change were overwritten", r.Start, r.Offset-1)
+				}
+			}
+			if bytes.Contains(after, bytes.Repeat([]byte{0xAA}, 64)) {
+				t.Error("bytes of the new version were written into the old file")
+			}
+		})
+	}
+}
@@ -0,0 +1,470 @@
+package daemon
+
+import (
+	"crypto/subtle"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Amirali-Amirifar/gofetch.git/internal/config"
+	"github.com/Amirali-Amirifar/gofetch.git/internal/controller"
+	"github.com/Amirali-Amirifar/gofetch.git/internal/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// The REST API serves downloads and queues as resources under apiPrefix,
+// for dashboards and scripts, and describes itself in an OpenAPI document.
+// Clients send the secret of the JSON-RPC interface as a bearer token, or
+// as the token query parameter where they cannot set headers, like
+// EventSource in browsers.
+const apiPrefix = "/api/v1"
+
+// keepAliveInterval is how often an idle event stream gets a comment, so
+// proxies in between do not time it out.
+const keepAliveInterval = 15 * time.Second
+
+//go:embed openapi.json
+var openAPI []byte
+
+// webFiles is the web UI, a page using the REST API that is served at the
+// root. It asks for the secret itself, so the files need none.
+//
+//go:embed web
+var webFiles embed.FS
+
+// apiError is the body of a failed request. A metalink may have added some
+// of its downloads before one failed; those are returned along with it.
+type apiError struct {
+	Error     string     `json:"error"`
+	Downloads []Download `json:"downloads,omitempty"`
+}
+
+// newDownload is the body of a request adding a download.
+type newDownload struct {
+	URL       string   `json:"url"`
+	QueueName string   `json:"queue_name"`
+	FileName  string   `json:"file_name"`
+	Checksum  string   `json:"checksum"`
+	Signature string   `json:"signature"`
+	Mirrors   []string `json:"mirrors"` // More URLs of the same file
+}
+
+// downloadPatch is the body of a request changing a download.
+type downloadPatch struct {
+	QueueName string `json:"queue_name"`
+}
+
+// settings are the settings of the daemon clients may change.
+type settings struct {
+	GlobalBandwidthLimit int64 `json:"global_bandwidth_limit"` // KB/s shared by all queues, 0 = unlimited
+	DiscoverChecksums    bool  `json:"discover_checksums"`
+}
+
+// settingsPatch is the body of a request changing the settings it names.
+type settingsPatch struct {
+	GlobalBandwidthLimit *int64 `json:"global_bandwidth_limit"`
+	DiscoverChecksums    *bool  `json:"discover_checksums"`
+}
+
+// ServeAPI serves the aria2-compatible JSON-RPC interface, the REST API and
+// the web UI on addr until Shutdown is called. Clients authenticate with secret, which
+// must not be empty.
+func (s *Server) ServeAPI(addr, secret string) error {
+	if secret == "" {
+		return errors.New("rpc_secret must be set in state.json to serve the HTTP interfaces")
+	}
+	r, err := newRPC(s, secret)
+	if err != nil {
+		return err
+	}
+	web, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(rpcPath, r)
+	mux.Handle(apiPrefix+"/", s.api(secret))
+	mux.Handle("/", http.FileServerFS(web))
+	hs := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-s.done
+		hs.Close()
+		r.closeSockets()
+	}()
+	go r.notify()
+
+	log.Infof("JSON-RPC, REST API and web UI listening on http://%s", l.Addr())
+	if err := hs.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) api(secret string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+apiPrefix+"/openapi.json", handleOpenAPI)
+	mux.HandleFunc("GET "+apiPrefix+"/downloads", s.handleListDownloads)
+	mux.HandleFunc("POST "+apiPrefix+"/downloads", s.handleAddDownload)
+	mux.HandleFunc("GET "+apiPrefix+"/downloads/{id}", s.handleGetDownload)
+	mux.HandleFunc("PATCH "+apiPrefix+"/downloads/{id}", s.handlePatchDownload)
+	mux.HandleFunc("DELETE "+apiPrefix+"/downloads/{id}", s.handleDeleteDownload)
+	mux.HandleFunc("POST "+apiPrefix+"/downloads/{id}/pause", s.handleControl(pause))
+	mux.HandleFunc("POST "+apiPrefix+"/downloads/{id}/resume", s.handleControl(s.resume))
+	mux.HandleFunc("POST "+apiPrefix+"/downloads/{id}/cancel", s.handleControl(cancel))
+	mux.HandleFunc("POST "+apiPrefix+"/downloads/{id}/retry", s.handleControl(s.scheduler.Retry))
+	mux.HandleFunc("GET "+apiPrefix+"/queues", s.handleListQueues)
+	mux.HandleFunc("POST "+apiPrefix+"/queues", s.handleCreateQueue)
+	mux.HandleFunc("GET "+apiPrefix+"/queues/{name}", s.handleGetQueue)
+	mux.HandleFunc("PUT "+apiPrefix+"/queues/{name}", s.handlePutQueue)
+	mux.HandleFunc("DELETE "+apiPrefix+"/queues/{name}", s.handleDeleteQueue)
+	mux.HandleFunc("GET "+apiPrefix+"/settings", s.handleGetSettings)
+	mux.HandleFunc("PATCH "+apiPrefix+"/settings", s.handlePatchSettings)
+	mux.HandleFunc("GET "+apiPrefix+"/events", s.handleEvents)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		// The description of the API is no secret.
+		if r.URL.Path != apiPrefix+"/openapi.json" && !authorizedRequest(r, secret) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gofetch"`)
+			writeError(w, http.StatusUnauthorized, errors.New("missing or wrong secret"))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func authorizedRequest(r *http.Request, secret string) bool {
+	token := r.URL.Query().Get("token")
+	if scheme, bearer, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		token = bearer
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Debugf("Failed to write an API response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, apiError{Error: err.Error()})
+}
+
+// readJSON decodes the body of a request into v, rejecting unknown fields
+// so misspelled ones do not go unnoticed.
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRPCBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return false
+	}
+	return true
+}
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPI)
+}
+
+func (s *Server) handleListDownloads(w http.ResponseWriter, r *http.Request) {
+	all, err := s.list()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	status, queue := r.URL.Query().Get("status"), r.URL.Query().Get("queue")
+	downloads := make([]Download, 0, len(all))
+	for _, d := range all {
+		if (status == "" || string(d.Status) == status) && (queue == "" || d.QueueName == queue) {
+			downloads = append(downloads, d)
+		}
+	}
+	writeJSON(w, http.StatusOK, downloads)
+}
+
+// handleAddDownload adds the downloads of a URL. A file_name that exists
+// already is not overwritten; the download is renamed, see
+// controller.Download.Create.
+func (s *Server) handleAddDownload(w http.ResponseWriter, r *http.Request) {
+	var body newDownload
+	if !readJSON(w, r, &body) {
+		return
+	}
+	if body.URL == "" {
+		writeError(w, http.StatusUnprocessableEntity, errors.New("url is required"))
+		return
+	}
+	// Clients of the API are other programs: they may not have the daemon
+	// read local files, nor write outside the storage folder.
+	if body.Signature != "" && !controller.IsURL(body.Signature) {
+		writeError(w, http.StatusUnprocessableEntity, errors.New("signature must be an http or https URL"))
+		return
+	}
+	download := models.Download{
+		URL:       body.URL,
+		QueueName: body.QueueName,
+		FileName:  controller.ConfineName(body.FileName),
+		Checksum:  body.Checksum,
+		Signature: body.Signature,
+	}
+	for _, url := range body.Mirrors {
+		download.Mirrors = append(download.Mirrors, models.Mirror{URL: url, Priority: 1})
+	}
+
+	added, err := s.scheduler.Add(download)
+	downloads := make([]Download, len(added))
+	for i, d := range added {
+		downloads[i] = s.view(d)
+	}
+	if err != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, apiError{Error: err.Error(), Downloads: downloads})
+		return
+	}
+	writeJSON(w, http.StatusCreated, downloads)
+}
+
+// lookupDownload returns the download named in the path, or answers with
+// the reason there is none.
+func (s *Server) lookupDownload(w http.ResponseWriter, r *http.Request) (*controller.Download, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid download id %q", r.PathValue("id")))
+		return nil, false
+	}
+	d, err := s.scheduler.Lookup(id)
+	if err != nil {
+		var notFound *controller.NotFoundError
+		if errors.As(err, &notFound) {
+			writeError(w, http.StatusNotFound, err)
+		} else {
+			writeError(w, http.StatusInternalServerError, err)
+		}
+		return nil, false
+	}
+	return d, true
+}
+
+func (s *Server) handleGetDownload(w http.ResponseWriter, r *http.Request) {
+	if d, ok := s.lookupDownload(w, r); ok {
+		writeJSON(w, http.StatusOK, s.view(d))
+	}
+}
+
+func (s *Server) handlePatchDownload(w http.ResponseWriter, r *http.Request) {
+	d, ok := s.lookupDownload(w, r)
+	if !ok {
+		return
+	}
+	var patch downloadPatch
+	if !readJSON(w, r, &patch) {
+		return
+	}
+	if patch.QueueName != "" {
+		if err := s.scheduler.Move(d, patch.QueueName); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, s.view(d))
+}
+
+// handleDeleteDownload removes a download, and its file with delete_file.
+func (s *Server) handleDeleteDownload(w http.ResponseWriter, r *http.Request) {
+	d, ok := s.lookupDownload(w, r)
+	if !ok {
+		return
+	}
+	deleteFile, _ := strconv.ParseBool(r.URL.Query().Get("delete_file"))
+	if _, err := s.remove(d.Id, deleteFile); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleControl applies action to the download named in the path. An
+// action the download is in the wrong status for is a conflict.
+func (s *Server) handleControl(action func(d *controller.Download) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		d, ok := s.lookupDownload(w, r)
+		if !ok {
+			return
+		}
+		if err := action(d); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, s.view(d))
+	}
+}
+
+func (s *Server) handleListQueues(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.snapshotState().Queues)
+}
+
+// lookupQueue returns the queue named in the path, or answers that there is
+// no such queue.
+func (s *Server) lookupQueue(w http.ResponseWriter, r *http.Request) (models.Queue, bool) {
+	state := s.snapshotState()
+	i := findQueue(&state, r.PathValue("name"))
+	if i < 0 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no queue named %s", r.PathValue("name")))
+		return models.Queue{}, false
+	}
+	return state.Queues[i], true
+}
+
+func (s *Server) handleGetQueue(w http.ResponseWriter, r *http.Request) {
+	if queue, ok := s.lookupQueue(w, r); ok {
+		writeJSON(w, http.StatusOK, queue)
+	}
+}
+
+func (s *Server) handleCreateQueue(w http.ResponseWriter, r *http.Request) {
+	var queue models.Queue
+	if !readJSON(w, r, &queue) {
+		return
+	}
+	s.writeQueue(w, "", queue, http.StatusCreated)
+}
+
+// handlePutQueue replaces the settings of a queue. A different name in the
+// body renames it.
+func (s *Server) handlePutQueue(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.lookupQueue(w, r); !ok {
+		return
+	}
+	var queue models.Queue
+	if !readJSON(w, r, &queue) {
+		return
+	}
+	s.writeQueue(w, r.PathValue("name"), queue, http.StatusOK)
+}
+
+// writeQueue saves a queue and answers with it as saved.
+func (s *Server) writeQueue(w http.ResponseWriter, name string, queue models.Queue, status int) {
+	state, err := s.saveQueue(name, queue)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	writeJSON(w, status, state.Queues[findQueue(&state, queue.Name)])
+}
+
+// handleDeleteQueue removes a queue. Its downloads move to the Default
+// queue, or are canceled with ?cancel=true.
+func (s *Server) handleDeleteQueue(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.lookupQueue(w, r); !ok {
+		return
+	}
+	name := r.PathValue("name")
+	if name == config.DefaultQueueName {
+		writeError(w, http.StatusConflict, fmt.Errorf("the %s queue cannot be deleted", name))
+		return
+	}
+	cancel, _ := strconv.ParseBool(r.URL.Query().Get("cancel"))
+	if _, err := s.deleteQueue(name, cancel); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleGetSettings(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, settingsOf(s.snapshotState()))
+}
+
+func (s *Server) handlePatchSettings(w http.ResponseWriter, r *http.Request) {
+	var patch settingsPatch
+	if !readJSON(w, r, &patch) {
+		return
+	}
+	state := s.snapshotState()
+	var err error
+	if patch.GlobalBandwidthLimit != nil {
+		state, err = s.setGlobalLimit(*patch.GlobalBandwidthLimit)
+	}
+	if err == nil && patch.DiscoverChecksums != nil {
+		state, err = s.setChecksumDiscovery(*patch.DiscoverChecksums)
+	}
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, settingsOf(state))
+}
+
+func settingsOf(state models.AppState) settings {
+	return settings{GlobalBandwidthLimit: state.GlobalBandwidthLimit, DiscoverChecksums: state.DiscoverChecksums}
+}
+
+// handleEvents streams the events of the daemon as Server-Sent Events: a
+// download event with the download whenever one changed, and a state event
+// with the queues and settings whenever they changed.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+	events, stop := s.listen()
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				// Fell behind; the client reconnects and starts over.
+				return
+			}
+			var data []byte
+			var err error
+			if e.Download != nil {
+				data, err = json.Marshal(e.Download)
+			} else {
+				data, err = json.Marshal(e.State)
+			}
+			if err != nil {
+				log.Errorf("Failed to encode a %s event: %v", e.Type, err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		case <-s.done:
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,363 @@
+package daemon
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// The JSON-RPC interface speaks the part of aria2's RPC protocol that
+// browser extensions, AriaNg and media managers rely on, so gofetch can take
+// the place of aria2 for them. Requests are POSTed to rpcPath or sent over a
+// WebSocket opened on it; only WebSocket clients receive notifications.
+const (
+	rpcPath = "/jsonrpc"
+	// maxRPCBody bounds a request, or a batch of them.
+	maxRPCBody = 1 << 20
+	// rpcWriteTimeout is how long a WebSocket client may take to accept an
+	// answer or a notification before it is disconnected.
+	rpcWriteTimeout = 10 * time.Second
+)
+
+// Error codes of JSON-RPC 2.0, and the code aria2 reports every failure of
+// a method with.
+const (
+	codeFailed         = 1
+	codeParseError     = -32700
+	codeInvalidRequest = -32600
+	codeMethodNotFound = -32601
+	codeInvalidParams  = -32602
+)
+
+var errUnauthorized = &rpcError{Code: codeFailed, Message: "Unauthorized"}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+func invalidParams(format string, args ...any) error {
+	return &rpcError{Code: codeInvalidParams, Message: fmt.Sprintf(format, args...)}
+}
+
+type rpcRequest struct {
+	ID     json.RawMessage   `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcNotification struct {
+	JSONRPC string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  []any  `json:"params"`
+}
+
+// rpc serves the aria2-compatible JSON-RPC interface of a Server.
+type rpc struct {
+	server  *Server
+	secret  string
+	session string // Id of this run of the daemon, for aria2.getSessionInfo
+
+	mu      sync.Mutex // Guards sockets
+	sockets map[*socket]bool
+}
+
+// socket is a WebSocket client of the JSON-RPC interface.
+type socket struct {
+	*websocket.Conn
+	mu sync.Mutex // Serializes writes of answers and notifications
+}
+
+var upgrader = websocket.Upgrader{
+	// Web pages of any origin may connect, like to aria2 with
+	// --rpc-allow-origin-all; they still need the secret.
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+func newRPC(s *Server, secret string) (*rpc, error) {
+	session := make([]byte, 20)
+	if _, err := rand.Read(session); err != nil {
+		return nil, err
+	}
+	return &rpc{server: s, secret: secret, session: hex.EncodeToString(session), sockets: make(map[*socket]bool)}, nil
+}
+
+func (r *rpc) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	switch {
+	case websocket.IsWebSocketUpgrade(req):
+		r.serveWebSocket(w, req)
+	case req.Method == http.MethodOptions:
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.WriteHeader(http.StatusNoContent)
+	case req.Method == http.MethodPost:
+		body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxRPCBody))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json-rpc")
+		w.Write(r.handle(body))
+	default:
+		w.Header().Set("Allow", "POST, OPTIONS")
+		http.Error(w, "JSON-RPC requests must be POSTed or sent over a WebSocket", http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *rpc) serveWebSocket(w http.ResponseWriter, req *http.Request) {
+	ws, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		// The upgrader already answered with the error.
+		return
+	}
+	s := &socket{Conn: ws}
+	r.mu.Lock()
+	r.sockets[s] = true
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.sockets, s)
+		r.mu.Unlock()
+		ws.Close()
+	}()
+
+	ws.SetReadLimit(maxRPCBody)
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		// Answered concurrently, like requests on the daemon socket.
+		go func() {
+			if err := s.write(r.handle(data)); err != nil {
+				log.Debugf("Failed to answer a JSON-RPC client: %v", err)
+			}
+		}()
+	}
+}
+
+func (s *socket) write(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.SetWriteDeadline(time.Now().Add(rpcWriteTimeout))
+	err := s.WriteMessage(websocket.TextMessage, data)
+	if err != nil {
+		s.Close()
+	}
+	return err
+}
+
+func (r *rpc) closeSockets() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for s := range r.sockets {
+		s.Close()
+	}
+}
+
+// handle answers a request or a batch of them.
+func (r *rpc) handle(body []byte) []byte {
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(body, &batch); err != nil {
+			return encode(failure(nil, &rpcError{Code: codeParseError, Message: err.Error()}))
+		}
+		answers := make([]rpcResponse, len(batch))
+		for i, raw := range batch {
+			answers[i] = r.handleOne(raw)
+		}
+		return encode(answers)
+	}
+	return encode(r.handleOne(body))
+}
+
+func (r *rpc) handleOne(raw json.RawMessage) rpcResponse {
+	var req rpcRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return failure(nil, &rpcError{Code: codeParseError, Message: err.Error()})
+	}
+	if req.Method == "" {
+		return failure(req.ID, &rpcError{Code: codeInvalidRequest, Message: "missing method"})
+	}
+
+	result, err := r.call(req.Method, req.Params)
+	if err != nil {
+		return failure(req.ID, err)
+	}
+	return rpcResponse{JSONRPC: "2.0", ID: id(req.ID), Result: result}
+}
+
+func failure(reqID json.RawMessage, err error) rpcResponse {
+	var e *rpcError
+	if !errors.As(err, &e) {
+		e = &rpcError{Code: codeFailed, Message: err.Error()}
+	}
+	return rpcResponse{JSONRPC: "2.0", ID: id(reqID), Error: e}
+}
+
+// id echoes the id of a request, which is null when it had none.
+func id(reqID json.RawMessage) json.RawMessage {
+	if len(reqID) == 0 {
+		return json.RawMessage("null")
+	}
+	return reqID
+}
+
+func encode(v any) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(failure(nil, err))
+	}
+	return data
+}
+
+// call runs a method. Apart from the system methods that describe the
+// interface, every method takes "token:<secret>" as its first parameter.
+func (r *rpc) call(method string, params []json.RawMessage) (any, error) {
+	switch method {
+	case "system.listMethods":
+		return append([]string{"system.listMethods", "system.listNotifications", "system.multicall"}, methodNames()...), nil
+	case "system.listNotifications":
+		return notificationNames(), nil
+	case "system.multicall":
+		return r.multicall(params)
+	}
+
+	handler, ok := methods[method]
+	if !ok {
+		return nil, &rpcError{Code: codeMethodNotFound, Message: fmt.Sprintf("No such method: %s", method)}
+	}
+	if !r.authorized(params) {
+		return nil, errUnauthorized
+	}
+	return handler(r, params[1:])
+}
+
+func (r *rpc) authorized(params []json.RawMessage) bool {
+	var token string
+	if len(params) == 0 || json.Unmarshal(params[0], &token) != nil {
+		return false
+	}
+	secret, ok := strings.CutPrefix(token, "token:")
+	return ok && subtle.ConstantTimeCompare([]byte(secret), []byte(r.secret)) == 1
+}
+
+// multicall runs several methods in one request. Like aria2 it wraps each
+// result in an array, and returns a failure as its error object.
+func (r *rpc) multicall(params []json.RawMessage) (any, error) {
+	var calls []struct {
+		MethodName string            `json:"methodName"`
+		Params     []json.RawMessage `json:"params"`
+	}
+	if err := param(params, 0, &calls); err != nil {
+		return nil, err
+	}
+	results := make([]any, len(calls))
+	for i, c := range calls {
+		if c.MethodName == "system.multicall" {
+			results[i] = &rpcError{Code: codeFailed, Message: "Recursive system.multicall forbidden."}
+			continue
+		}
+		result, err := r.call(c.MethodName, c.Params)
+		if err != nil {
+			results[i] = failure(nil, err).Error
+			continue
+		}
+		results[i] = []any{result}
+	}
+	return results, nil
+}
+
+// param decodes the parameter at index i into v. A missing parameter leaves
+// v alone, so optional ones keep their defaults.
+func param(params []json.RawMessage, i int, v any) error {
+	if i >= len(params) {
+		return nil
+	}
+	if err := json.Unmarshal(params[i], v); err != nil {
+		return invalidParams("invalid parameter %d: %v", i+1, err)
+	}
+	return nil
+}
+
+// notify pushes aria2's notifications to WebSocket clients as downloads
+// start, pause, stop, complete or fail.
+func (r *rpc) notify() {
+	events, stop := r.server.listen()
+	defer func() { stop() }()
+	statuses := make(map[int64]string)
+	for {
+		var e Event
+		var ok bool
+		select {
+		case e, ok = <-events:
+		case <-r.server.done:
+			return
+		}
+		if !ok {
+			// Fell behind; the statuses still tell what changed since.
+			events, stop = r.server.listen()
+			continue
+		}
+		if e.Type != EventDownload {
+			continue
+		}
+
+		status := ariaStatus(*e.Download)
+		previous, seen := statuses[e.Download.Id]
+		statuses[e.Download.Id] = status
+		// A download seen for the first time may have stopped long ago, when
+		// a client looked it up, unless it ran in this session.
+		if status == previous || (!seen && status != statusActive && e.Download.StartTime.IsZero()) {
+			continue
+		}
+		if method, ok := notifications[status]; ok {
+			r.broadcast(method, gid(e.Download.Id))
+		}
+	}
+}
+
+func (r *rpc) broadcast(method, gid string) {
+	data := encode(rpcNotification{
+		JSONRPC: "2.0",
+		Method:  method,
+		Params:  []any{map[string]string{"gid": gid}},
+	})
+	r.mu.Lock()
+	sockets := make([]*socket, 0, len(r.sockets))
+	for s := range r.sockets {
+		sockets = append(sockets, s)
+	}
+	r.mu.Unlock()
+
+	for _, s := range sockets {
+		if err := s.write(data); err != nil {
+			log.Debugf("Failed to notify a JSON-RPC client: %v", err)
+		}
+	}
+}
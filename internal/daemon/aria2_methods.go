@@ -0,0 +1,585 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Amirali-Amirifar/gofetch.git/internal/config"
+	"github.com/Amirali-Amirifar/gofetch.git/internal/controller"
+	"github.com/Amirali-Amirifar/gofetch.git/internal/models"
+	"github.com/Amirali-Amirifar/gofetch.git/internal/queues"
+	log "github.com/sirupsen/logrus"
+)
+
+// ariaVersion is the aria2 release whose interface is served. Clients
+// decide which methods to use by it.
+const ariaVersion = "1.37.0"
+
+// defaultPieceLength is the piece size reported for downloads without
+// piece checksums, aria2's default.
+const defaultPieceLength = 1024 * 1024
+
+// Statuses of downloads in aria2.
+const (
+	statusActive   = "active"
+	statusWaiting  = "waiting"
+	statusPaused   = "paused"
+	statusComplete = "complete"
+	statusError    = "error"
+	statusRemoved  = "removed"
+)
+
+// notifications maps the status a download entered to the notification
+// aria2 sends for it.
+var notifications = map[string]string{
+	statusActive:   "aria2.onDownloadStart",
+	statusPaused:   "aria2.onDownloadPause",
+	statusRemoved:  "aria2.onDownloadStop",
+	statusComplete: "aria2.onDownloadComplete",
+	statusError:    "aria2.onDownloadError",
+}
+
+// methods are the aria2 methods served, called with the parameters that
+// follow the secret token.
+var methods = map[string]func(r *rpc, params []json.RawMessage) (any, error){
+	"aria2.addUri":             (*rpc).addURI,
+	"aria2.remove":             (*rpc).remove,
+	"aria2.forceRemove":        (*rpc).remove,
+	"aria2.pause":              (*rpc).pause,
+	"aria2.forcePause":         (*rpc).pause,
+	"aria2.pauseAll":           (*rpc).pauseAll,
+	"aria2.forcePauseAll":      (*rpc).pauseAll,
+	"aria2.unpause":            (*rpc).unpause,
+	"aria2.unpauseAll":         (*rpc).unpauseAll,
+	"aria2.tellStatus":         (*rpc).tellStatus,
+	"aria2.getUris":            (*rpc).getURIs,
+	"aria2.getFiles":           (*rpc).getFiles,
+	"aria2.tellActive":         (*rpc).tellActive,
+	"aria2.tellWaiting":        (*rpc).tellWaiting,
+	"aria2.tellStopped":        (*rpc).tellStopped,
+	"aria2.getOption":          (*rpc).getOption,
+	"aria2.getGlobalOption":    (*rpc).getGlobalOption,
+	"aria2.changeGlobalOption": (*rpc).changeGlobalOption,
+	"aria2.getGlobalStat":      (*rpc).getGlobalStat,
+	"aria2.getVersion":         (*rpc).getVersion,
+	"aria2.getSessionInfo":     (*rpc).getSessionInfo,
+	"aria2.shutdown":           (*rpc).shutdown,
+	"aria2.forceShutdown":      (*rpc).shutdown,
+}
+
+func methodNames() []string {
+	names := make([]string, 0, len(methods))
+	for name := range methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func notificationNames() []string {
+	names := make([]string, 0, len(notifications))
+	for _, name := range notifications {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// gid formats a download id as an aria2 GID, 16 hex digits.
+func gid(id int64) string {
+	return fmt.Sprintf("%016x", id)
+}
+
+func parseGID(gid string) (int64, error) {
+	id, err := strconv.ParseInt(gid, 16, 64)
+	if err != nil || id <= 0 {
+		return 0, invalidParams("invalid GID %s", gid)
+	}
+	return id, nil
+}
+
+// lookup returns the download whose GID is the first parameter.
+func (r *rpc) lookup(params []json.RawMessage) (*controller.Download, error) {
+	var g string
+	if err := param(params, 0, &g); err != nil {
+		return nil, err
+	}
+	id, err := parseGID(g)
+	if err != nil {
+		return nil, err
+	}
+	return r.server.scheduler.Lookup(id)
+}
+
+// addURI adds a download of the file the URIs point to, the first being
+// the URL and the others its mirrors. Of the options, out names the file,
+// dir places it together with out inside the storage folder of a queue, and
+// checksum is verified at the end; options gofetch has no use for are
+// ignored. Like aria2's auto-file-renaming, a file already at dir/out is
+// kept and the download gets a name like "out(1)". The download goes to the
+// Default queue, regardless of the position asked for.
+func (r *rpc) addURI(params []json.RawMessage) (any, error) {
+	var uris []string
+	var options map[string]string
+	if err := param(params, 0, &uris); err != nil {
+		return nil, err
+	}
+	if err := param(params, 1, &options); err != nil {
+		return nil, err
+	}
+	if len(uris) == 0 {
+		return nil, invalidParams("no URI to download")
+	}
+
+	fileName, err := r.fileName(options["dir"], options["out"])
+	if err != nil {
+		return nil, err
+	}
+	download := models.Download{URL: uris[0], FileName: fileName, Checksum: options["checksum"]}
+	if len(uris) > 1 {
+		for _, uri := range uris {
+			download.Mirrors = append(download.Mirrors, models.Mirror{URL: uri, Priority: 1})
+		}
+	}
+	for option := range options {
+		switch option {
+		case "out", "dir", "checksum":
+		default:
+			log.Debugf("Ignoring aria2 option %s of %s", option, download.URL)
+		}
+	}
+
+	// A URL that cannot be fetched still gets a download, which ends up in
+	// the error status, as with aria2.
+	downloads, err := r.server.scheduler.Add(download)
+	if len(downloads) == 0 {
+		return nil, err
+	}
+	if err != nil {
+		log.Warnf("JSON-RPC download %s: %v", download.URL, err)
+	}
+	return gid(downloads[0].Id), nil
+}
+
+// fileName checks the dir and out options of addUri and joins them. out
+// must be a relative path that stays where it is put, and dir the storage
+// folder of a queue or a folder inside one, so clients cannot have files
+// written anywhere else.
+func (r *rpc) fileName(dir, out string) (string, error) {
+	separator := func(c rune) bool { return c == '/' || c == '\\' }
+	if filepath.IsAbs(out) || slices.Contains(strings.FieldsFunc(out, separator), "..") {
+		return "", invalidParams("out %q must be a relative path without ..", out)
+	}
+	if dir == "" {
+		return out, nil
+	}
+
+	expanded, err := queues.ExpandFolder(dir)
+	if err != nil {
+		return "", err
+	}
+	expanded = filepath.Clean(expanded)
+	state := r.server.snapshotState()
+	inside := filepath.IsAbs(expanded) && slices.ContainsFunc(state.Queues, func(q models.Queue) bool {
+		folder, err := queues.ExpandFolder(q.StorageFolder)
+		if err != nil {
+			return false
+		}
+		rel, err := filepath.Rel(filepath.Clean(folder), expanded)
+		return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+	})
+	if !inside {
+		return "", invalidParams("dir %q is not the storage folder of a queue, nor inside one", dir)
+	}
+	if out == "" {
+		return "", nil
+	}
+	return filepath.Join(expanded, out), nil
+}
+
+func (r *rpc) remove(params []json.RawMessage) (any, error) {
+	return r.control(params, cancel)
+}
+
+func (r *rpc) pause(params []json.RawMessage) (any, error) {
+	return r.control(params, pause)
+}
+
+func (r *rpc) unpause(params []json.RawMessage) (any, error) {
+	return r.control(params, r.server.resume)
+}
+
+func (r *rpc) control(params []json.RawMessage, action func(d *controller.Download) error) (any, error) {
+	d, err := r.lookup(params)
+	if err != nil {
+		return nil, err
+	}
+	if err := action(d); err != nil {
+		return nil, err
+	}
+	return gid(d.Id), nil
+}
+
+func (r *rpc) pauseAll([]json.RawMessage) (any, error) {
+	for _, d := range r.server.scheduler.Downloads() {
+		switch d.Snapshot().Status {
+		case models.DownloadStatusQueued, models.DownloadStatusDownloading:
+			d.PauseDownload()
+		}
+	}
+	return "OK", nil
+}
+
+// unpauseAll resumes the paused downloads. Those waiting for confirmation
+// to start over or re-fetch corrupted parts are left alone.
+func (r *rpc) unpauseAll([]json.RawMessage) (any, error) {
+	for _, d := range r.server.scheduler.Downloads() {
+		if d.Snapshot().Status == models.DownloadStatusPaused {
+			r.server.scheduler.Resume(d)
+		}
+	}
+	return "OK", nil
+}
+
+func (r *rpc) tellStatus(params []json.RawMessage) (any, error) {
+	d, err := r.lookup(params)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	if err := param(params, 1, &keys); err != nil {
+		return nil, err
+	}
+	return status(r.server.view(d), keys), nil
+}
+
+func (r *rpc) getURIs(params []json.RawMessage) (any, error) {
+	d, err := r.lookup(params)
+	if err != nil {
+		return nil, err
+	}
+	return uris(d.Snapshot()), nil
+}
+
+func (r *rpc) getFiles(params []json.RawMessage) (any, error) {
+	d, err := r.lookup(params)
+	if err != nil {
+		return nil, err
+	}
+	return files(r.server.view(d)), nil
+}
+
+func (r *rpc) tellActive(params []json.RawMessage) (any, error) {
+	var keys []string
+	if err := param(params, 0, &keys); err != nil {
+		return nil, err
+	}
+	return r.tell(keys, 0, -1, statusActive)
+}
+
+func (r *rpc) tellWaiting(params []json.RawMessage) (any, error) {
+	offset, num, keys, err := pageParams(params)
+	if err != nil {
+		return nil, err
+	}
+	return r.tell(keys, offset, num, statusWaiting, statusPaused)
+}
+
+func (r *rpc) tellStopped(params []json.RawMessage) (any, error) {
+	offset, num, keys, err := pageParams(params)
+	if err != nil {
+		return nil, err
+	}
+	return r.tell(keys, offset, num, statusComplete, statusError, statusRemoved)
+}
+
+func pageParams(params []json.RawMessage) (offset, num int, keys []string, err error) {
+	if len(params) < 2 {
+		return 0, 0, nil, invalidParams("offset and num are required")
+	}
+	if err = param(params, 0, &offset); err == nil {
+		if err = param(params, 1, &num); err == nil {
+			err = param(params, 2, &keys)
+		}
+	}
+	return offset, num, keys, err
+}
+
+// tell returns the status of the downloads in the given aria2 statuses. A
+// page of num downloads starts at offset, or counts back from the last one
+// when offset is negative, as in aria2; num < 0 returns them all.
+func (r *rpc) tell(keys []string, offset, num int, statuses ...string) (any, error) {
+	all, err := r.server.list()
+	if err != nil {
+		return nil, err
+	}
+	var matching []Download
+	for _, d := range all {
+		for _, s := range statuses {
+			if ariaStatus(d) == s {
+				matching = append(matching, d)
+				break
+			}
+		}
+	}
+
+	if offset < 0 {
+		for i, j := 0, len(matching)-1; i < j; i, j = i+1, j-1 {
+			matching[i], matching[j] = matching[j], matching[i]
+		}
+		offset = -offset - 1
+	}
+	offset = min(offset, len(matching))
+	matching = matching[offset:]
+	if num >= 0 && num < len(matching) {
+		matching = matching[:num]
+	}
+
+	result := make([]map[string]any, len(matching))
+	for i, d := range matching {
+		result[i] = status(d, keys)
+	}
+	return result, nil
+}
+
+func (r *rpc) getOption(params []json.RawMessage) (any, error) {
+	d, err := r.lookup(params)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := d.Snapshot()
+	options := map[string]string{"out": filepath.Base(snapshot.FileName)}
+	if filepath.IsAbs(snapshot.FileName) {
+		options["dir"] = filepath.Dir(snapshot.FileName)
+	}
+	if snapshot.Checksum != "" {
+		options["checksum"] = snapshot.Checksum
+	}
+	return options, nil
+}
+
+func (r *rpc) getGlobalOption([]json.RawMessage) (any, error) {
+	state := r.server.snapshotState()
+	queue := state.Queues[findQueue(&state, config.DefaultQueueName)]
+	return map[string]string{
+		"dir":                        queue.StorageFolder,
+		"max-concurrent-downloads":   strconv.Itoa(queue.MaxSimultaneous),
+		"max-overall-download-limit": strconv.FormatInt(state.GlobalBandwidthLimit*1024, 10),
+		"max-download-limit":         strconv.FormatInt(queue.MaxDownloadSpeed*1024, 10),
+	}, nil
+}
+
+// changeGlobalOption changes the speed limits and the number of
+// simultaneous downloads, which are those of the Default queue except for
+// the overall limit that caps all queues.
+func (r *rpc) changeGlobalOption(params []json.RawMessage) (any, error) {
+	var options map[string]string
+	if err := param(params, 0, &options); err != nil {
+		return nil, err
+	}
+
+	state := r.server.snapshotState()
+	queue := state.Queues[findQueue(&state, config.DefaultQueueName)]
+	var global *int64
+	var queueChanged bool
+	for option, value := range options {
+		var err error
+		switch option {
+		case "max-overall-download-limit":
+			var kbps int64
+			kbps, err = parseSpeed(value)
+			global = &kbps
+		case "max-download-limit":
+			queue.MaxDownloadSpeed, err = parseSpeed(value)
+			queueChanged = true
+		case "max-concurrent-downloads":
+			queue.MaxSimultaneous, err = strconv.Atoi(value)
+			queueChanged = true
+		default:
+			err = errors.New("gofetch does not support it")
+		}
+		if err != nil {
+			return nil, invalidParams("option %s: %v", option, err)
+		}
+	}
+
+	if queueChanged {
+		if _, err := r.server.saveQueue(queue.Name, queue); err != nil {
+			return nil, err
+		}
+	}
+	if global != nil {
+		if _, err := r.server.setGlobalLimit(*global); err != nil {
+			return nil, err
+		}
+	}
+	return "OK", nil
+}
+
+// parseSpeed reads an aria2 speed limit, bytes per second with an optional
+// K or M suffix, in KB/s. Limits below 1 KB/s are rounded up rather than
+// lifted.
+func parseSpeed(value string) (int64, error) {
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(value, "K"), strings.HasSuffix(value, "k"):
+		multiplier, value = 1024, value[:len(value)-1]
+	case strings.HasSuffix(value, "M"), strings.HasSuffix(value, "m"):
+		multiplier, value = 1024*1024, value[:len(value)-1]
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid speed %q", value)
+	}
+	bytes := n * multiplier
+	return (bytes + 1023) / 1024, nil
+}
+
+func (r *rpc) getGlobalStat([]json.RawMessage) (any, error) {
+	all, err := r.server.list()
+	if err != nil {
+		return nil, err
+	}
+	var speed int64
+	var active, waiting, stopped int
+	for _, d := range all {
+		switch ariaStatus(d) {
+		case statusActive:
+			active++
+			speed += d.Speed
+		case statusWaiting, statusPaused:
+			waiting++
+		default:
+			stopped++
+		}
+	}
+	return map[string]string{
+		"downloadSpeed":   strconv.FormatInt(speed, 10),
+		"uploadSpeed":     "0",
+		"numActive":       strconv.Itoa(active),
+		"numWaiting":      strconv.Itoa(waiting),
+		"numStopped":      strconv.Itoa(stopped),
+		"numStoppedTotal": strconv.Itoa(stopped),
+	}, nil
+}
+
+func (r *rpc) getVersion([]json.RawMessage) (any, error) {
+	return map[string]any{
+		"version":         ariaVersion,
+		"enabledFeatures": []string{"HTTPS", "Message Digest", "Metalink"},
+	}, nil
+}
+
+func (r *rpc) getSessionInfo([]json.RawMessage) (any, error) {
+	return map[string]string{"sessionId": r.session}, nil
+}
+
+func (r *rpc) shutdown([]json.RawMessage) (any, error) {
+	log.Info("Daemon shutting down on a JSON-RPC request")
+	r.server.Shutdown()
+	return "OK", nil
+}
+
+// ariaStatus maps the status of a download to aria2's. Downloads waiting
+// for confirmation to start over or re-fetch corrupted parts are paused.
+func ariaStatus(d Download) string {
+	switch d.Status {
+	case models.DownloadStatusDownloading:
+		return statusActive
+	case models.DownloadStatusPaused, models.DownloadStatusChanged, models.DownloadStatusVerifyFailed:
+		return statusPaused
+	case models.DownloadStatusCompleted:
+		return statusComplete
+	case models.DownloadStatusFailed:
+		return statusError
+	case models.DownloadStatusCanceled:
+		return statusRemoved
+	}
+	return statusWaiting
+}
+
+// status describes a download the way aria2.tellStatus does, with numbers
+// as strings. Only the given keys are returned, or all when there are none.
+func status(d Download, keys []string) map[string]any {
+	pieceLength := int64(defaultPieceLength)
+	if d.Pieces != nil && d.Pieces.Length > 0 {
+		pieceLength = d.Pieces.Length
+	}
+	s := map[string]any{
+		"gid":             gid(d.Id),
+		"status":          ariaStatus(d),
+		"totalLength":     strconv.FormatInt(d.ContentLength, 10),
+		"completedLength": strconv.FormatInt(completed(d), 10),
+		"uploadLength":    "0",
+		"downloadSpeed":   strconv.FormatInt(d.Speed, 10),
+		"uploadSpeed":     "0",
+		"connections":     strconv.Itoa(d.Connections),
+		"pieceLength":     strconv.FormatInt(pieceLength, 10),
+		"numPieces":       strconv.FormatInt((d.ContentLength+pieceLength-1)/pieceLength, 10),
+		"dir":             filepath.Dir(d.FileName),
+		"files":           files(d),
+	}
+	if d.LastError != "" {
+		s["errorCode"] = "1"
+		s["errorMessage"] = d.LastError
+	} else if ariaStatus(d) == statusComplete {
+		s["errorCode"] = "0"
+	}
+
+	if len(keys) == 0 {
+		return s
+	}
+	filtered := make(map[string]any, len(keys))
+	for _, key := range keys {
+		if v, ok := s[key]; ok {
+			filtered[key] = v
+		}
+	}
+	return filtered
+}
+
+// completed returns the bytes of a download on disk. Only the engine tracks
+// the progress of a running download; the store keeps segment offsets.
+func completed(d Download) int64 {
+	if d.Status == models.DownloadStatusCompleted && d.ContentLength > 0 {
+		return d.ContentLength
+	}
+	if d.CurrentProgress > 0 {
+		return d.CurrentProgress
+	}
+	var written int64
+	for _, r := range d.Ranges {
+		written += r.Written()
+	}
+	return written
+}
+
+func files(d Download) []map[string]any {
+	return []map[string]any{{
+		"index":           "1",
+		"path":            d.FileName,
+		"length":          strconv.FormatInt(d.ContentLength, 10),
+		"completedLength": strconv.FormatInt(completed(d), 10),
+		"selected":        "true",
+		"uris":            uris(d.Download),
+	}}
+}
+
+// uris lists the sources of a download. Connections are spread over all
+// mirrors, so each is in use.
+func uris(d models.Download) []map[string]string {
+	if len(d.Mirrors) == 0 {
+		return []map[string]string{{"uri": d.URL, "status": "used"}}
+	}
+	result := make([]map[string]string, len(d.Mirrors))
+	for i, m := range d.Mirrors {
+		result[i] = map[string]string{"uri": m.URL, "status": "used"}
+	}
+	return result
+}
@@ -0,0 +1,286 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Amirali-Amirifar/gofetch.git/internal/models"
+)
+
+// startTimeout is how long Connect waits for a daemon it started to listen.
+const startTimeout = 5 * time.Second
+
+// ErrNotRunning means no daemon listens on the socket.
+var ErrNotRunning = errors.New("gofetch daemon is not running")
+
+// Client talks to a running daemon. Its methods may be called concurrently.
+type Client struct {
+	conn net.Conn
+
+	mu      sync.Mutex // Guards everything below and writes to conn
+	enc     *json.Encoder
+	nextID  int64
+	pending map[int64]chan message
+	events  chan Event
+	err     error // Set once the connection is lost
+}
+
+// Dial connects to the daemon listening on the socket at path.
+func Dial(path string) (*Client, error) {
+	nc, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotRunning, err)
+	}
+	c := &Client{
+		conn:    nc,
+		enc:     json.NewEncoder(nc),
+		pending: make(map[int64]chan message),
+	}
+	go c.read()
+	return c, nil
+}
+
+// Connect connects to the daemon listening on the socket at path, and
+// starts one in the background when none is running.
+func Connect(path string) (*Client, error) {
+	if c, err := Dial(path); err == nil {
+		return c, nil
+	}
+	if err := startDaemon(); err != nil {
+		return nil, fmt.Errorf("failed to start the daemon: %w", err)
+	}
+	deadline := time.Now().Add(startTimeout)
+	for {
+		time.Sleep(100 * time.Millisecond)
+		c, err := Dial(path)
+		if err == nil || time.Now().After(deadline) {
+			return c, err
+		}
+	}
+}
+
+// Close disconnects from the daemon, which keeps running.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) read() {
+	dec := json.NewDecoder(c.conn)
+	for {
+		var m message
+		if err := dec.Decode(&m); err != nil {
+			c.fail(fmt.Errorf("lost connection to the daemon: %w", err))
+			return
+		}
+		if m.ID == 0 {
+			c.mu.Lock()
+			events := c.events
+			c.mu.Unlock()
+			if m.Event != nil && events != nil {
+				events <- *m.Event
+			}
+			continue
+		}
+		c.mu.Lock()
+		answer, ok := c.pending[m.ID]
+		delete(c.pending, m.ID)
+		c.mu.Unlock()
+		if ok {
+			answer <- m
+		}
+	}
+}
+
+// fail ends every call waiting for an answer and the event stream.
+func (c *Client) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = err
+	for id, answer := range c.pending {
+		answer <- message{ID: id, Error: err.Error()}
+		delete(c.pending, id)
+	}
+	if c.events != nil {
+		close(c.events)
+		c.events = nil
+	}
+}
+
+// call sends a request and decodes the answer into result, which may be nil.
+func (c *Client) call(method string, params, result any) error {
+	var raw json.RawMessage
+	if params != nil {
+		var err error
+		if raw, err = json.Marshal(params); err != nil {
+			return err
+		}
+	}
+
+	answer := make(chan message, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return c.err
+	}
+	c.nextID++
+	id := c.nextID
+	c.pending[id] = answer
+	err := c.enc.Encode(request{ID: id, Method: method, Params: raw})
+	if err != nil {
+		delete(c.pending, id)
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to reach the daemon: %w", err)
+	}
+
+	m := <-answer
+	if result != nil && len(m.Result) > 0 {
+		if err := json.Unmarshal(m.Result, result); err != nil {
+			return fmt.Errorf("invalid answer from the daemon: %w", err)
+		}
+	}
+	if m.Error != "" {
+		return errors.New(m.Error)
+	}
+	return nil
+}
+
+// Subscribe starts the stream of events. The channel is closed when the
+// connection is lost, and must be drained: answers to calls wait behind
+// unread events.
+func (c *Client) Subscribe() (<-chan Event, error) {
+	c.mu.Lock()
+	if c.events == nil && c.err == nil {
+		c.events = make(chan Event, eventBuffer)
+	}
+	events := c.events
+	c.mu.Unlock()
+	if err := c.call(methodSubscribe, nil, nil); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// State returns the queues and settings.
+func (c *Client) State() (models.AppState, error) {
+	var state models.AppState
+	err := c.call(methodState, nil, &state)
+	return state, err
+}
+
+// Downloads returns every download, with live progress for running ones.
+func (c *Client) Downloads() ([]Download, error) {
+	var downloads []Download
+	err := c.call(methodList, nil, &downloads)
+	return downloads, err
+}
+
+// Download returns the download with the given id.
+func (c *Client) Download(id int64) (Download, error) {
+	var d Download
+	err := c.call(methodGet, idParams{ID: id}, &d)
+	return d, err
+}
+
+// Add hands a download to its queue once its URL answered. A metalink adds
+// a download for every file it lists; those added before one failed are
+// returned along with the error.
+func (c *Client) Add(download models.Download) ([]Download, error) {
+	var downloads []Download
+	err := c.call(methodAdd, download, &downloads)
+	return downloads, err
+}
+
+// Pause stops a queued or running download, keeping what it fetched.
+func (c *Client) Pause(id int64) (Download, error) {
+	return c.control(methodPause, id)
+}
+
+// Resume puts a paused download back in its queue, and confirms starting
+// over or fetching a file that failed verification again for one waiting on
+// that.
+func (c *Client) Resume(id int64) (Download, error) {
+	return c.control(methodResume, id)
+}
+
+// Cancel stops a download for good.
+func (c *Client) Cancel(id int64) (Download, error) {
+	return c.control(methodCancel, id)
+}
+
+// Retry puts a failed or canceled download back in its queue.
+func (c *Client) Retry(id int64) (Download, error) {
+	return c.control(methodRetry, id)
+}
+
+func (c *Client) control(method string, id int64) (Download, error) {
+	var d Download
+	err := c.call(method, idParams{ID: id}, &d)
+	return d, err
+}
+
+// Move hands a download to another queue.
+func (c *Client) Move(id int64, queue string) (Download, error) {
+	var d Download
+	err := c.call(methodMove, moveParams{ID: id, Queue: queue}, &d)
+	return d, err
+}
+
+// Remove stops a download and deletes it from the list, and with deleteFile
+// deletes its file as well.
+func (c *Client) Remove(id int64, deleteFile bool) (Download, error) {
+	var d Download
+	err := c.call(methodRemove, removeParams{ID: id, DeleteFile: deleteFile}, &d)
+	return d, err
+}
+
+// SaveQueue creates a queue when name is empty, and otherwise replaces the
+// settings of the queue called name, which may rename it.
+func (c *Client) SaveQueue(name string, queue models.Queue) (models.AppState, error) {
+	var state models.AppState
+	err := c.call(methodSaveQueue, saveQueueParams{Name: name, Queue: queue}, &state)
+	return state, err
+}
+
+// DeleteQueue removes a queue. Its downloads move to the Default queue, or
+// are canceled when cancel is set.
+func (c *Client) DeleteQueue(name string, cancel bool) (models.AppState, error) {
+	var state models.AppState
+	err := c.call(methodDeleteQueue, deleteQueueParams{Name: name, Cancel: cancel}, &state)
+	return state, err
+}
+
+// MoveQueue moves a queue to position in the list of queues, counted from
+// 0.
+func (c *Client) MoveQueue(name string, position int) (models.AppState, error) {
+	var state models.AppState
+	err := c.call(methodMoveQueue, moveQueueParams{Name: name, Position: position}, &state)
+	return state, err
+}
+
+// SetGlobalLimit caps the combined speed of all queues in KB/s, 0 meaning
+// unlimited.
+func (c *Client) SetGlobalLimit(kbps int64) (models.AppState, error) {
+	var state models.AppState
+	err := c.call(methodSetGlobalLimit, limitParams{KBps: kbps}, &state)
+	return state, err
+}
+
+// SetChecksumDiscovery turns the lookup of published checksum files of new
+// downloads on or off.
+func (c *Client) SetChecksumDiscovery(on bool) (models.AppState, error) {
+	var state models.AppState
+	err := c.call(methodSetChecksumDiscovery, switchParams{On: on}, &state)
+	return state, err
+}
+
+// Shutdown stops the daemon. Running downloads continue from where they
+// stopped when it starts again.
+func (c *Client) Shutdown() error {
+	return c.call(methodShutdown, nil, nil)
+}
@@ -0,0 +1,116 @@
+// Package daemon runs the download engine in the background, so downloads
+// outlive the terminal that started them. The daemon owns the scheduler, the
+// SQLite store and state.json, and serves the TUI and the CLI subcommands
+// over a Unix socket.
+//
+// Both ends exchange JSON values, one per line. A client sends requests with
+// an id, the daemon answers each with a message carrying the same id, and
+// once a client subscribed it also receives events with no id.
+package daemon
+
+import (
+	"encoding/json"
+
+	"github.com/Amirali-Amirifar/gofetch.git/internal/controller"
+	"github.com/Amirali-Amirifar/gofetch.git/internal/models"
+)
+
+// Methods a client can call.
+const (
+	methodState                = "state"
+	methodList                 = "list"
+	methodGet                  = "get"
+	methodAdd                  = "add"
+	methodPause                = "pause"
+	methodResume               = "resume"
+	methodCancel               = "cancel"
+	methodRetry                = "retry"
+	methodMove                 = "move"
+	methodRemove               = "remove"
+	methodSaveQueue            = "save_queue"
+	methodDeleteQueue          = "delete_queue"
+	methodMoveQueue            = "move_queue"
+	methodSetGlobalLimit       = "set_global_limit"
+	methodSetChecksumDiscovery = "set_checksum_discovery"
+	methodSubscribe            = "subscribe"
+	methodShutdown             = "shutdown"
+)
+
+// Download is a download as clients see it.
+type Download struct {
+	models.Download
+	Running     bool  `json:"running"`     // A queue slot is executing it, e.g. still checking its signature after completing
+	Speed       int64 `json:"speed"`       // Bytes per second while downloading
+	Connections int   `json:"connections"` // Connections it is fetching over right now
+
+	ConnectionStatuses []controller.ConnectionStatus `json:"connection_statuses,omitempty"` // The connections of a parallel download
+}
+
+// EventType tells what an event carries.
+type EventType string
+
+const (
+	EventDownload EventType = "download" // A download changed its status or progress
+	EventState    EventType = "state"    // Queues or settings changed
+	EventRemoved  EventType = "removed"  // A download was removed, carried in its last state
+)
+
+// Event is pushed to subscribed clients.
+type Event struct {
+	Type     EventType        `json:"type"`
+	Download *Download        `json:"download,omitempty"`
+	State    *models.AppState `json:"state,omitempty"`
+}
+
+type request struct {
+	ID     int64           `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// message is an answer to a request, or an event when ID is 0. An answer
+// may carry both a result and an error, e.g. the downloads added before one
+// of the files of a metalink failed.
+type message struct {
+	ID     int64           `json:"id,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+	Event  *Event          `json:"event,omitempty"`
+}
+
+type idParams struct {
+	ID int64 `json:"id"`
+}
+
+type moveParams struct {
+	ID    int64  `json:"id"`
+	Queue string `json:"queue"`
+}
+
+type removeParams struct {
+	ID         int64 `json:"id"`
+	DeleteFile bool  `json:"delete_file"` // Delete the downloaded file too
+}
+
+type saveQueueParams struct {
+	Name  string       `json:"name"` // Queue being edited, empty to create one
+	Queue models.Queue `json:"queue"`
+}
+
+type deleteQueueParams struct {
+	Name   string `json:"name"`
+	Cancel bool   `json:"cancel"` // Cancel unfinished downloads instead of moving them to the Default queue
+}
+
+type moveQueueParams struct {
+	Name     string `json:"name"`
+	Position int    `json:"position"` // Index in the list of queues the queue moves to
+}
+
+type limitParams struct {
+	KBps int64 `json:"kbps"`
+}
+
+type switchParams struct {
+	On bool `json:"on"`
+}
@@ -0,0 +1,202 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/Amirali-Amirifar/gofetch.git/internal/config"
+	"github.com/Amirali-Amirifar/gofetch.git/internal/models"
+	"github.com/Amirali-Amirifar/gofetch.git/internal/queues"
+	"github.com/Amirali-Amirifar/gofetch.git/internal/repository/json"
+)
+
+func (s *Server) snapshotState() models.AppState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copyState(*s.state)
+}
+
+func copyState(state models.AppState) models.AppState {
+	state.Queues = append([]models.Queue(nil), state.Queues...)
+	return state
+}
+
+// updateState applies change to a copy of the state and saves it. The new
+// state is only kept, and published, once it was written to state.json.
+func (s *Server) updateState(change func(state *models.AppState) error) (models.AppState, error) {
+	s.mu.Lock()
+	state := copyState(*s.state)
+	if err := change(&state); err != nil {
+		s.mu.Unlock()
+		return models.AppState{}, err
+	}
+	if err := json.SaveAppState(state); err != nil {
+		s.mu.Unlock()
+		return models.AppState{}, err
+	}
+	*s.state = state
+	s.mu.Unlock()
+
+	published := copyState(state)
+	s.publish(Event{Type: EventState, State: &published})
+	return state, nil
+}
+
+// setGlobalLimit caps the combined speed of all queues in KB/s, 0 meaning
+// unlimited.
+func (s *Server) setGlobalLimit(kbps int64) (models.AppState, error) {
+	if kbps < 0 {
+		return models.AppState{}, errors.New("speed limit cannot be negative")
+	}
+	state, err := s.updateState(func(state *models.AppState) error {
+		state.GlobalBandwidthLimit = kbps
+		return nil
+	})
+	if err == nil {
+		s.scheduler.SetGlobalLimit(kbps)
+	}
+	return state, err
+}
+
+// setChecksumDiscovery turns the lookup of published checksum files of new
+// downloads on or off.
+func (s *Server) setChecksumDiscovery(on bool) (models.AppState, error) {
+	state, err := s.updateState(func(state *models.AppState) error {
+		state.DiscoverChecksums = on
+		return nil
+	})
+	if err == nil {
+		s.scheduler.SetChecksumDiscovery(on)
+	}
+	return state, err
+}
+
+// saveQueue creates a queue, or replaces the settings of the queue called
+// name. Renaming a queue takes its downloads along.
+func (s *Server) saveQueue(name string, queue models.Queue) (models.AppState, error) {
+	if err := queues.Validate(queue); err != nil {
+		return models.AppState{}, err
+	}
+
+	state, err := s.updateState(func(state *models.AppState) error {
+		i := findQueue(state, name)
+		switch {
+		case name != "" && i < 0:
+			return fmt.Errorf("no queue named %s", name)
+		case name == config.DefaultQueueName && queue.Name != name:
+			return fmt.Errorf("the %s queue cannot be renamed", name)
+		case queue.Name != name && findQueue(state, queue.Name) >= 0:
+			return fmt.Errorf("queue %s already exists", queue.Name)
+		case i < 0:
+			queue.Id = nextQueueID(state)
+			state.Queues = append(state.Queues, queue)
+		default:
+			queue.Id = state.Queues[i].Id
+			state.Queues[i] = queue
+		}
+		return nil
+	})
+	if err != nil {
+		return models.AppState{}, err
+	}
+
+	if name == "" {
+		name = queue.Name
+	}
+	s.scheduler.UpdateQueue(name, queue)
+	if name != queue.Name {
+		if err := s.moveDownloads(name, queue.Name, false); err != nil {
+			return state, err
+		}
+	}
+	return state, nil
+}
+
+// deleteQueue removes a queue. Its downloads move to the Default queue, and
+// the unfinished ones are canceled first when cancel is set.
+func (s *Server) deleteQueue(name string, cancel bool) (models.AppState, error) {
+	if name == config.DefaultQueueName {
+		return models.AppState{}, fmt.Errorf("the %s queue cannot be deleted", name)
+	}
+	current := s.snapshotState()
+	if findQueue(&current, name) < 0 {
+		return models.AppState{}, fmt.Errorf("no queue named %s", name)
+	}
+
+	if err := s.moveDownloads(name, config.DefaultQueueName, cancel); err != nil {
+		return models.AppState{}, err
+	}
+	state, err := s.updateState(func(state *models.AppState) error {
+		if i := findQueue(state, name); i >= 0 {
+			state.Queues = append(state.Queues[:i], state.Queues[i+1:]...)
+		}
+		return nil
+	})
+	if err != nil {
+		return models.AppState{}, err
+	}
+	s.scheduler.RemoveQueue(name)
+	return state, nil
+}
+
+// moveQueue moves a queue to position in the list of queues. The order is
+// only how clients list the queues; each queue keeps its own slots.
+func (s *Server) moveQueue(name string, position int) (models.AppState, error) {
+	return s.updateState(func(state *models.AppState) error {
+		i := findQueue(state, name)
+		if i < 0 {
+			return fmt.Errorf("no queue named %s", name)
+		}
+		if position < 0 || position >= len(state.Queues) {
+			return fmt.Errorf("queue %s cannot move outside the list of %d queues", name, len(state.Queues))
+		}
+		queue := state.Queues[i]
+		state.Queues = slices.Insert(slices.Delete(state.Queues, i, i+1), position, queue)
+		return nil
+	})
+}
+
+// moveDownloads hands the downloads of queue from to queue to, canceling
+// the unfinished ones first when cancel is set.
+func (s *Server) moveDownloads(from, to string, cancel bool) error {
+	rows, err := config.GetDB().GetDownloads()
+	if err != nil {
+		return fmt.Errorf("failed to load downloads: %w", err)
+	}
+	var errs []error
+	for _, row := range rows {
+		if row.QueueName != from {
+			continue
+		}
+		d, err := s.scheduler.Lookup(row.Id)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if cancel {
+			d.CancelDownload()
+		}
+		if err := s.scheduler.Move(d, to); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func findQueue(state *models.AppState, name string) int {
+	for i, q := range state.Queues {
+		if q.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func nextQueueID(state *models.AppState) int64 {
+	var id int64
+	for _, q := range state.Queues {
+		id = max(id, q.Id)
+	}
+	return id + 1
+}
@@ -0,0 +1,531 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Amirali-Amirifar/gofetch.git/internal/config"
+	"github.com/Amirali-Amirifar/gofetch.git/internal/controller"
+	"github.com/Amirali-Amirifar/gofetch.git/internal/models"
+	"github.com/Amirali-Amirifar/gofetch.git/internal/queues"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// eventInterval is how often running downloads are checked for changes
+	// to push to subscribers.
+	eventInterval = 500 * time.Millisecond
+	// eventBuffer is how many events a subscriber may fall behind before
+	// the daemon gives up on it.
+	eventBuffer = 1024
+)
+
+// Server serves the engine to clients connecting to its socket.
+type Server struct {
+	scheduler *controller.Scheduler
+
+	mu        sync.Mutex // Guards state, subscribers and meters
+	state     *models.AppState
+	subs      map[*conn]bool
+	listeners map[chan Event]bool // Subscribers within the daemon
+	meters    map[int64]*meter    // Speed of each downloading download
+
+	// watchMu is held by watch while it publishes, and by a removal while it
+	// drops the download, so no event of a download follows the one
+	// announcing its removal.
+	watchMu sync.Mutex
+
+	done     chan struct{}
+	shutdown sync.Once
+}
+
+// conn is a connected client.
+type conn struct {
+	net.Conn
+	mu     sync.Mutex // Serializes writes of answers and events
+	enc    *json.Encoder
+	events chan Event
+	closed chan struct{}
+}
+
+// meter measures the speed of a download from its progress.
+type meter struct {
+	bytes int64
+	at    time.Time
+	speed float64 // Bytes per second, smoothed
+}
+
+// NewServer returns a server for scheduler, whose queues and settings are
+// kept in state and saved to state.json on every change. Clients are shown
+// the Default queue the scheduler runs even when state.json lacks it.
+func NewServer(state *models.AppState, scheduler *controller.Scheduler) *Server {
+	if findQueue(state, config.DefaultQueueName) < 0 {
+		state.Queues = append([]models.Queue{queues.Default()}, state.Queues...)
+	}
+	return &Server{
+		scheduler: scheduler,
+		state:     state,
+		subs:      make(map[*conn]bool),
+		listeners: make(map[chan Event]bool),
+		meters:    make(map[int64]*meter),
+		done:      make(chan struct{}),
+	}
+}
+
+// Serve answers clients connecting to l until Shutdown is called.
+func (s *Server) Serve(l net.Listener) error {
+	go func() {
+		<-s.done
+		l.Close()
+	}()
+	go s.watch()
+
+	log.Infof("Daemon listening on %s", l.Addr())
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				return nil
+			default:
+			}
+			return err
+		}
+		go s.serveConn(nc)
+	}
+}
+
+// Shutdown stops accepting clients and makes Serve return.
+func (s *Server) Shutdown() {
+	s.shutdown.Do(func() { close(s.done) })
+}
+
+// Listen claims the Unix socket at path for a daemon, which fails when
+// another daemon is running. Only the user running the daemon may connect.
+func Listen(path string) (net.Listener, error) {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		// A daemon that crashed leaves its socket behind; nobody answers on it.
+		if c, dialErr := net.Dial("unix", path); dialErr == nil {
+			c.Close()
+			return nil, fmt.Errorf("a daemon is already listening on %s", path)
+		}
+		if removeErr := os.Remove(path); removeErr != nil && !os.IsNotExist(removeErr) {
+			return nil, err
+		}
+		if l, err = net.Listen("unix", path); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (s *Server) serveConn(nc net.Conn) {
+	c := &conn{Conn: nc, enc: json.NewEncoder(nc), events: make(chan Event, eventBuffer), closed: make(chan struct{})}
+	defer func() {
+		s.mu.Lock()
+		delete(s.subs, c)
+		s.mu.Unlock()
+		close(c.closed)
+		nc.Close()
+	}()
+
+	dec := json.NewDecoder(nc)
+	for {
+		var req request
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		// Requests are answered concurrently, so a slow initial request of a
+		// new download does not hold up pausing another.
+		go s.answer(c, req)
+	}
+}
+
+func (c *conn) send(m message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.enc.Encode(m)
+}
+
+func (s *Server) answer(c *conn, req request) {
+	var result any
+	var err error
+	if req.Method == methodSubscribe {
+		s.subscribe(c)
+	} else {
+		result, err = s.call(req.Method, req.Params)
+	}
+
+	m := message{ID: req.ID}
+	if result != nil {
+		data, marshalErr := json.Marshal(result)
+		if marshalErr != nil {
+			err = errors.Join(err, marshalErr)
+		}
+		m.Result = data
+	}
+	if err != nil {
+		m.Error = err.Error()
+	}
+	if err := c.send(m); err != nil {
+		log.Debugf("Failed to answer %s: %v", req.Method, err)
+	}
+}
+
+func (s *Server) call(method string, params json.RawMessage) (any, error) {
+	switch method {
+	case methodState:
+		return s.snapshotState(), nil
+	case methodList:
+		return s.list()
+	case methodGet:
+		var p idParams
+		if err := decode(params, &p); err != nil {
+			return nil, err
+		}
+		d, err := s.scheduler.Lookup(p.ID)
+		if err != nil {
+			return nil, err
+		}
+		return s.view(d), nil
+	case methodAdd:
+		var download models.Download
+		if err := decode(params, &download); err != nil {
+			return nil, err
+		}
+		downloads, err := s.scheduler.Add(download)
+		views := make([]Download, len(downloads))
+		for i, d := range downloads {
+			views[i] = s.view(d)
+		}
+		return views, err
+	case methodPause:
+		return s.control(params, pause)
+	case methodResume:
+		return s.control(params, s.resume)
+	case methodCancel:
+		return s.control(params, cancel)
+	case methodRetry:
+		return s.control(params, s.scheduler.Retry)
+	case methodMove:
+		var p moveParams
+		if err := decode(params, &p); err != nil {
+			return nil, err
+		}
+		d, err := s.scheduler.Lookup(p.ID)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.scheduler.Move(d, p.Queue); err != nil {
+			return nil, err
+		}
+		return s.view(d), nil
+	case methodRemove:
+		var p removeParams
+		if err := decode(params, &p); err != nil {
+			return nil, err
+		}
+		return s.remove(p.ID, p.DeleteFile)
+	case methodSaveQueue:
+		var p saveQueueParams
+		if err := decode(params, &p); err != nil {
+			return nil, err
+		}
+		return s.saveQueue(p.Name, p.Queue)
+	case methodDeleteQueue:
+		var p deleteQueueParams
+		if err := decode(params, &p); err != nil {
+			return nil, err
+		}
+		return s.deleteQueue(p.Name, p.Cancel)
+	case methodMoveQueue:
+		var p moveQueueParams
+		if err := decode(params, &p); err != nil {
+			return nil, err
+		}
+		return s.moveQueue(p.Name, p.Position)
+	case methodSetGlobalLimit:
+		var p limitParams
+		if err := decode(params, &p); err != nil {
+			return nil, err
+		}
+		return s.setGlobalLimit(p.KBps)
+	case methodSetChecksumDiscovery:
+		var p switchParams
+		if err := decode(params, &p); err != nil {
+			return nil, err
+		}
+		return s.setChecksumDiscovery(p.On)
+	case methodShutdown:
+		log.Info("Daemon shutting down on request")
+		s.Shutdown()
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown method %q", method)
+}
+
+func decode(params json.RawMessage, v any) error {
+	if err := json.Unmarshal(params, v); err != nil {
+		return fmt.Errorf("invalid parameters: %w", err)
+	}
+	return nil
+}
+
+// list returns every download in the store, with the live progress of those
+// the engine is working on.
+func (s *Server) list() ([]Download, error) {
+	rows, err := config.GetDB().GetDownloads()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load downloads: %w", err)
+	}
+	downloads := make([]Download, len(rows))
+	for i, row := range rows {
+		if d, ok := s.scheduler.Get(row.Id); ok {
+			downloads[i] = s.view(d)
+		} else {
+			downloads[i] = Download{Download: row}
+		}
+	}
+	return downloads, nil
+}
+
+func (s *Server) view(d *controller.Download) Download {
+	v := Download{
+		Download:           d.Snapshot(),
+		Running:            d.Running(),
+		Connections:        d.Connections(),
+		ConnectionStatuses: d.ConnectionStatuses(),
+	}
+	s.mu.Lock()
+	if m, ok := s.meters[d.Id]; ok {
+		v.Speed = int64(m.speed)
+	}
+	s.mu.Unlock()
+	return v
+}
+
+// measure updates the speed of d from the progress it made since the last
+// call, which watch makes every eventInterval.
+func (s *Server) measure(d *controller.Download, now time.Time) {
+	snapshot := d.Snapshot()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if snapshot.Status != models.DownloadStatusDownloading {
+		delete(s.meters, d.Id)
+		return
+	}
+	m, ok := s.meters[d.Id]
+	if !ok {
+		s.meters[d.Id] = &meter{bytes: snapshot.CurrentProgress, at: now}
+		return
+	}
+	if seconds := now.Sub(m.at).Seconds(); seconds > 0 {
+		current := float64(max(snapshot.CurrentProgress-m.bytes, 0)) / seconds
+		if m.speed == 0 {
+			m.speed = current
+		} else {
+			m.speed = 0.7*m.speed + 0.3*current
+		}
+	}
+	m.bytes, m.at = snapshot.CurrentProgress, now
+}
+
+// control applies action to the download named in params.
+func (s *Server) control(params json.RawMessage, action func(d *controller.Download) error) (any, error) {
+	var p idParams
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+	d, err := s.scheduler.Lookup(p.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := action(d); err != nil {
+		return nil, err
+	}
+	return s.view(d), nil
+}
+
+func pause(d *controller.Download) error {
+	switch status := d.Snapshot().Status; status {
+	case models.DownloadStatusQueued, models.DownloadStatusDownloading:
+	default:
+		return fmt.Errorf("download %d is %s, only queued and running downloads can be paused", d.Id, status)
+	}
+	d.PauseDownload()
+	return nil
+}
+
+func cancel(d *controller.Download) error {
+	switch status := d.Snapshot().Status; status {
+	case models.DownloadStatusCanceled, models.DownloadStatusCompleted:
+		return fmt.Errorf("download %d is already %s", d.Id, status)
+	}
+	d.CancelDownload()
+	return nil
+}
+
+func (s *Server) resume(d *controller.Download) error {
+	switch status := d.Snapshot().Status; status {
+	case models.DownloadStatusPaused, models.DownloadStatusChanged, models.DownloadStatusVerifyFailed:
+	default:
+		return fmt.Errorf("download %d is %s, only paused downloads and those waiting for confirmation can be resumed", d.Id, status)
+	}
+	s.scheduler.Resume(d)
+	return nil
+}
+
+// remove forgets a download, and with deleteFile deletes its file, then
+// tells subscribers.
+func (s *Server) remove(id int64, deleteFile bool) (Download, error) {
+	d, err := s.scheduler.Lookup(id)
+	if err != nil {
+		return Download{}, err
+	}
+	// Stopping waits for the run to unwind, which must not hold up watch.
+	if err := s.scheduler.Remove(d); err != nil {
+		return Download{}, err
+	}
+	s.watchMu.Lock()
+	s.scheduler.Forget(d)
+	s.mu.Lock()
+	delete(s.meters, id)
+	s.mu.Unlock()
+	removed := s.view(d)
+	s.publish(Event{Type: EventRemoved, Download: &removed})
+	s.watchMu.Unlock()
+
+	if deleteFile {
+		if err := d.DeleteFiles(); err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+func (s *Server) subscribe(c *conn) {
+	s.mu.Lock()
+	if s.subs[c] {
+		s.mu.Unlock()
+		return
+	}
+	s.subs[c] = true
+	s.mu.Unlock()
+
+	go func() {
+		for {
+			select {
+			case e := <-c.events:
+				if err := c.send(message{Event: &e}); err != nil {
+					return
+				}
+			case <-c.closed:
+				return
+			}
+		}
+	}()
+}
+
+// publish pushes e to every subscriber. A subscriber too far behind is
+// disconnected rather than left with a gap in its events.
+func (s *Server) publish(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.subs {
+		select {
+		case c.events <- e:
+		default:
+			log.Warnf("Disconnecting a client that stopped reading events")
+			delete(s.subs, c)
+			c.Close()
+		}
+	}
+	for events := range s.listeners {
+		select {
+		case events <- e:
+		default:
+			log.Warnf("Unsubscribing a listener that stopped reading events")
+			delete(s.listeners, events)
+			close(events)
+		}
+	}
+}
+
+// listen subscribes a part of the daemon itself to the events. The channel
+// is closed by stop, or once the listener falls too far behind.
+func (s *Server) listen() (<-chan Event, func()) {
+	events := make(chan Event, eventBuffer)
+	s.mu.Lock()
+	s.listeners[events] = true
+	s.mu.Unlock()
+	stop := func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.listeners[events] {
+			delete(s.listeners, events)
+			close(events)
+		}
+	}
+	return events, stop
+}
+
+// watch publishes the downloads of the engine whenever their status or
+// progress changed.
+func (s *Server) watch() {
+	ticker := time.NewTicker(eventInterval)
+	defer ticker.Stop()
+
+	last := make(map[int64]Download)
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+		s.watchMu.Lock()
+		now := time.Now()
+		downloads := s.scheduler.Downloads()
+		for _, d := range downloads {
+			s.measure(d, now)
+			current := s.view(d)
+			if previous, ok := last[current.Id]; ok && !changed(previous, current) {
+				continue
+			}
+			last[current.Id] = current
+			s.publish(Event{Type: EventDownload, Download: &current})
+		}
+		s.watchMu.Unlock()
+
+		// Forget removed downloads; their id may be given out again.
+		if len(last) > len(downloads) {
+			known := make(map[int64]bool, len(downloads))
+			for _, d := range downloads {
+				known[d.Id] = true
+			}
+			for id := range last {
+				if !known[id] {
+					delete(last, id)
+				}
+			}
+		}
+	}
+}
+
+func changed(a, b Download) bool {
+	return a.Status != b.Status || a.CurrentProgress != b.CurrentProgress || a.Progress != b.Progress ||
+		a.Running != b.Running || a.LastError != b.LastError || a.FileName != b.FileName ||
+		a.QueueName != b.QueueName || a.ContentLength != b.ContentLength || a.SignatureStatus != b.SignatureStatus ||
+		a.Speed != b.Speed || a.Connections != b.Connections || !slices.Equal(a.ConnectionStatuses, b.ConnectionStatuses) ||
+		!slices.EqualFunc(a.Ranges, b.Ranges, func(x, y models.Range) bool { return x.Failures == y.Failures })
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package daemon
+
+import "errors"
+
+func startDaemon() error {
+	return errors.New("run gofetch daemon first")
+}
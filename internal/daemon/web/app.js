@@ -0,0 +1,492 @@
+"use strict";
+
+// The web UI is a client of the REST API of the daemon serving it. The
+// secret is kept in the local storage of the browser once entered; a link
+// ending in #token=<secret> signs in as well.
+
+const api = "/api/v1";
+const storageKey = "gofetch-secret";
+
+let secret = localStorage.getItem(storageKey) || "";
+let events = null;
+let queues = [];
+const downloads = new Map(); // By id
+let editing = null; // Name of the queue in the form, "" for a new one
+let deleting = null; // Name of the queue whose deletion awaits a choice
+let renderPending = false;
+
+const $ = (id) => document.getElementById(id);
+
+// request calls the API and returns the decoded answer. A failure throws an
+// Error carrying the message of the daemon, and the answer as data.
+async function request(method, path, body) {
+  const options = { method, headers: { Authorization: "Bearer " + secret } };
+  if (body !== undefined) {
+    options.headers["Content-Type"] = "application/json";
+    options.body = JSON.stringify(body);
+  }
+  const response = await fetch(api + path, options);
+  if (response.status === 401) {
+    signOut();
+    throw new Error("The secret was not accepted");
+  }
+  if (response.status === 204) {
+    return null;
+  }
+  const data = await response.json();
+  if (!response.ok) {
+    const error = new Error(data.error);
+    error.data = data;
+    throw error;
+  }
+  return data;
+}
+
+function showMessage(text, failed) {
+  const message = $("message");
+  message.textContent = text;
+  message.className = failed ? "message error" : "message";
+  message.hidden = !text;
+}
+
+// run calls action and shows what went wrong, if anything.
+async function run(action) {
+  try {
+    await action();
+  } catch (error) {
+    showMessage(error.message, true);
+  }
+}
+
+// Pages
+
+function showPage(name) {
+  for (const page of document.querySelectorAll(".page")) {
+    page.hidden = page.id !== name;
+  }
+  for (const button of document.querySelectorAll("nav button")) {
+    button.classList.toggle("active", button.dataset.page === name);
+  }
+  showMessage("");
+}
+
+function signOut() {
+  secret = "";
+  localStorage.removeItem(storageKey);
+  if (events) {
+    events.close();
+    events = null;
+  }
+  $("login").hidden = false;
+  document.querySelector("nav").hidden = true;
+  for (const page of document.querySelectorAll(".page")) {
+    page.hidden = true;
+  }
+  $("connection").textContent = "";
+}
+
+async function signIn(value) {
+  secret = value;
+  localStorage.setItem(storageKey, secret);
+  $("login").hidden = true;
+  document.querySelector("nav").hidden = false;
+  showPage("downloads");
+  await reload();
+  listen();
+}
+
+// reload fetches everything, after signing in and whenever the event stream
+// reconnected and may have missed changes.
+async function reload() {
+  const [list, queueList, settings] = await Promise.all([
+    request("GET", "/downloads"),
+    request("GET", "/queues"),
+    request("GET", "/settings"),
+  ]);
+  downloads.clear();
+  for (const d of list) {
+    downloads.set(d.id, d);
+  }
+  queues = queueList;
+  renderDownloads();
+  renderQueues();
+  fillSettings(settings);
+}
+
+function listen() {
+  events = new EventSource(api + "/events?token=" + encodeURIComponent(secret));
+  let opened = false;
+  events.addEventListener("open", () => {
+    $("connection").textContent = "live";
+    $("connection").className = "connection live";
+    if (opened) {
+      run(reload);
+    }
+    opened = true;
+  });
+  events.addEventListener("error", () => {
+    $("connection").textContent = "reconnecting";
+    $("connection").className = "connection";
+  });
+  events.addEventListener("download", (e) => {
+    const d = JSON.parse(e.data);
+    downloads.set(d.id, d);
+    scheduleRender();
+  });
+  events.addEventListener("removed", (e) => {
+    downloads.delete(JSON.parse(e.data).id);
+    scheduleRender();
+  });
+  events.addEventListener("state", (e) => {
+    const state = JSON.parse(e.data);
+    queues = state.queues;
+    renderQueues();
+    fillSettings(state);
+  });
+}
+
+// Downloads
+
+function scheduleRender() {
+  if (!renderPending) {
+    renderPending = true;
+    requestAnimationFrame(() => {
+      renderPending = false;
+      renderDownloads();
+    });
+  }
+}
+
+function formatBytes(n) {
+  const units = ["KiB", "MiB", "GiB", "TiB", "PiB", "EiB"];
+  if (n < 1024) {
+    return n + " B";
+  }
+  let value = n / 1024;
+  let unit = 0;
+  while (value >= 1024 && unit < units.length - 1) {
+    value /= 1024;
+    unit++;
+  }
+  return value.toFixed(1) + " " + units[unit];
+}
+
+function formatDuration(seconds) {
+  seconds = Math.round(seconds);
+  const h = Math.floor(seconds / 3600);
+  const m = Math.floor((seconds % 3600) / 60);
+  const s = seconds % 60;
+  return h > 0 ? `${h}h${m}m${s}s` : m > 0 ? `${m}m${s}s` : `${s}s`;
+}
+
+// completed returns the bytes of a download on disk. Only the engine tracks
+// the progress of running downloads; the others carry segment offsets.
+function completed(d) {
+  if (d.status === "COMPLETED" && d.content_length > 0) {
+    return d.content_length;
+  }
+  if (d.current_progress > 0) {
+    return d.current_progress;
+  }
+  return (d.ranges || []).reduce((sum, r) => sum + (r.offset - r.start), 0);
+}
+
+function fileName(d) {
+  return d.file_name ? d.file_name.split("/").pop() : d.url;
+}
+
+function element(tag, text, className) {
+  const e = document.createElement(tag);
+  if (text !== undefined) {
+    e.textContent = text;
+  }
+  if (className) {
+    e.className = className;
+  }
+  return e;
+}
+
+function actionButton(label, action) {
+  const button = element("button", label);
+  button.type = "button";
+  button.addEventListener("click", () => run(action));
+  return button;
+}
+
+function control(d, action) {
+  return async () => {
+    const updated = await request("POST", `/downloads/${d.id}/${action}`);
+    downloads.set(updated.id, updated);
+    renderDownloads();
+  };
+}
+
+// downloadActions offers what the status of a download allows, like the
+// CLI does.
+function downloadActions(d) {
+  switch (d.status) {
+    case "QUEUED":
+    case "DOWNLOADING":
+      return [actionButton("Pause", control(d, "pause")), actionButton("Cancel", control(d, "cancel"))];
+    case "PAUSED":
+      return [actionButton("Resume", control(d, "resume")), actionButton("Cancel", control(d, "cancel"))];
+    case "CHANGED":
+      return [actionButton("Start over", control(d, "resume")), actionButton("Cancel", control(d, "cancel"))];
+    case "VERIFY_FAILED":
+      return [actionButton("Re-fetch", control(d, "resume")), actionButton("Cancel", control(d, "cancel"))];
+    case "FAILED":
+    case "CANCELED":
+      return [actionButton("Retry", control(d, "retry"))];
+  }
+  return [];
+}
+
+function renderDownloads() {
+  const rows = $("download-rows");
+  rows.replaceChildren();
+  const sorted = [...downloads.values()].sort((a, b) => a.id - b.id);
+  for (const d of sorted) {
+    const done = completed(d);
+    const row = element("tr");
+    row.append(element("td", d.id));
+
+    const name = element("td", fileName(d), "file");
+    name.title = d.last_error ? `${d.url}\n${d.last_error}` : d.url;
+    row.append(name);
+    row.append(element("td", d.queue_name));
+
+    const status = element("td", d.status, "status " + d.status.toLowerCase());
+    if (d.last_error) {
+      status.title = d.last_error;
+    }
+    row.append(status);
+
+    const progress = element("td");
+    const bar = element("progress");
+    if (d.content_length > 0) {
+      bar.max = d.content_length;
+      bar.value = done;
+      progress.append(bar, element("span", Math.floor((done * 100) / d.content_length) + "%"));
+    } else {
+      progress.append(element("span", formatBytes(done)));
+    }
+    row.append(progress);
+
+    row.append(element("td", d.content_length > 0 ? formatBytes(d.content_length) : "unknown"));
+    const downloading = d.status === "DOWNLOADING";
+    row.append(element("td", downloading ? formatBytes(d.speed) + "/s" : ""));
+    let eta = "";
+    if (downloading && d.speed > 0 && d.content_length > 0) {
+      eta = formatDuration((d.content_length - done) / d.speed);
+    }
+    row.append(element("td", eta));
+
+    const actions = element("td", undefined, "actions");
+    actions.append(...downloadActions(d));
+    row.append(actions);
+    rows.append(row);
+  }
+  $("no-downloads").hidden = downloads.size > 0;
+}
+
+async function addDownload(form) {
+  const data = new FormData(form);
+  const url = data.get("url").trim();
+  const body = {
+    url,
+    queue_name: data.get("queue_name"),
+    file_name: data.get("file_name").trim(),
+    checksum: data.get("checksum").trim(),
+    signature: data.get("signature").trim(),
+    mirrors: data.get("mirrors").split(/[\s,]+/).filter((m) => m !== ""),
+  };
+  try {
+    const added = await request("POST", "/downloads", body);
+    for (const d of added) {
+      downloads.set(d.id, d);
+    }
+    form.reset();
+    fillQueueChoices();
+    showPage("downloads");
+    renderDownloads();
+    showMessage(added.length === 1 ? `Added ${fileName(added[0])}` : `Added ${added.length} downloads`);
+  } catch (error) {
+    // A download whose URL failed is still listed, with the reason.
+    for (const d of (error.data && error.data.downloads) || []) {
+      downloads.set(d.id, d);
+    }
+    renderDownloads();
+    throw error;
+  }
+}
+
+// Queues
+
+function formatSpeedLimit(kbps) {
+  return kbps > 0 ? kbps + " KB/s" : "unlimited";
+}
+
+function fillQueueChoices() {
+  const select = document.querySelector("#add-form select[name=queue_name]");
+  const current = select.value;
+  select.replaceChildren();
+  for (const q of queues) {
+    const option = element("option", q.name);
+    option.value = q.name;
+    select.append(option);
+  }
+  if (queues.some((q) => q.name === current)) {
+    select.value = current;
+  }
+}
+
+function renderQueues() {
+  fillQueueChoices();
+  const rows = $("queue-rows");
+  rows.replaceChildren();
+  for (const q of queues) {
+    const row = element("tr");
+    row.append(
+      element("td", q.name),
+      element("td", q.storage_folder),
+      element("td", q.max_simultaneous),
+      element("td", formatSpeedLimit(q.max_download_speed)),
+      element("td", formatSpeedLimit(q.bandwidth_limit)),
+      element("td", q.active_time_start),
+      element("td", q.active_time_end),
+      element("td", q.max_retry_attempts),
+    );
+
+    const actions = element("td", undefined, "actions");
+    if (deleting === q.name) {
+      actions.append(
+        element("span", "Its downloads:"),
+        actionButton("Move to Default", () => deleteQueue(q.name, false)),
+        actionButton("Cancel them", () => deleteQueue(q.name, true)),
+        actionButton("Keep queue", () => {
+          deleting = null;
+          renderQueues();
+        }),
+      );
+    } else {
+      actions.append(actionButton("Edit", () => editQueue(q)));
+      if (q.name !== "Default") {
+        actions.append(
+          actionButton("Delete", () => {
+            deleting = q.name;
+            renderQueues();
+          }),
+        );
+      }
+    }
+    row.append(actions);
+    rows.append(row);
+  }
+}
+
+function editQueue(q) {
+  const form = $("queue-form");
+  editing = q ? q.name : "";
+  $("queue-form-title").textContent = q ? `Edit ${q.name}` : "New Queue";
+  form.reset();
+  if (q) {
+    for (const [field, value] of Object.entries(q)) {
+      if (form.elements[field]) {
+        form.elements[field].value = value;
+      }
+    }
+  }
+  // The Default queue keeps its name.
+  form.elements.name.readOnly = editing === "Default";
+  form.hidden = false;
+  form.elements.name.focus();
+}
+
+async function saveQueue(form) {
+  const number = (name) => parseInt(form.elements[name].value, 10) || 0;
+  const queue = {
+    name: form.elements.name.value.trim(),
+    storage_folder: form.elements.storage_folder.value.trim(),
+    max_simultaneous: number("max_simultaneous"),
+    max_download_speed: number("max_download_speed"),
+    bandwidth_limit: number("bandwidth_limit"),
+    active_time_start: form.elements.active_time_start.value.trim(),
+    active_time_end: form.elements.active_time_end.value.trim(),
+    max_retry_attempts: number("max_retry_attempts"),
+  };
+  if (editing) {
+    await request("PUT", "/queues/" + encodeURIComponent(editing), queue);
+  } else {
+    await request("POST", "/queues", queue);
+  }
+  form.hidden = true;
+  editing = null;
+  queues = await request("GET", "/queues");
+  renderQueues();
+  showMessage(`Saved queue ${queue.name}`);
+}
+
+async function deleteQueue(name, cancel) {
+  deleting = null;
+  await request("DELETE", `/queues/${encodeURIComponent(name)}?cancel=${cancel}`);
+  queues = await request("GET", "/queues");
+  renderQueues();
+  showMessage(`Deleted queue ${name}`);
+}
+
+function fillSettings(settings) {
+  const form = $("settings-form");
+  // Leave alone what is being edited.
+  if (form.contains(document.activeElement)) {
+    return;
+  }
+  form.elements.global_bandwidth_limit.value = settings.global_bandwidth_limit;
+  form.elements.discover_checksums.checked = settings.discover_checksums;
+}
+
+async function saveSettings(form) {
+  const settings = await request("PATCH", "/settings", {
+    global_bandwidth_limit: parseInt(form.elements.global_bandwidth_limit.value, 10) || 0,
+    discover_checksums: form.elements.discover_checksums.checked,
+  });
+  document.activeElement.blur();
+  fillSettings(settings);
+  showMessage("Saved settings");
+}
+
+// Wiring
+
+for (const button of document.querySelectorAll("nav button")) {
+  button.addEventListener("click", () => showPage(button.dataset.page));
+}
+$("login-form").addEventListener("submit", (e) => {
+  e.preventDefault();
+  run(() => signIn(e.target.elements.secret.value));
+});
+$("add-form").addEventListener("submit", (e) => {
+  e.preventDefault();
+  run(() => addDownload(e.target));
+});
+$("new-queue").addEventListener("click", () => editQueue(null));
+$("queue-form").addEventListener("submit", (e) => {
+  e.preventDefault();
+  run(() => saveQueue(e.target));
+});
+$("queue-form-cancel").addEventListener("click", () => {
+  $("queue-form").hidden = true;
+  editing = null;
+});
+$("settings-form").addEventListener("submit", (e) => {
+  e.preventDefault();
+  run(() => saveSettings(e.target));
+});
+
+if (location.hash.startsWith("#token=")) {
+  secret = decodeURIComponent(location.hash.slice("#token=".length));
+  history.replaceState(null, "", location.pathname);
+}
+if (secret) {
+  run(() => signIn(secret));
+} else {
+  signOut();
+}
@@ -8,12 +8,25 @@ import (
 type DownloadStatus string
 
 const (
-	DownloadStatusDownloading DownloadStatus = "DOWNLOADING"
-	DownloadStatusPaused      DownloadStatus = "PAUSED"
-	DownloadStatusCompleted   DownloadStatus = "COMPLETED"
-	DownloadStatusCanceled    DownloadStatus = "CANCELED"
-	DownloadStatusFailed      DownloadStatus = "FAILED"
-	DownloadStatusQueued      DownloadStatus = "QUEUED"
+	DownloadStatusDownloading  DownloadStatus = "DOWNLOADING"
+	DownloadStatusPaused       DownloadStatus = "PAUSED"
+	DownloadStatusCompleted    DownloadStatus = "COMPLETED"
+	DownloadStatusCanceled     DownloadStatus = "CANCELED"
+	DownloadStatusFailed       DownloadStatus = "FAILED"
+	DownloadStatusQueued       DownloadStatus = "QUEUED"
+	DownloadStatusChanged      DownloadStatus = "CHANGED"       // Remote file changed mid-download; resuming starts over
+	DownloadStatusVerifyFailed DownloadStatus = "VERIFY_FAILED" // Finished file does not match its checksum; resuming re-fetches the corrupted pieces, or the whole file without piece checksums
+)
+
+// SignatureStatus is the outcome of checking the detached OpenPGP signature
+// of a completed download. It is empty when no signature was checked.
+type SignatureStatus string
+
+const (
+	SignatureGood       SignatureStatus = "GOOD"        // Made by a key of the keyring over exactly this file
+	SignatureBad        SignatureStatus = "BAD"         // Does not match the file, or the key is expired or revoked
+	SignatureUnknownKey SignatureStatus = "UNKNOWN_KEY" // Made by a key missing from the keyring
+	SignatureError      SignatureStatus = "ERROR"       // Signature or keyring could not be read
 )
 
 type Download struct {
@@ -29,12 +42,58 @@ type Download struct {
 	ContentType   string         `json:"content_type" sqliteDb:"content_type"`
 	AcceptRanges  bool           `json:"accept_ranges" sqliteDb:"accept_ranges"`
 	RangesCount   int            `json:"ranges_count" sqliteDb:"ranges_count"`
-	Ranges        []int          `json:"ranges" sqliteDb:"ranges"`
+	Ranges        []Range        `json:"ranges" sqliteDb:"ranges"`
+	LastError     string         `json:"last_error" sqliteDb:"last_error"`
+	ETag          string         `json:"etag" sqliteDb:"etag"`
+	LastModified  string         `json:"last_modified" sqliteDb:"last_modified"`
+	Checksum      string         `json:"checksum" sqliteDb:"checksum"` // Expected digest as "<algorithm>:<hex>", empty if unknown
+	Pieces        *Pieces        `json:"pieces" sqliteDb:"pieces"`
+	Mirrors       []Mirror       `json:"mirrors" sqliteDb:"mirrors"`     // Other sources of the same file, best first; URL is the first of them
+	Redirects     []string       `json:"redirects" sqliteDb:"redirects"` // Locations the probe was redirected to, the last one serving the file
+	// Detached OpenPGP signature, as a URL or local path. Empty to look for
+	// <url>.sig and <url>.asc when a keyring is configured.
+	Signature       string          `json:"signature" sqliteDb:"signature"`
+	SignatureStatus SignatureStatus `json:"signature_status" sqliteDb:"signature_status"`
+	Signer          string          `json:"signer" sqliteDb:"signer"` // Fingerprint of the signing key
 	// Exported fields for progress tracking.
-	CurrentProgress int64     // Bytes downloaded so far.
-	StartTime       time.Time // When the download started.
-	// Internal fields.
-	CancelChan chan struct{}
+	CurrentProgress int64     `json:"current_progress"` // Bytes downloaded so far.
+	StartTime       time.Time `json:"start_time"`       // When the download started.
+}
+
+// Range is a byte segment of a download. Offset is the next byte to fetch,
+// so the segment is complete once Offset is past End.
+type Range struct {
+	Start     int64      `json:"start"`
+	End       int64      `json:"end"`
+	Offset    int64      `json:"offset"`
+	Failures  int        `json:"failures,omitempty"`   // Failed attempts at fetching the segment
+	LastError string     `json:"last_error,omitempty"` // Error of the last failed attempt
+	FailedAt  *time.Time `json:"failed_at,omitempty"`  // When the last attempt failed, nil before any failure
+}
+
+// Done reports whether every byte of the segment has been written.
+func (r Range) Done() bool {
+	return r.Offset > r.End
+}
+
+// Written returns the number of bytes of the segment already on disk.
+func (r Range) Written() int64 {
+	return r.Offset - r.Start
+}
+
+// Pieces are checksums of consecutive fixed-size blocks of a file. When a
+// download fails verification they tell which blocks to fetch again.
+type Pieces struct {
+	Algorithm string   `json:"algorithm"`
+	Length    int64    `json:"length"`
+	Hashes    []string `json:"hashes"` // Hex digests, in file order
+}
+
+// Mirror is one source of a file offered by a metalink.
+type Mirror struct {
+	URL      string `json:"url"`
+	Priority int    `json:"priority"`           // Lower is preferred
+	Location string `json:"location,omitempty"` // ISO 3166-1 country code
 }
 
 type Queue struct {
@@ -42,8 +101,8 @@ type Queue struct {
 	Name             string `json:"name" sqliteDb:"name"`
 	StorageFolder    string `json:"storage_folder" sqliteDb:"storage_folder"`
 	MaxSimultaneous  int    `json:"max_simultaneous" sqliteDb:"max_simultaneous"`
-	BandwidthLimit   int64  `json:"bandwidth_limit" sqliteDb:"bandwidth_limit"`
-	MaxDownloadSpeed int64  `json:"max_download_speed" sqliteDb:"max_download_speed"`
+	BandwidthLimit   int64  `json:"bandwidth_limit" sqliteDb:"bandwidth_limit"`       // KB/s shared by all downloads of the queue, 0 = unlimited
+	MaxDownloadSpeed int64  `json:"max_download_speed" sqliteDb:"max_download_speed"` // KB/s for each single download, 0 = unlimited
 	ActiveTimeStart  string `json:"active_time_start" sqliteDb:"active_time_start"`
 	ActiveTimeEnd    string `json:"active_time_end" sqliteDb:"active_time_end"`
 	MaxRetryAttempts int    `json:"max_retry_attempts" sqliteDb:"max_retry_attempts"`
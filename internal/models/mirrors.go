@@ -0,0 +1,36 @@
+package models
+
+import "strings"
+
+// ParseMirrors returns the mirrors of a download fetched from url, with
+// extra listing more URLs of the same file separated by spaces or commas.
+// It returns nil when there are no extra URLs.
+func ParseMirrors(url, extra string) []Mirror {
+	fields := strings.FieldsFunc(extra, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+	mirrors := make([]Mirror, len(fields))
+	for i, u := range fields {
+		mirrors[i] = Mirror{URL: u, Priority: 1}
+	}
+	return NormalizeMirrors(url, mirrors)
+}
+
+// NormalizeMirrors puts url first among mirrors and drops duplicates.
+func NormalizeMirrors(url string, mirrors []Mirror) []Mirror {
+	if len(mirrors) == 0 {
+		return nil
+	}
+	seen := map[string]bool{url: true}
+	normalized := []Mirror{{URL: url, Priority: 1}}
+	for _, m := range mirrors {
+		if m.URL == url {
+			normalized[0] = m
+		}
+		if !seen[m.URL] {
+			seen[m.URL] = true
+			normalized = append(normalized, m)
+		}
+	}
+	return normalized
+}
@@ -5,6 +5,12 @@ type SwitchTabMsg struct {
 }
 
 type AppState struct {
-	Queues    []Queue    `json:"queues"`
-	Downloads []Download `json:"downloads"`
+	Queues               []Queue    `json:"queues"`
+	Downloads            []Download `json:"downloads"`
+	GlobalBandwidthLimit int64      `json:"global_bandwidth_limit"` // KB/s shared by all queues, 0 = unlimited
+	DiscoverChecksums    bool       `json:"discover_checksums"`     // Look for SHA256SUMS and similar files next to new downloads
+	Keyring              string     `json:"keyring"`                // OpenPGP public keys that completed downloads are verified against, empty to skip
+	Location             string     `json:"location"`               // Preferred mirror locations as comma separated country codes, e.g. "de,nl"
+	RPCPort              int        `json:"rpc_port"`               // Port of the aria2-compatible JSON-RPC interface, the REST API and the web UI on localhost, 0 to turn them off
+	RPCSecret            string     `json:"rpc_secret"`             // Token clients of both must send, like aria2's --rpc-secret
 }
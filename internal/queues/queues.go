@@ -0,0 +1,101 @@
+// Package queues holds the queue settings shared by the daemon and its
+// clients. It has no state of its own, so clients can use it without
+// touching the database.
+package queues
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Amirali-Amirifar/gofetch.git/internal/config"
+	"github.com/Amirali-Amirifar/gofetch.git/internal/models"
+)
+
+// Default returns the Default queue with the settings of the configuration
+// defaults.
+func Default() models.Queue {
+	return models.Queue{
+		Name:             config.DefaultQueueName,
+		StorageFolder:    config.DefaultDownloadFolder,
+		MaxSimultaneous:  config.DefaultMaxSimultaneous,
+		BandwidthLimit:   config.DefaultDownloadSpeed,
+		ActiveTimeStart:  config.DefaultActiveTimeStart,
+		ActiveTimeEnd:    config.DefaultActiveTimeEnd,
+		MaxRetryAttempts: config.DefaultMaxRetryAttempts,
+	}
+}
+
+// Validate checks queue settings before they are saved: a name, no
+// negative limits, active times written as HH:MM and a storage folder that
+// can be written to. The folder is created when it does not exist yet.
+func Validate(queue models.Queue) error {
+	if strings.TrimSpace(queue.Name) == "" {
+		return errors.New("queue name cannot be empty")
+	}
+	if queue.MaxSimultaneous < 0 || queue.MaxDownloadSpeed < 0 || queue.BandwidthLimit < 0 || queue.MaxRetryAttempts < 0 {
+		return errors.New("limits and retry attempts cannot be negative")
+	}
+	if (queue.ActiveTimeStart == "") != (queue.ActiveTimeEnd == "") {
+		return errors.New("set both ends of the active time range, or neither")
+	}
+	for _, value := range []string{queue.ActiveTimeStart, queue.ActiveTimeEnd} {
+		if _, err := time.Parse("15:04", value); value != "" && err != nil {
+			return fmt.Errorf("active time %q is not written as HH:MM", value)
+		}
+	}
+
+	return ValidateStorageFolder(queue.StorageFolder)
+}
+
+// ValidateStorageFolder checks that downloads can be written to folder,
+// creating it when it does not exist yet. An empty folder stands for the
+// default one. Its errors start with folderErrorPrefix.
+func ValidateStorageFolder(folder string) error {
+	expanded, err := ExpandFolder(folder)
+	if err != nil {
+		return fmt.Errorf("%s%s cannot be resolved: %w", folderErrorPrefix, folder, err)
+	}
+	if err := os.MkdirAll(expanded, os.ModePerm); err != nil {
+		return fmt.Errorf("%s%s cannot be created: %w", folderErrorPrefix, expanded, err)
+	}
+	probe, err := os.CreateTemp(expanded, ".gofetch-*")
+	if err != nil {
+		return fmt.Errorf("%s%s is not writable: %w", folderErrorPrefix, expanded, err)
+	}
+	probe.Close()
+	if err := os.Remove(probe.Name()); err != nil {
+		return fmt.Errorf("%s%s is not writable: %w", folderErrorPrefix, expanded, err)
+	}
+	return nil
+}
+
+// folderErrorPrefix starts the errors about the storage folder, so clients
+// of the daemon, which only see their text, can tell them apart.
+const folderErrorPrefix = "storage folder "
+
+// IsFolderError reports whether message, the text of an error returned by
+// Validate, is about the storage folder.
+func IsFolderError(message string) bool {
+	return strings.HasPrefix(message, folderErrorPrefix)
+}
+
+// ExpandFolder resolves a storage folder, falling back to the default one
+// and expanding a leading "~" to the home directory.
+func ExpandFolder(folder string) (string, error) {
+	downloadFolder := folder
+	if downloadFolder == "" {
+		downloadFolder = config.DefaultDownloadFolder
+	}
+	if strings.HasPrefix(downloadFolder, "~") {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to get home directory: %w", err)
+		}
+		downloadFolder = filepath.Join(homeDir, strings.TrimPrefix(downloadFolder[1:], "/"))
+	}
+	return downloadFolder, nil
+}
@@ -11,7 +11,18 @@ CREATE TABLE IF NOT EXISTS downloads (
      accept_ranges BOOLEAN,
      ranges_count INTEGER,
      ranges TEXT,
-     created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+     created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+     queue_name TEXT DEFAULT '',
+     last_error TEXT DEFAULT '',
+     etag TEXT DEFAULT '',
+     last_modified TEXT DEFAULT '',
+     checksum TEXT DEFAULT '',
+     pieces TEXT DEFAULT '',
+     signature TEXT DEFAULT '',
+     signature_status TEXT DEFAULT '',
+     signer TEXT DEFAULT '',
+     mirrors TEXT DEFAULT '',
+     redirects TEXT DEFAULT ''
 );
 
 CREATE TABLE IF NOT EXISTS queues (
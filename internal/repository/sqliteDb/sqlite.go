@@ -6,7 +6,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"time"
+	"strings"
 
 	"github.com/Amirali-Amirifar/gofetch.git/internal/models"
 	_ "github.com/mattn/go-sqlite3"
@@ -53,6 +53,25 @@ func New(dbPath string) (*SQLiteRepository, error) {
 	return &SQLiteRepository{Db: db}, nil
 }
 
+// downloadColumns lists the downloads columns in the order scanDownloads reads them.
+const downloadColumns = "id, url, queue, queue_name, file_name, status, progress, headers, content_length, content_type, accept_ranges, ranges_count, ranges, last_error, etag, last_modified, checksum, pieces, signature, signature_status, signer, mirrors, redirects"
+
+// migrations add the columns introduced after a database was first created.
+// Databases created from the current schema already have them.
+var migrations = []string{
+	"ALTER TABLE downloads ADD COLUMN queue_name TEXT DEFAULT ''",
+	"ALTER TABLE downloads ADD COLUMN last_error TEXT DEFAULT ''",
+	"ALTER TABLE downloads ADD COLUMN etag TEXT DEFAULT ''",
+	"ALTER TABLE downloads ADD COLUMN last_modified TEXT DEFAULT ''",
+	"ALTER TABLE downloads ADD COLUMN checksum TEXT DEFAULT ''",
+	"ALTER TABLE downloads ADD COLUMN pieces TEXT DEFAULT ''",
+	"ALTER TABLE downloads ADD COLUMN signature TEXT DEFAULT ''",
+	"ALTER TABLE downloads ADD COLUMN signature_status TEXT DEFAULT ''",
+	"ALTER TABLE downloads ADD COLUMN signer TEXT DEFAULT ''",
+	"ALTER TABLE downloads ADD COLUMN mirrors TEXT DEFAULT ''",
+	"ALTER TABLE downloads ADD COLUMN redirects TEXT DEFAULT ''",
+}
+
 func initDB(db *sql.DB) error {
 	// Create downloads table with enhanced schema
 	schema, err := os.ReadFile("./internal/repository/sqliteDb/schema.sql")
@@ -60,8 +79,16 @@ func initDB(db *sql.DB) error {
 		log.Errorf("failed to read schema: %s", err)
 		return err
 	}
-	_, err = db.Exec(string(schema))
-	return err
+	if _, err = db.Exec(string(schema)); err != nil {
+		return err
+	}
+
+	for _, migration := range migrations {
+		if _, err := db.Exec(migration); err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			return fmt.Errorf("failed to migrate database: %v", err)
+		}
+	}
+	return nil
 }
 
 func (r *SQLiteRepository) Close() error {
@@ -81,10 +108,29 @@ func (r *SQLiteRepository) AddNewDownload(download *models.Download) error {
 		return err
 	}
 
+	piecesJSON, err := marshalPieces(download.Pieces)
+	if err != nil {
+		log.Errorf("Error marshaling pieces: %v", err)
+		return err
+	}
+
+	mirrorsJSON, err := marshalMirrors(download.Mirrors)
+	if err != nil {
+		log.Errorf("Error marshaling mirrors: %v", err)
+		return err
+	}
+
+	redirectsJSON, err := marshalRedirects(download.Redirects)
+	if err != nil {
+		log.Errorf("Error marshaling redirects: %v", err)
+		return err
+	}
+
 	result, err := r.Db.Exec(
-		"INSERT INTO downloads (url, queue, file_name, status, progress, headers, content_length, content_type, accept_ranges, ranges_count, ranges) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		"INSERT INTO downloads (url, queue, queue_name, file_name, status, progress, headers, content_length, content_type, accept_ranges, ranges_count, ranges, last_error, etag, last_modified, checksum, pieces, signature, signature_status, signer, mirrors, redirects) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
 		download.URL,
 		download.QueueID,
+		download.QueueName,
 		download.FileName,
 		download.Status,
 		download.Progress,
@@ -94,6 +140,16 @@ func (r *SQLiteRepository) AddNewDownload(download *models.Download) error {
 		download.AcceptRanges,
 		download.RangesCount,
 		string(rangesJSON),
+		download.LastError,
+		download.ETag,
+		download.LastModified,
+		download.Checksum,
+		piecesJSON,
+		download.Signature,
+		download.SignatureStatus,
+		download.Signer,
+		mirrorsJSON,
+		redirectsJSON,
 	)
 	if err != nil {
 		log.Errorf("Error saving download: %v", err)
@@ -119,10 +175,29 @@ func (r *SQLiteRepository) UpdateDownload(download *models.Download) error {
 		return err
 	}
 
+	piecesJSON, err := marshalPieces(download.Pieces)
+	if err != nil {
+		log.Errorf("Error marshaling pieces: %v", err)
+		return err
+	}
+
+	mirrorsJSON, err := marshalMirrors(download.Mirrors)
+	if err != nil {
+		log.Errorf("Error marshaling mirrors: %v", err)
+		return err
+	}
+
+	redirectsJSON, err := marshalRedirects(download.Redirects)
+	if err != nil {
+		log.Errorf("Error marshaling redirects: %v", err)
+		return err
+	}
+
 	_, err = r.Db.Exec(
 		`UPDATE downloads SET 
             url = ?, 
             queue = ?, 
+            queue_name = ?,
             file_name = ?, 
             status = ?, 
             progress = ?, 
@@ -131,10 +206,21 @@ func (r *SQLiteRepository) UpdateDownload(download *models.Download) error {
             content_type = ?,
             accept_ranges = ?,
             ranges_count = ?,
-            ranges = ?
+            ranges = ?,
+            last_error = ?,
+            etag = ?,
+            last_modified = ?,
+            checksum = ?,
+            pieces = ?,
+            signature = ?,
+            signature_status = ?,
+            signer = ?,
+            mirrors = ?,
+            redirects = ?
         WHERE id = ?`,
 		download.URL,
 		download.QueueID,
+		download.QueueName,
 		download.FileName,
 		download.Status,
 		download.Progress,
@@ -144,6 +230,16 @@ func (r *SQLiteRepository) UpdateDownload(download *models.Download) error {
 		download.AcceptRanges,
 		download.RangesCount,
 		string(rangesJSON),
+		download.LastError,
+		download.ETag,
+		download.LastModified,
+		download.Checksum,
+		piecesJSON,
+		download.Signature,
+		download.SignatureStatus,
+		download.Signer,
+		mirrorsJSON,
+		redirectsJSON,
 		download.Id,
 	)
 	if err != nil {
@@ -154,21 +250,71 @@ func (r *SQLiteRepository) UpdateDownload(download *models.Download) error {
 }
 
 func (r *SQLiteRepository) GetDownloads() ([]models.Download, error) {
-	rows, err := r.Db.Query("SELECT * FROM downloads")
+	rows, err := r.Db.Query("SELECT " + downloadColumns + " FROM downloads")
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	return scanDownloads(rows)
+}
+
+// GetDownload returns the download with the given id.
+func (r *SQLiteRepository) GetDownload(id int64) (models.Download, error) {
+	rows, err := r.Db.Query("SELECT "+downloadColumns+" FROM downloads WHERE id = ?", id)
+	if err != nil {
+		return models.Download{}, err
+	}
+	defer rows.Close()
+
+	downloads, err := scanDownloads(rows)
+	if err != nil {
+		return models.Download{}, err
+	}
+	if len(downloads) == 0 {
+		return models.Download{}, sql.ErrNoRows
+	}
+	return downloads[0], nil
+}
+
+// DeleteDownload removes the download with the given id.
+func (r *SQLiteRepository) DeleteDownload(id int64) error {
+	_, err := r.Db.Exec("DELETE FROM downloads WHERE id = ?", id)
+	return err
+}
+
+// GetDownloadsByStatus returns the downloads whose status is one of statuses.
+func (r *SQLiteRepository) GetDownloadsByStatus(statuses ...models.DownloadStatus) ([]models.Download, error) {
+	if len(statuses) == 0 {
+		return nil, nil
+	}
+
+	placeholders := make([]string, len(statuses))
+	args := make([]interface{}, len(statuses))
+	for i, status := range statuses {
+		placeholders[i] = "?"
+		args[i] = status
+	}
+
+	rows, err := r.Db.Query("SELECT "+downloadColumns+" FROM downloads WHERE status IN ("+strings.Join(placeholders, ", ")+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanDownloads(rows)
+}
+
+func scanDownloads(rows *sql.Rows) ([]models.Download, error) {
 	var downloads []models.Download
 	for rows.Next() {
 		var download models.Download
-		var headersJSON, rangesJSON string
-		var createdAt time.Time
+		var headersJSON, rangesJSON, piecesJSON, mirrorsJSON, redirectsJSON string
 		err := rows.Scan(
 			&download.Id,
 			&download.URL,
 			&download.QueueID,
+			&download.QueueName,
 			&download.FileName,
 			&download.Status,
 			&download.Progress,
@@ -178,7 +324,16 @@ func (r *SQLiteRepository) GetDownloads() ([]models.Download, error) {
 			&download.AcceptRanges,
 			&download.RangesCount,
 			&rangesJSON,
-			&createdAt,
+			&download.LastError,
+			&download.ETag,
+			&download.LastModified,
+			&download.Checksum,
+			&piecesJSON,
+			&download.Signature,
+			&download.SignatureStatus,
+			&download.Signer,
+			&mirrorsJSON,
+			&redirectsJSON,
 		)
 		if err != nil {
 			log.Errorf("Error getting downloads: %v", err)
@@ -196,10 +351,53 @@ func (r *SQLiteRepository) GetDownloads() ([]models.Download, error) {
 				return nil, err
 			}
 		}
+		if piecesJSON != "" {
+			if err := json.Unmarshal([]byte(piecesJSON), &download.Pieces); err != nil {
+				return nil, err
+			}
+		}
+		if mirrorsJSON != "" {
+			if err := json.Unmarshal([]byte(mirrorsJSON), &download.Mirrors); err != nil {
+				return nil, err
+			}
+		}
+		if redirectsJSON != "" {
+			if err := json.Unmarshal([]byte(redirectsJSON), &download.Redirects); err != nil {
+				return nil, err
+			}
+		}
 
 		downloads = append(downloads, download)
 	}
-	return downloads, nil
+	return downloads, rows.Err()
+}
+
+// marshalPieces stores missing piece checksums as an empty string.
+func marshalPieces(pieces *models.Pieces) (string, error) {
+	if pieces == nil {
+		return "", nil
+	}
+	data, err := json.Marshal(pieces)
+	return string(data), err
+}
+
+// marshalMirrors stores downloads without mirrors as an empty string.
+func marshalMirrors(mirrors []models.Mirror) (string, error) {
+	if len(mirrors) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(mirrors)
+	return string(data), err
+}
+
+// marshalRedirects stores downloads that were not redirected as an empty
+// string.
+func marshalRedirects(redirects []string) (string, error) {
+	if len(redirects) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(redirects)
+	return string(data), err
 }
 
 //
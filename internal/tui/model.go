@@ -10,3 +10,10 @@ type ChildModel interface {
 	GetName() string
 	GetKeyBinds() []key.Binding
 }
+
+// prompter is implemented by views that ask questions below their content,
+// such as which queue to move downloads to. While a question is open, esc
+// goes to the view to dismiss it instead of leaving the view.
+type prompter interface {
+	Prompting() bool
+}
@@ -1,6 +1,7 @@
 package tui
 
 import (
+	"github.com/Amirali-Amirifar/gofetch.git/internal/daemon"
 	"github.com/Amirali-Amirifar/gofetch.git/internal/tui/components"
 	"strings"
 
@@ -8,6 +9,7 @@ import (
 	"github.com/Amirali-Amirifar/gofetch.git/internal/tui/views"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
+	log "github.com/sirupsen/logrus"
 )
 
 type model struct {
@@ -17,12 +19,33 @@ type model struct {
 	width         int
 	height        int
 	state         models.AppState
+	client        *daemon.Client
+	events        <-chan daemon.Event // Nil when subscribing failed
 	children      []ChildModel
 	HelpComponent components.HelpModel
 }
 
 func (m model) Init() tea.Cmd {
-	return nil
+	cmds := []tea.Cmd{listenCmd(m.events)}
+	for _, child := range m.children {
+		cmds = append(cmds, child.Init())
+	}
+	return tea.Batch(cmds...)
+}
+
+// listenCmd waits for the next event of the daemon and hands it to the
+// program as a message.
+func listenCmd(events <-chan daemon.Event) tea.Cmd {
+	if events == nil {
+		return nil
+	}
+	return func() tea.Msg {
+		event, ok := <-events
+		if !ok {
+			return views.DisconnectedMsg{}
+		}
+		return event
+	}
 }
 
 func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
@@ -32,9 +55,15 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
 	case tea.WindowSizeMsg:
 		return m.updateSizeMsg(msg)
+	case daemon.Event:
+		m, cmd = m.broadcast(msg)
+		return m, tea.Batch(cmd, listenCmd(m.events))
 	case tea.KeyMsg:
 		switch msg.String() {
 		case "esc":
+			if p, ok := m.children[m.activeTab].(prompter); ok && m.isFocusedTab && p.Prompting() {
+				break
+			}
 			m.isFocusedTab = !m.isFocusedTab
 			m.HelpComponent = m.HelpComponent.SetIsFocusedTab(m.isFocusedTab)
 			return m, nil
@@ -42,6 +71,12 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		}
 	}
 
+	// Views keep receiving their ticks and events while in the background;
+	// only keys go to the active view alone.
+	if _, ok := msg.(tea.KeyMsg); !ok {
+		return m.broadcast(msg)
+	}
+
 	// Delegate update to the active view
 	if m.isFocusedTab {
 		updatedChild, cmd := m.children[m.activeTab].Update(msg)
@@ -80,6 +115,21 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	return m, cmd
 }
 
+// broadcast hands msg to every view.
+func (m model) broadcast(msg tea.Msg) (model, tea.Cmd) {
+	var cmds []tea.Cmd
+	for i := range m.children {
+		updatedChild, cmd := m.children[i].Update(msg)
+		if child, ok := updatedChild.(ChildModel); ok {
+			m.children[i] = child
+		} else {
+			panic(`invalid child model`)
+		}
+		cmds = append(cmds, cmd)
+	}
+	return m, tea.Batch(cmds...)
+}
+
 func (m model) handleTabChange(newTab int) model {
 	m.activeTab = newTab
 	m.HelpComponent = m.HelpComponent.SetActiveTab(m.children[m.activeTab].GetName())
@@ -172,9 +222,9 @@ func (m model) View() string {
 func (m model) initializeChildren() model {
 	// Initialize child models with the loaded state
 	m.children = []ChildModel{
-		views.InitDownloads(m.state),    // New Download tab
-		views.InitDownloadList(m.state), // Downloads List tab
-		views.InitQueueList(m.state),    // Queues List tab
+		views.InitDownloads(m.state, m.client),    // New Download tab
+		views.InitDownloadList(m.state, m.client), // Downloads List tab
+		views.InitQueueList(m.state, m.client),    // Queues List tab
 	}
 
 	// Populate Tabs dynamically from children's GetName()
@@ -210,9 +260,17 @@ func (m model) updateSizeMsg(msg tea.WindowSizeMsg) (model, tea.Cmd) {
 	return m, nil
 }
 
-func GetTui(state models.AppState) *tea.Program {
+func GetTui(state models.AppState, client *daemon.Client) *tea.Program {
+	// Subscribed before the views load the downloads, so no change is
+	// missed in between.
+	events, err := client.Subscribe()
+	if err != nil {
+		log.Errorf("Failed to subscribe to events: %v", err)
+	}
 	m := model{
-		state: state,
+		state:  state,
+		client: client,
+		events: events,
 	}.initializeChildren()
 	m = m.handleTabChange(1)
 
@@ -2,7 +2,7 @@ package views
 
 import (
 	"fmt"
-	"github.com/Amirali-Amirifar/gofetch.git/internal/controller"
+	"github.com/Amirali-Amirifar/gofetch.git/internal/daemon"
 	"github.com/Amirali-Amirifar/gofetch.git/internal/models"
 	"github.com/charmbracelet/bubbles/key"
 	"github.com/charmbracelet/bubbles/progress"
@@ -10,20 +10,24 @@ import (
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
 	log "github.com/sirupsen/logrus"
+	"path/filepath"
 	"strings"
-	"time"
 )
 
+// maxStripLines bounds the transfers listed below the form.
+const maxStripLines = 8
+
 // button represents a simple clickable button.
 type button struct {
 	label  string
 	action string
 }
 
-// progressMsg delivers progress updates to the view.
-type progressMsg struct {
-	progress float64 // between 0.0 and 1.0.
-	speed    float64 // bytes per second.
+// submittedMsg reports the downloads the daemon added for a URL.
+type submittedMsg struct {
+	url       string
+	downloads []daemon.Download
+	err       error
 }
 
 // buttonPressedMsg is sent when a button is clicked.
@@ -41,20 +45,20 @@ type model struct {
 	startButton  button
 	cancelButton button
 
-	// Application state and progress info.
-	state           models.AppState
-	err             error
-	activeDownload  bool
-	progressBar     progress.Model
-	progressVal     float64 // value between 0 and 1.
-	speed           float64 // bytes per second.
-	downloadControl *controller.Download
-	statusMsg       string
+	// Application state and the transfers in progress.
+	state       models.AppState
+	client      *daemon.Client
+	err         error
+	transfers   map[int64]daemon.Download // Unfinished downloads, kept current by events
+	order       []int64                   // Ids of the transfers in the order they were added
+	pending     int                       // Submissions the daemon has not answered yet
+	progressBar progress.Model
+	statusMsg   string
 }
 
 func (m model) GetKeyBinds() []key.Binding {
 	return []key.Binding{
-		key.NewBinding(key.WithKeys("enter"), key.WithHelp("enter", "select/confirm")),
+		key.NewBinding(key.WithKeys("enter"), key.WithHelp("enter", "start download")),
 		key.NewBinding(key.WithKeys("tab"), key.WithHelp("tab", "next field")),
 		key.NewBinding(key.WithKeys("shift+tab"), key.WithHelp("shift+tab", "previous field")),
 	}
@@ -65,10 +69,10 @@ func (m model) GetName() string {
 	return "Download Page"
 }
 
-func InitDownloads(state models.AppState) model {
+func InitDownloads(state models.AppState, client *daemon.Client) model {
 
 	urlInput := textinput.New()
-	urlInput.Placeholder = "https://..."
+	urlInput.Placeholder = "https://... or a .meta4/.metalink file"
 	urlInput.Focus()
 	urlInput.Width = 40
 
@@ -81,21 +85,40 @@ func InitDownloads(state models.AppState) model {
 	fileNameInput.Placeholder = "Optional, relative or absolute path"
 	fileNameInput.Width = 40
 
-	inputs := []textinput.Model{urlInput, queueInput, fileNameInput}
-	prog := progress.New(progress.WithDefaultGradient())
-
-	return model{
-		startButton:    button{label: "Start Download", action: "start"},
-		cancelButton:   button{label: "Cancel", action: "cancel"},
-		inputs:         inputs,
-		focusIndex:     0,
-		state:          state,
-		err:            nil,
-		activeDownload: false,
-		progressBar:    prog,
-		progressVal:    0,
-		speed:          0,
+	checksumInput := textinput.New()
+	checksumInput.Placeholder = "Optional, e.g. sha256:<digest>"
+	checksumInput.Width = 40
+
+	signatureInput := textinput.New()
+	signatureInput.Placeholder = "Optional, URL or file of a .sig/.asc"
+	signatureInput.Width = 40
+
+	mirrorsInput := textinput.New()
+	mirrorsInput.Placeholder = "Optional, more URLs of the same file"
+	mirrorsInput.Width = 40
+
+	inputs := []textinput.Model{urlInput, queueInput, fileNameInput, checksumInput, signatureInput, mirrorsInput}
+	prog := progress.New(progress.WithDefaultGradient(), progress.WithWidth(30))
+
+	m := model{
+		startButton:  button{label: "Start Download", action: "start"},
+		cancelButton: button{label: "Cancel", action: "cancel"},
+		inputs:       inputs,
+		focusIndex:   0,
+		state:        state,
+		client:       client,
+		err:          nil,
+		transfers:    make(map[int64]daemon.Download),
+		progressBar:  prog,
+	}
+	downloads, err := client.Downloads()
+	if err != nil {
+		log.Errorf("Failed to fetch downloads: %v", err)
 	}
+	for _, download := range downloads {
+		m.setTransfer(download)
+	}
+	return m
 }
 
 // Init is the Bubble Tea initialization.
@@ -103,103 +126,130 @@ func (m model) Init() tea.Cmd {
 	return tea.Batch(textinput.Blink)
 }
 
-// pollDownloadProgressCmd polls the active download and sends progress updates.
-func pollDownloadProgressCmd(c *controller.Download) tea.Cmd {
-	return tea.Tick(500*time.Millisecond, func(t time.Time) tea.Msg {
-		progFloat := 0.0
-		if c.ContentLength > 0 {
-			progFloat = float64(c.CurrentProgress) / float64(c.ContentLength)
-			if progFloat > 1.0 {
-				progFloat = 1.0
-			}
+// submitCmd hands a download to the daemon, which waits for the server to
+// answer before adding it.
+func submitCmd(client *daemon.Client, download models.Download) tea.Cmd {
+	return func() tea.Msg {
+		downloads, err := client.Add(download)
+		return submittedMsg{url: download.URL, downloads: downloads, err: err}
+	}
+}
+
+// transferring reports whether a download belongs in the strip of
+// transfers: it is waiting for a slot, downloading, or paused.
+func transferring(status models.DownloadStatus) bool {
+	return status == models.DownloadStatusQueued ||
+		status == models.DownloadStatusDownloading ||
+		status == models.DownloadStatusPaused
+}
+
+// setTransfer records the latest version of a download. Downloads that
+// finish leave the strip, and the status line tells how they ended.
+func (m *model) setTransfer(download daemon.Download) {
+	_, known := m.transfers[download.Id]
+	if transferring(download.Status) {
+		if !known {
+			m.order = append(m.order, download.Id)
 		}
-		elapsed := time.Since(c.StartTime)
-		speed := 0.0
-		if elapsed.Seconds() > 0 {
-			speed = float64(c.CurrentProgress) / elapsed.Seconds()
+		m.transfers[download.Id] = download
+		return
+	}
+	if !known {
+		return
+	}
+	m.removeTransfer(download.Id)
+	name := transferName(download)
+	switch download.Status {
+	case models.DownloadStatusCompleted:
+		m.statusMsg = "Completed " + name
+	case models.DownloadStatusCanceled:
+		m.statusMsg = "Canceled " + name
+	case models.DownloadStatusChanged:
+		m.statusMsg = fmt.Sprintf("Error: %s changed on the server, resume it in the Download List to start over", name)
+	default:
+		m.statusMsg = fmt.Sprintf("Error: %s: %s", name, download.LastError)
+	}
+}
+
+func (m *model) removeTransfer(id int64) {
+	if _, ok := m.transfers[id]; !ok {
+		return
+	}
+	delete(m.transfers, id)
+	for i, known := range m.order {
+		if known == id {
+			m.order = append(m.order[:i:i], m.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// resetForm empties the form for the next download. The queue is kept, as
+// downloads added in a row usually go to the same one.
+func (m *model) resetForm() {
+	for i := range m.inputs {
+		if i != 1 {
+			m.inputs[i].SetValue("")
 		}
-		return progressMsg{progress: progFloat, speed: speed}
-	})
+		m.inputs[i].Blur()
+	}
+	m.focusIndex = 0
+	m.inputs[0].Focus()
+}
+
+// transferName is the file name of a download, or its URL until the name is
+// known.
+func transferName(download daemon.Download) string {
+	if download.FileName != "" {
+		return filepath.Base(download.FileName)
+	}
+	return download.URL
 }
 
 func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
 
-		if m.activeDownload {
-			switch msg.String() {
-			case "p":
-				if m.downloadControl != nil {
-					if m.downloadControl.Status == models.DownloadStatusDownloading {
-						m.downloadControl.PauseDownload()
-					} else if m.downloadControl.Status == models.DownloadStatusPaused {
-						m.downloadControl.ResumeDownload()
-					}
-				}
-				return m, nil
-			case "c":
-				if m.downloadControl != nil {
-					m.downloadControl.CancelDownload()
-				}
-				m.activeDownload = false
-				m.progressVal = 0
-				return m, tea.ClearScreen
-			case "q":
-				m.activeDownload = false
-				m.progressVal = 0
-				return m, tea.ClearScreen
-			}
-		}
-
 		switch msg.String() {
 		case "tab":
-			if !m.activeDownload {
-				if m.focusIndex < len(m.inputs) {
-					m.inputs[m.focusIndex].Blur()
-				}
-				m.focusIndex = (m.focusIndex + 1) % (len(m.inputs) + 2) // +2 for the buttons.
-				if m.focusIndex < len(m.inputs) {
-					m.inputs[m.focusIndex].Focus()
-				}
+			if m.focusIndex < len(m.inputs) {
+				m.inputs[m.focusIndex].Blur()
+			}
+			m.focusIndex = (m.focusIndex + 1) % (len(m.inputs) + 2) // +2 for the buttons.
+			if m.focusIndex < len(m.inputs) {
+				m.inputs[m.focusIndex].Focus()
 			}
 			return m, tea.ClearScreen
 		case "shift+tab":
-			if !m.activeDownload {
-				if m.focusIndex < len(m.inputs) {
-					m.inputs[m.focusIndex].Blur()
-				}
-				m.focusIndex = (m.focusIndex - 1 + (len(m.inputs) + 2)) % (len(m.inputs) + 2)
-				if m.focusIndex < len(m.inputs) {
-					m.inputs[m.focusIndex].Focus()
-				}
+			if m.focusIndex < len(m.inputs) {
+				m.inputs[m.focusIndex].Blur()
+			}
+			m.focusIndex = (m.focusIndex - 1 + (len(m.inputs) + 2)) % (len(m.inputs) + 2)
+			if m.focusIndex < len(m.inputs) {
+				m.inputs[m.focusIndex].Focus()
 			}
 			return m, tea.ClearScreen
 		case "enter":
-			cmds := []tea.Cmd{tea.ClearScreen}
-			if !m.activeDownload {
-				if m.focusIndex == len(m.inputs) {
-					cmds = append(cmds, func() tea.Msg {
-						return buttonPressedMsg{action: m.startButton.action}
-					})
-				} else if m.focusIndex == len(m.inputs)+1 {
-					cmds = append(cmds, func() tea.Msg {
-						return buttonPressedMsg{action: m.cancelButton.action}
-					})
-				}
+			// Enter in any field starts the download, so a URL can be pasted
+			// and sent right away.
+			action := m.startButton.action
+			if m.focusIndex == len(m.inputs)+1 {
+				action = m.cancelButton.action
 			}
-			return m, tea.Batch(cmds...)
+			return m, tea.Batch(tea.ClearScreen, func() tea.Msg {
+				return buttonPressedMsg{action: action}
+			})
 		}
 	case buttonPressedMsg:
 		switch msg.action {
 		case "start":
-			m.activeDownload = true
-			m.progressVal = 0
-			m.speed = 0
-
 			// Gather input values.
 			url := m.inputs[0].Value()
 			queue := m.inputs[1].Value()
 			fileName := m.inputs[2].Value()
+			checksum := m.inputs[3].Value()
+			signature := m.inputs[4].Value()
+			mirrors := m.inputs[5].Value()
 
 			if queue == "" {
 				queue = "Default"
@@ -213,30 +263,62 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				FileName:  fileName,
 				URL:       url,
 				QueueName: queue,
+				Checksum:  checksum,
+				Signature: signature,
+				Mirrors:   models.ParseMirrors(url, mirrors),
 			}
 
-			// Create and start the download.
-			ctrl := &controller.Download{Download: download}
-			m.downloadControl = ctrl
-			go ctrl.Create()
-			log.Printf("Started download: %#v", download)
-
-			// Begin polling for progress.
-			return m, pollDownloadProgressCmd(ctrl)
+			// Hand the download to its queue, which starts it once a slot is
+			// free, and take the next one while the daemon checks the server.
+			m.pending++
+			m.statusMsg = fmt.Sprintf("Adding %s...", plural(m.pending, "download"))
+			log.Printf("Submitting download: %#v", download)
+			m.resetForm()
+			return m, submitCmd(m.client, download)
 		case "cancel":
 			return m, tea.ClearScreen
 		}
-	case progressMsg:
-		m.progressVal = msg.progress
-		m.speed = msg.speed
-		// Continue polling until complete.
-		if m.progressVal < 1.0 {
-			if m.downloadControl != nil {
-				return m, pollDownloadProgressCmd(m.downloadControl)
+	case submittedMsg:
+		m.pending--
+		// A download whose URL could not be fetched comes back failed, along
+		// with the error; only the others were added. Queued ones may have
+		// started already.
+		var added []daemon.Download
+		for _, download := range msg.downloads {
+			m.setTransfer(download)
+			if transferring(download.Status) {
+				added = append(added, download)
 			}
 		}
-		m.activeDownload = false
-		m.progressVal = 1.0
+		switch {
+		case msg.err != nil:
+			m.statusMsg = fmt.Sprintf("Error: %s: %v", msg.url, msg.err)
+			if len(added) > 0 {
+				m.statusMsg += fmt.Sprintf(" (added %s)", plural(len(added), "download"))
+			}
+		case len(added) == 0:
+			m.statusMsg = fmt.Sprintf("Error: %s: nothing was added", msg.url)
+		case len(added) == 1:
+			m.statusMsg = "Added " + transferName(added[0])
+		default:
+			m.statusMsg = "Added " + plural(len(added), "download")
+		}
+		if m.pending > 0 {
+			m.statusMsg += fmt.Sprintf(", adding %s...", plural(m.pending, "more download"))
+		}
+		return m, nil
+	case daemon.Event:
+		switch msg.Type {
+		case daemon.EventDownload:
+			m.setTransfer(*msg.Download)
+		case daemon.EventRemoved:
+			m.removeTransfer(msg.Download.Id)
+		case daemon.EventState:
+			m.state = *msg.State
+		}
+		return m, nil
+	case DisconnectedMsg:
+		m.statusMsg = "Error: Lost connection to the daemon, restart gofetch to reconnect"
 		return m, nil
 	case error:
 		m.err = msg
@@ -244,19 +326,11 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	}
 
 	var cmds []tea.Cmd
-	if !m.activeDownload {
-		for i := range m.inputs {
-			var cmd tea.Cmd
-			m.inputs[i], cmd = m.inputs[i].Update(msg)
-			cmds = append(cmds, cmd)
-		}
-	}
-
-	newModel, progCmd := m.progressBar.Update(msg)
-	if pb, ok := newModel.(progress.Model); ok {
-		m.progressBar = pb
+	for i := range m.inputs {
+		var cmd tea.Cmd
+		m.inputs[i], cmd = m.inputs[i].Update(msg)
+		cmds = append(cmds, cmd)
 	}
-	cmds = append(cmds, progCmd)
 	return m, tea.Batch(cmds...)
 }
 
@@ -268,20 +342,12 @@ func (m model) View() string {
 		BorderForeground(lipgloss.Color("205")).
 		Foreground(lipgloss.Color("229"))
 
-	if m.activeDownload {
-		status := m.downloadControl.Status
-		statusStr := string(status)
-		b.WriteString("Download in progress...\n\n")
-		b.WriteString(m.progressBar.ViewAs(m.progressVal))
-		b.WriteString(fmt.Sprintf("\nSpeed: %.2f bytes/s\n", m.speed))
-		b.WriteString(fmt.Sprintf("\nStatus: %s\n", statusStr))
-		b.WriteString("\nControls: (p) Pause/Resume, (c) Cancel, (q) Quit view")
-		return docStyles.Render(b.String())
-	}
-
 	b.WriteString("URL: " + m.inputs[0].View() + "\n\n")
 	b.WriteString("Queue: " + m.inputs[1].View() + "\n\n")
 	b.WriteString("File Name: " + m.inputs[2].View() + "\n\n")
+	b.WriteString("Checksum: " + m.inputs[3].View() + "\n\n")
+	b.WriteString("Signature: " + m.inputs[4].View() + "\n\n")
+	b.WriteString("Mirrors: " + m.inputs[5].View() + "\n\n")
 
 	normalStyle := lipgloss.NewStyle().Foreground(lipgloss.Color("7")).Background(lipgloss.Color("240")).Padding(0, 2)
 	focusedStyle := lipgloss.NewStyle().Foreground(lipgloss.Color("0")).Background(lipgloss.Color("229")).Padding(0, 2)
@@ -317,5 +383,32 @@ func (m model) View() string {
 		b.WriteString("\n\n")
 	}
 
+	b.WriteString(m.transferStrip())
 	return docStyles.Render(b.String())
 }
+
+// transferStrip lists the unfinished downloads, one line each, with a
+// progress bar. They are managed in the Download List.
+func (m model) transferStrip() string {
+	if len(m.order) == 0 {
+		return "No active transfers"
+	}
+	nameStyle := lipgloss.NewStyle().Width(30).MaxWidth(30)
+	lines := []string{fmt.Sprintf("Active transfers (%d), manage them in the Download List:", len(m.order))}
+	for _, id := range m.order[:min(len(m.order), maxStripLines)] {
+		download := m.transfers[id]
+		fraction := 0.0
+		if download.ContentLength > 0 {
+			fraction = min(float64(completedBytes(download.Download))/float64(download.ContentLength), 1)
+		}
+		line := nameStyle.Render(transferName(download)) + " " + m.progressBar.ViewAs(fraction) + "  " + string(download.Status)
+		if download.Status == models.DownloadStatusDownloading {
+			line += "  " + formatBytes(download.Speed) + "/s"
+		}
+		lines = append(lines, line)
+	}
+	if len(m.order) > maxStripLines {
+		lines = append(lines, fmt.Sprintf("... and %d more", len(m.order)-maxStripLines))
+	}
+	return strings.Join(lines, "\n")
+}
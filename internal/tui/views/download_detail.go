@@ -0,0 +1,218 @@
+package views
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Amirali-Amirifar/gofetch.git/internal/daemon"
+	"github.com/Amirali-Amirifar/gofetch.git/internal/models"
+	"github.com/charmbracelet/lipgloss"
+)
+
+const (
+	// segmentBarWidth is the number of cells the file is drawn with.
+	segmentBarWidth = 64
+	// sampleInterval is how often the speed of downloading downloads is
+	// recorded for the throughput graph, which shows the last historyLength
+	// samples.
+	sampleInterval = time.Second
+	historyLength  = 60
+	// maxSegmentLines bounds the segments listed; finished segments without
+	// failures are left out first.
+	maxSegmentLines = 12
+)
+
+var (
+	detailLabelStyle = lipgloss.NewStyle().Bold(true).Width(12)
+	doneCellStyle    = lipgloss.NewStyle().Foreground(lipgloss.Color("#7D56F4"))
+	activeCellStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("229"))
+	failedCellStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("#FF0000"))
+	sparkStyle       = lipgloss.NewStyle().Foreground(lipgloss.Color("#00FF00"))
+	sparks           = []rune("▁▂▃▄▅▆▇█")
+)
+
+// renderDetail shows everything known about a download: where it comes
+// from, what the server answered, and how far each of its segments got.
+// history holds its recent speeds, oldest first.
+func renderDetail(d daemon.Download, history []int64) string {
+	var lines []string
+	field := func(label string, values ...string) {
+		for i, value := range values {
+			if i > 0 {
+				label = ""
+			}
+			lines = append(lines, detailLabelStyle.Render(label)+value)
+		}
+	}
+
+	field("URL", d.URL)
+	if len(d.Redirects) > 0 {
+		field("Redirected", d.Redirects...)
+	}
+	field("File", d.FileName)
+	status := string(d.Status)
+	if d.LastError != "" {
+		status += ": " + d.LastError
+	}
+	field("Status", status)
+
+	done := completedBytes(d.Download)
+	progress := formatBytes(done)
+	if d.ContentLength > 0 {
+		progress = fmt.Sprintf("%s / %s (%d%%)", progress, formatBytes(d.ContentLength), min(done*100/d.ContentLength, 100))
+	}
+	field("Progress", progress)
+	if d.Status == models.DownloadStatusDownloading {
+		speed := fmt.Sprintf("%s/s over %d connection(s)", formatBytes(d.Speed), d.Connections)
+		if d.Speed > 0 && d.ContentLength > done {
+			speed += fmt.Sprintf(", %s left", time.Duration((d.ContentLength-done)/d.Speed)*time.Second)
+		}
+		field("Speed", speed)
+	}
+	if !d.StartTime.IsZero() {
+		field("Started", d.StartTime.Local().Format(time.DateTime))
+	}
+	if len(history) > 0 {
+		field("Throughput", sparkline(history)+"  peak "+formatBytes(slices.Max(history))+"/s")
+	}
+
+	if bar := segmentBar(d); bar != "" {
+		lines = append(lines, "", detailLabelStyle.Render("Segments")+bar)
+		lines = append(lines, segmentLines(d)...)
+	}
+
+	if len(d.Headers) > 0 {
+		lines = append(lines, "", detailLabelStyle.Render("Headers"))
+		names := make([]string, 0, len(d.Headers))
+		for name := range d.Headers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			lines = append(lines, fmt.Sprintf("  %s: %s", name, strings.Join(d.Headers[name], ", ")))
+		}
+	}
+
+	lines = append(lines, "", "enter: back to the list")
+	return lipgloss.JoinVertical(lipgloss.Left, lines...)
+}
+
+// segmentBar draws the file as a row of cells, like a defragmenter does:
+// each cell covers an equal share of the file and shows how much of it is on
+// disk. Cells where a connection is writing are highlighted, and those of
+// unfinished segments that failed before are red.
+func segmentBar(d daemon.Download) string {
+	if d.ContentLength <= 0 || len(d.Ranges) == 0 {
+		return ""
+	}
+	cellSize := float64(d.ContentLength) / segmentBarWidth
+	written := make([]float64, segmentBarWidth)
+	styles := make([]*lipgloss.Style, segmentBarWidth)
+
+	active := make(map[int]bool)
+	for _, c := range d.ConnectionStatuses {
+		active[c.Segment] = true
+	}
+	for i, r := range d.Ranges {
+		first := min(int(float64(r.Start)/cellSize), segmentBarWidth-1)
+		for cell := first; cell < segmentBarWidth && float64(cell)*cellSize <= float64(r.End); cell++ {
+			from := max(float64(cell)*cellSize, float64(r.Start))
+			to := min(float64(cell+1)*cellSize, float64(r.Offset))
+			if to > from {
+				written[cell] += to - from
+			}
+		}
+		if r.Done() {
+			continue
+		}
+		cell := min(int(float64(r.Offset)/cellSize), segmentBarWidth-1)
+		switch {
+		case r.Failures > 0:
+			styles[cell] = &failedCellStyle
+		case active[i] && styles[cell] == nil:
+			styles[cell] = &activeCellStyle
+		}
+	}
+
+	var b strings.Builder
+	for cell, bytes := range written {
+		var block string
+		switch fraction := bytes / cellSize; {
+		case fraction >= 0.999:
+			block = "█"
+		case fraction >= 0.5:
+			block = "▓"
+		case fraction > 0:
+			block = "▒"
+		default:
+			block = "░"
+		}
+		style := styles[cell]
+		if style == nil {
+			style = &doneCellStyle
+		}
+		b.WriteString(style.Render(block))
+	}
+	return b.String()
+}
+
+// segmentLines lists the segments with the connection working on each and
+// its speed, and the failures each had. Unfinished segments and those that
+// failed come first, as they are what holds a download up.
+func segmentLines(d daemon.Download) []string {
+	owners := make(map[int]string)
+	for _, c := range d.ConnectionStatuses {
+		owners[c.Segment] = fmt.Sprintf("#%d %s/s", c.ID, formatBytes(c.Speed))
+	}
+
+	var shown, hidden []int
+	for i, r := range d.Ranges {
+		if !r.Done() || r.Failures > 0 {
+			shown = append(shown, i)
+		} else {
+			hidden = append(hidden, i)
+		}
+	}
+	shown = append(shown, hidden...)
+	hiddenCount := max(len(shown)-maxSegmentLines, 0)
+	shown = shown[:len(shown)-hiddenCount]
+	sort.Ints(shown)
+
+	lines := []string{fmt.Sprintf("  %3s  %-25s %5s  %-20s %7s  %s", "#", "Bytes", "Done", "Connection", "Retries", "Last error")}
+	for _, i := range shown {
+		r := d.Ranges[i]
+		size := r.End - r.Start + 1
+		percent := int64(100)
+		if size > 0 && !r.Done() {
+			percent = (r.Offset - r.Start) * 100 / size
+		}
+		lastError := r.LastError
+		if r.FailedAt != nil {
+			lastError = r.FailedAt.Local().Format(time.TimeOnly) + " " + lastError
+		}
+		lines = append(lines, fmt.Sprintf("  %3d  %-25s %4d%%  %-20s %7d  %s",
+			i, fmt.Sprintf("%d-%d", r.Start, r.End), percent, owners[i], r.Failures, lastError))
+	}
+	if hiddenCount > 0 {
+		lines = append(lines, fmt.Sprintf("  ... and %d more segments", hiddenCount))
+	}
+	return lines
+}
+
+// sparkline draws samples as a bar graph one character high, scaled to the
+// largest of them.
+func sparkline(samples []int64) string {
+	peak := slices.Max(samples)
+	var b strings.Builder
+	for _, sample := range samples {
+		level := 0
+		if peak > 0 {
+			level = int(sample * int64(len(sparks)-1) / peak)
+		}
+		b.WriteRune(sparks[level])
+	}
+	return sparkStyle.Render(b.String())
+}
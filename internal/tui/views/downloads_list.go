@@ -2,56 +2,115 @@ package views
 
 import (
 	"fmt"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
 
-	"github.com/Amirali-Amirifar/gofetch.git/internal/config"
+	"github.com/Amirali-Amirifar/gofetch.git/internal/daemon"
 	"github.com/Amirali-Amirifar/gofetch.git/internal/models"
 	"github.com/charmbracelet/bubbles/key"
 	"github.com/charmbracelet/bubbles/table"
+	"github.com/charmbracelet/bubbles/textinput"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
 	log "github.com/sirupsen/logrus"
 )
 
+// frameInterval is how often the download list redraws the downloads that
+// changed, however often the daemon reports them.
+const frameInterval = 250 * time.Millisecond
+
+// frameMsg asks the download list to draw a frame.
+type frameMsg time.Time
+
+// actionMsg reports how an action on downloads went.
+type actionMsg struct {
+	verb string // What was done, e.g. "Paused"
+	done int
+	errs []error
+}
+
+// DisconnectedMsg tells the views that the connection to the daemon was
+// lost, so no more events arrive.
+type DisconnectedMsg struct{}
+
 type downloadListModel struct {
-	table table.Model
-	state models.AppState
+	table     table.Model
+	state     models.AppState
+	client    *daemon.Client
+	downloads map[int64]daemon.Download // Latest known version of each download, kept current by events
+	order     []int64                   // Ids of the downloads in the order of the rows
+	dirty     bool                      // Downloads changed since the rows were last drawn
+	err       string
+
+	selected   map[int64]bool // Downloads marked for the next action
+	confirm    []int64        // Downloads to delete with their files once confirmed
+	moving     []int64        // Downloads to move once a queue is entered
+	queueInput textinput.Model
+	statusMsg  string
+
+	detail     int64             // Download shown in the detail pane, 0 while the list is shown
+	history    map[int64][]int64 // Recent speeds of each download, oldest first
+	lastSample time.Time
 }
 
 func (m downloadListModel) GetKeyBinds() []key.Binding {
-	return []key.Binding{}
+	return []key.Binding{
+		key.NewBinding(key.WithKeys(" "), key.WithHelp("space", "Select")),
+		key.NewBinding(key.WithKeys("a"), key.WithHelp("a", "Select All")),
+		key.NewBinding(key.WithKeys("p"), key.WithHelp("p", "Pause/Resume")),
+		key.NewBinding(key.WithKeys("c"), key.WithHelp("c", "Cancel")),
+		key.NewBinding(key.WithKeys("r"), key.WithHelp("r", "Retry")),
+		key.NewBinding(key.WithKeys("m"), key.WithHelp("m", "Move to Queue")),
+		key.NewBinding(key.WithKeys("x"), key.WithHelp("x", "Remove")),
+		key.NewBinding(key.WithKeys("D"), key.WithHelp("D", "Delete with File")),
+		key.NewBinding(key.WithKeys("o"), key.WithHelp("o", "Open Folder")),
+	}
 }
 
 func (m downloadListModel) GetName() string {
 	return "Download List"
 }
 
-func InitDownloadList(state models.AppState) downloadListModel {
+// Prompting reports whether a question waits for an answer below the list.
+func (m downloadListModel) Prompting() bool {
+	return m.confirm != nil || m.moving != nil
+}
+
+func InitDownloadList(state models.AppState, client *daemon.Client) downloadListModel {
 	columns := []table.Column{
-		{Title: "URL", Width: 50},
-		{Title: "Queue", Width: 15},
-		{Title: "Status", Width: 15},
-		{Title: "Progress", Width: 10},
+		{Title: "", Width: 1},
+		{Title: "URL", Width: 40},
+		{Title: "Queue", Width: 12},
+		{Title: "Status", Width: 13},
+		{Title: "Progress", Width: 8},
+		{Title: "Bytes", Width: 21},
+		{Title: "Speed", Width: 12},
+		{Title: "ETA", Width: 9},
+		{Title: "Signature", Width: 25},
+		{Title: "Error", Width: 30},
 	}
 
-	var rows []table.Row
-	db := config.GetDB()
-	downloads, err := db.GetDownloads()
+	m := downloadListModel{
+		state:     state,
+		client:    client,
+		downloads: make(map[int64]daemon.Download),
+		selected:  make(map[int64]bool),
+		history:   make(map[int64][]int64),
+	}
+	downloads, err := client.Downloads()
 	if err != nil {
 		log.Errorf("Failed to fetch downloads: %v", err)
 	}
-
 	for _, download := range downloads {
-		rows = append(rows, table.Row{
-			download.URL,
-			download.QueueName,
-			string(download.Status),
-			fmt.Sprintf("%d%%", download.Progress),
-		})
+		m.setDownload(download)
 	}
 
 	t := table.New(
 		table.WithColumns(columns),
-		table.WithRows(rows),
+		table.WithRows(m.rows()),
 		table.WithFocused(true),
 		table.WithHeight(10),
 	)
@@ -68,39 +127,376 @@ func InitDownloadList(state models.AppState) downloadListModel {
 		Bold(false)
 	t.SetStyles(s)
 
-	return downloadListModel{table: t, state: state}
+	m.table = t
+	m.dirty = false
+	return m
 }
 
-func (m downloadListModel) Init() tea.Cmd {
+// setDownload records the latest version of a download, which the next
+// frame draws.
+func (m *downloadListModel) setDownload(download daemon.Download) {
+	if _, ok := m.downloads[download.Id]; !ok {
+		m.order = append(m.order, download.Id)
+	}
+	m.downloads[download.Id] = download
+	m.dirty = true
+}
+
+// removeDownload drops a download that was removed from the list.
+func (m *downloadListModel) removeDownload(id int64) {
+	if _, ok := m.downloads[id]; !ok {
+		return
+	}
+	delete(m.downloads, id)
+	delete(m.selected, id)
+	delete(m.history, id)
+	if m.detail == id {
+		m.detail = 0
+	}
+	for i, known := range m.order {
+		if known == id {
+			m.order = append(m.order[:i:i], m.order[i+1:]...)
+			break
+		}
+	}
+	m.dirty = true
+}
+
+func (m downloadListModel) rows() []table.Row {
+	rows := make([]table.Row, 0, len(m.order))
+	for _, id := range m.order {
+		mark := ""
+		if m.selected[id] {
+			mark = "*"
+		}
+		rows = append(rows, append(table.Row{mark}, downloadRow(m.downloads[id])...))
+	}
+	return rows
+}
+
+// targets returns the downloads an action applies to: the selected ones, or
+// else the one under the cursor.
+func (m downloadListModel) targets() []int64 {
+	var ids []int64
+	for _, id := range m.order {
+		if m.selected[id] {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		if cursor := m.table.Cursor(); cursor >= 0 && cursor < len(m.order) {
+			ids = append(ids, m.order[cursor])
+		}
+	}
+	return ids
+}
+
+// actionCmd runs action on each of ids in the background, since the daemon
+// may take a moment, e.g. to stop a running download.
+func (m *downloadListModel) actionCmd(verb string, ids []int64, action func(id int64) error) tea.Cmd {
+	clear(m.selected)
+	m.dirty = true
+	return func() tea.Msg {
+		msg := actionMsg{verb: verb}
+		for _, id := range ids {
+			if err := action(id); err != nil {
+				msg.errs = append(msg.errs, err)
+			} else {
+				msg.done++
+			}
+		}
+		return msg
+	}
+}
+
+// pauseOrResumeCmd pauses the targets that are waiting or downloading and
+// resumes the others.
+func (m *downloadListModel) pauseOrResumeCmd(ids []int64) tea.Cmd {
+	pause := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		status := m.downloads[id].Status
+		if status == models.DownloadStatusQueued || status == models.DownloadStatusDownloading {
+			pause[id] = true
+		}
+	}
+	verb := "Paused or resumed"
+	switch len(pause) {
+	case 0:
+		verb = "Resumed"
+	case len(ids):
+		verb = "Paused"
+	}
+	client := m.client
+	return m.actionCmd(verb, ids, func(id int64) error {
+		var err error
+		if pause[id] {
+			_, err = client.Pause(id)
+		} else {
+			_, err = client.Resume(id)
+		}
+		return err
+	})
+}
+
+func (msg actionMsg) String() string {
+	if len(msg.errs) == 0 {
+		return fmt.Sprintf("%s %s", msg.verb, plural(msg.done, "download"))
+	}
+	text := "Error: " + msg.errs[0].Error()
+	if len(msg.errs) > 1 {
+		text += fmt.Sprintf(" (and %d more)", len(msg.errs)-1)
+	}
+	return text
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+// openFolder shows the folder of a download in the file manager.
+func openFolder(download models.Download) error {
+	if !filepath.IsAbs(download.FileName) {
+		return fmt.Errorf("download %d has not created its file yet", download.Id)
+	}
+	dir := filepath.Dir(download.FileName)
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", dir)
+	case "windows":
+		cmd = exec.Command("explorer", dir)
+	default:
+		cmd = exec.Command("xdg-open", dir)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to open %s: %w", dir, err)
+	}
+	go cmd.Wait()
 	return nil
 }
 
-func (m *downloadListModel) updateDownloads() {
-	var rows []table.Row
-	db := config.GetDB()
-	downloads, err := db.GetDownloads()
-	if err != nil {
-		log.Errorf("Failed to fetch downloads: %v", err)
+// downloadRow renders a download as a table row. Failed downloads show the
+// error that stopped them.
+func downloadRow(download daemon.Download) table.Row {
+	done := completedBytes(download.Download)
+	progress := fmt.Sprintf("%d%%", download.Progress)
+	bytes := formatBytes(done)
+	if download.ContentLength > 0 {
+		progress = fmt.Sprintf("%d%%", min(done*100/download.ContentLength, 100))
+		bytes += " / " + formatBytes(download.ContentLength)
 	}
 
-	for _, download := range downloads {
-		rows = append(rows, table.Row{
-			download.URL,
-			download.QueueName,
-			string(download.Status),
-			fmt.Sprintf("%d%%", download.Progress),
-		})
+	var speed, eta string
+	if download.Status == models.DownloadStatusDownloading {
+		speed = formatBytes(download.Speed) + "/s"
+		if download.Speed > 0 && download.ContentLength > done {
+			remaining := time.Duration((download.ContentLength-done)/download.Speed) * time.Second
+			eta = remaining.String()
+		}
+	}
+
+	return table.Row{
+		download.URL,
+		download.QueueName,
+		string(download.Status),
+		progress,
+		bytes,
+		speed,
+		eta,
+		signatureCell(download.Download),
+		download.LastError,
+	}
+}
+
+// completedBytes returns how much of a download is on disk. Only downloads
+// the engine holds track their progress in bytes; the others are counted
+// from their segments, or from the percentage stored for them.
+func completedBytes(download models.Download) int64 {
+	if download.Status == models.DownloadStatusCompleted && download.ContentLength > 0 {
+		return download.ContentLength
+	}
+	if download.CurrentProgress > 0 {
+		return download.CurrentProgress
+	}
+	var done int64
+	for _, r := range download.Ranges {
+		done += r.Offset - r.Start
+	}
+	if done == 0 && download.ContentLength > 0 {
+		done = download.ContentLength * int64(download.Progress) / 100
+	}
+	return done
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
 	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// signatureCell shows the outcome of the signature check with the last 16
+// digits of the signing key, the form gpg prints key IDs in.
+func signatureCell(download models.Download) string {
+	if download.SignatureStatus == "" {
+		return ""
+	}
+	signer := download.Signer
+	if len(signer) > 16 {
+		signer = signer[len(signer)-16:]
+	}
+	if signer == "" {
+		return string(download.SignatureStatus)
+	}
+	return string(download.SignatureStatus) + " " + signer
+}
 
-	m.table.SetRows(rows)
+func (m downloadListModel) Init() tea.Cmd {
+	return frameCmd()
+}
+
+func frameCmd() tea.Cmd {
+	return tea.Tick(frameInterval, func(t time.Time) tea.Msg {
+		return frameMsg(t)
+	})
 }
 
 func (m downloadListModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
-	m.updateDownloads()
 	var cmd tea.Cmd
 	switch msg := msg.(type) {
+	case daemon.Event:
+		switch msg.Type {
+		case daemon.EventDownload:
+			m.setDownload(*msg.Download)
+		case daemon.EventRemoved:
+			m.removeDownload(msg.Download.Id)
+		case daemon.EventState:
+			m.state = *msg.State
+		}
+		return m, nil
+	case actionMsg:
+		m.statusMsg = msg.String()
+		return m, nil
+	case DisconnectedMsg:
+		m.err = "Lost connection to the daemon, restart gofetch to reconnect"
+		return m, nil
+	case frameMsg:
+		if now := time.Time(msg); now.Sub(m.lastSample) >= sampleInterval {
+			m.sample()
+			m.lastSample = now
+		}
+		if m.dirty {
+			m.table.SetRows(m.rows())
+			m.dirty = false
+		}
+		return m, frameCmd()
 	case tea.KeyMsg:
+		if m.confirm != nil {
+			ids := m.confirm
+			m.confirm = nil
+			if msg.String() != "y" {
+				m.statusMsg = ""
+				return m, nil
+			}
+			client := m.client
+			return m, m.actionCmd("Deleted", ids, func(id int64) error {
+				_, err := client.Remove(id, true)
+				return err
+			})
+		}
+		if m.moving != nil {
+			return m.updateMove(msg)
+		}
+
+		client := m.client
 		switch msg.String() {
+		case " ":
+			if cursor := m.table.Cursor(); cursor >= 0 && cursor < len(m.order) {
+				id := m.order[cursor]
+				m.selected[id] = !m.selected[id]
+				if !m.selected[id] {
+					delete(m.selected, id)
+				}
+				m.table.SetRows(m.rows())
+				m.table.MoveDown(1)
+			}
+			return m, nil
+		case "a":
+			// Selects every download, or clears a selection.
+			if len(m.selected) > 0 {
+				clear(m.selected)
+			} else {
+				for _, id := range m.order {
+					m.selected[id] = true
+				}
+			}
+			m.table.SetRows(m.rows())
+			return m, nil
+		case "p":
+			if ids := m.targets(); len(ids) > 0 {
+				return m, m.pauseOrResumeCmd(ids)
+			}
+			return m, nil
+		case "c":
+			if ids := m.targets(); len(ids) > 0 {
+				return m, m.actionCmd("Canceled", ids, func(id int64) error {
+					_, err := client.Cancel(id)
+					return err
+				})
+			}
+			return m, nil
+		case "r":
+			if ids := m.targets(); len(ids) > 0 {
+				return m, m.actionCmd("Retried", ids, func(id int64) error {
+					_, err := client.Retry(id)
+					return err
+				})
+			}
+			return m, nil
+		case "x":
+			if ids := m.targets(); len(ids) > 0 {
+				return m, m.actionCmd("Removed", ids, func(id int64) error {
+					_, err := client.Remove(id, false)
+					return err
+				})
+			}
+			return m, nil
+		case "D":
+			m.confirm = m.targets()
+			if len(m.confirm) == 0 {
+				m.confirm = nil
+			}
+			return m, nil
+		case "m":
+			if ids := m.targets(); len(ids) > 0 {
+				m.moving = ids
+				names := make([]string, len(m.state.Queues))
+				for i, q := range m.state.Queues {
+					names[i] = q.Name
+				}
+				m.queueInput = textinput.New()
+				m.queueInput.Placeholder = strings.Join(names, ", ")
+				m.queueInput.Width = 40
+				m.queueInput.Focus()
+			}
+			return m, nil
+		case "o":
+			if ids := m.targets(); len(ids) > 0 {
+				m.statusMsg = ""
+				if err := openFolder(m.downloads[ids[0]].Download); err != nil {
+					m.statusMsg = "Error: " + err.Error()
+				}
+			}
+			return m, nil
 		case "esc":
 			if m.table.Focused() {
 				m.table.Blur()
@@ -110,20 +506,87 @@ func (m downloadListModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		case "q", "ctrl+c":
 			return m, tea.Quit
 		case "enter":
-			return m, tea.Printf("Selected: %s", m.table.SelectedRow()[0])
+			// Opens the detail pane of the download under the cursor, or
+			// closes it.
+			if m.detail != 0 {
+				m.detail = 0
+			} else if cursor := m.table.Cursor(); cursor >= 0 && cursor < len(m.order) {
+				m.detail = m.order[cursor]
+			}
+			return m, nil
 		}
 	}
 	m.table, cmd = m.table.Update(msg)
 	return m, cmd
 }
 
+// sample records the speed of every download that is downloading. The
+// others keep the samples they have, so a finished download still shows how
+// it went.
+func (m *downloadListModel) sample() {
+	for id, d := range m.downloads {
+		if d.Status != models.DownloadStatusDownloading {
+			continue
+		}
+		history := append(m.history[id], d.Speed)
+		if len(history) > historyLength {
+			history = history[len(history)-historyLength:]
+		}
+		m.history[id] = history
+	}
+}
+
+// updateMove reads the queue the downloads in m.moving go to. Entering no
+// name or pressing esc leaves them where they are.
+func (m downloadListModel) updateMove(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "esc":
+		m.moving = nil
+		return m, nil
+	case "enter":
+	default:
+		var cmd tea.Cmd
+		m.queueInput, cmd = m.queueInput.Update(msg)
+		return m, cmd
+	}
+	ids := m.moving
+	m.moving = nil
+	queue := strings.TrimSpace(m.queueInput.Value())
+	if queue == "" {
+		return m, nil
+	}
+	client := m.client
+	return m, m.actionCmd("Moved", ids, func(id int64) error {
+		_, err := client.Move(id, queue)
+		return err
+	})
+}
+
 func (m downloadListModel) View() string {
-	m.updateDownloads()
 	baseStyle := lipgloss.NewStyle().
 		BorderStyle(lipgloss.NormalBorder()).
 		BorderForeground(lipgloss.Color("240"))
 
 	renderedTable := baseStyle.Render(m.table.View())
+	if d, ok := m.downloads[m.detail]; ok {
+		renderedTable = baseStyle.Render(renderDetail(d, m.history[m.detail]))
+	}
 
-	return lipgloss.JoinVertical(lipgloss.Center, []string{"Download List Info", renderedTable}...) + "\n"
+	parts := []string{"Download List Info", renderedTable}
+	switch {
+	case m.confirm != nil:
+		parts = append(parts, fmt.Sprintf("Delete %s along with the files? (y/n)", plural(len(m.confirm), "download")))
+	case m.moving != nil:
+		parts = append(parts, fmt.Sprintf("Move %s to queue (esc to cancel):", plural(len(m.moving), "download")), m.queueInput.View())
+	case m.statusMsg != "":
+		statusStyle := lipgloss.NewStyle().Foreground(lipgloss.Color("#00FF00"))
+		if strings.HasPrefix(m.statusMsg, "Error") {
+			statusStyle = statusStyle.Foreground(lipgloss.Color("#FF0000"))
+		}
+		parts = append(parts, statusStyle.Render(m.statusMsg))
+	}
+	if m.err != "" {
+		parts = append(parts, lipgloss.NewStyle().Foreground(lipgloss.Color("#FF0000")).Render(m.err))
+	}
+	return lipgloss.JoinVertical(lipgloss.Center, parts...) + "\n"
 }
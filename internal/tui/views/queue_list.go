@@ -1,12 +1,16 @@
 package views
 
 import (
-	"encoding/json"
 	"fmt"
-	"os"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/Amirali-Amirifar/gofetch.git/internal/config"
+	"github.com/Amirali-Amirifar/gofetch.git/internal/daemon"
 	"github.com/Amirali-Amirifar/gofetch.git/internal/models"
+	"github.com/Amirali-Amirifar/gofetch.git/internal/queues"
 	"github.com/charmbracelet/bubbles/key"
 	"github.com/charmbracelet/bubbles/table"
 	"github.com/charmbracelet/bubbles/textinput"
@@ -14,12 +18,72 @@ import (
 	"github.com/charmbracelet/lipgloss"
 )
 
+// The inputs of the queue form.
+const (
+	fieldName = iota
+	fieldFolder
+	fieldMaxSimultaneous
+	fieldMaxDownloadSpeed
+	fieldBandwidthLimit
+	fieldActiveTimeStart
+	fieldActiveTimeEnd
+	fieldMaxRetryAttempts
+)
+
+var (
+	queueFieldLabels = []string{"Name", "Folder", "Max DL", "Speed", "Bandwidth", "Time Start", "Time End", "Retries"}
+	fieldLabelStyle  = lipgloss.NewStyle().Width(12)
+	fieldErrorStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("#FF0000"))
+)
+
+// queueSavedMsg reports whether the daemon saved the queue of the form.
+type queueSavedMsg struct {
+	editName string // Queue the form edited, empty for a new one
+	name     string
+	state    models.AppState
+	err      error
+}
+
+// queuesChangedMsg reports the state after a queue was deleted or moved, or
+// a setting of the Queue List changed.
+type queuesChangedMsg struct {
+	done   string // Shown once the change is made, empty for none
+	cursor int    // Row the cursor moves to, -1 to leave it
+	state  models.AppState
+	err    error
+}
+
+// globalLimitSetMsg reports whether the daemon took the new global speed
+// limit.
+type globalLimitSetMsg struct {
+	state models.AppState
+	err   error
+}
+
 type queueListModel struct {
 	table      table.Model
 	state      models.AppState
+	client     *daemon.Client
 	focused    bool
 	editing    bool
+	editName   string // Queue being edited, empty while a new one is created
 	editInputs []textinput.Model
+	editErrs   []string // Why the value of each input cannot be saved, empty when it can
+	formErr    string   // Why the daemon refused the queue, e.g. a folder it cannot write to
+
+	// deleting is the queue waiting for the choice of what happens to its
+	// downloads before it is deleted.
+	deleting  string
+	statusMsg string
+	// busy is set while a change waits for the daemon's answer. Further
+	// changes wait for it, as they depend on the state it returns.
+	busy bool
+
+	// editingGlobal is set while the global speed limit is being edited
+	// in globalInput instead of a queue.
+	editingGlobal bool
+	globalInput   textinput.Model
+	globalErr     string
 }
 
 func (m queueListModel) GetKeyBinds() []key.Binding {
@@ -27,6 +91,9 @@ func (m queueListModel) GetKeyBinds() []key.Binding {
 		key.NewBinding(key.WithKeys("N"), key.WithHelp("N", "New Queue")),
 		key.NewBinding(key.WithKeys("E"), key.WithHelp("E", "Edit")),
 		key.NewBinding(key.WithKeys("D"), key.WithHelp("D", "Delete")),
+		key.NewBinding(key.WithKeys("K", "J"), key.WithHelp("K/J", "Move Up/Down")),
+		key.NewBinding(key.WithKeys("g"), key.WithHelp("g", "Global Speed Limit")),
+		key.NewBinding(key.WithKeys("v"), key.WithHelp("v", "Toggle Checksum Discovery")),
 	}
 }
 
@@ -34,19 +101,27 @@ func (m queueListModel) GetName() string {
 	return "Queue List"
 }
 
-func InitQueueList(state models.AppState) queueListModel {
+// Prompting reports whether the choice of what happens to the downloads of
+// a deleted queue is pending.
+func (m queueListModel) Prompting() bool {
+	return m.deleting != ""
+}
+
+func InitQueueList(state models.AppState, client *daemon.Client) queueListModel {
 	columns := []table.Column{
 		{Title: "Name", Width: 15},
 		{Title: "Folder", Width: 20},
 		{Title: "Max DL", Width: 7},
 		{Title: "Speed", Width: 10},
+		{Title: "Bandwidth", Width: 10},
 		{Title: "Time Start", Width: 15},
 		{Title: "Time End", Width: 15},
+		{Title: "Retries", Width: 7},
 	}
 
 	var rows []table.Row
 	for _, q := range state.Queues {
-		rows = append(rows, table.Row{q.Name, q.StorageFolder, fmt.Sprintf("%d", q.MaxSimultaneous), fmt.Sprintf("%d", q.MaxDownloadSpeed), q.ActiveTimeStart, q.ActiveTimeEnd})
+		rows = append(rows, queueRow(q))
 	}
 
 	t := table.New(
@@ -56,7 +131,7 @@ func InitQueueList(state models.AppState) queueListModel {
 		table.WithHeight(7),
 	)
 
-	return queueListModel{table: t, state: state, focused: true}
+	return queueListModel{table: t, state: state, client: client, focused: true}
 }
 
 func (m queueListModel) Init() tea.Cmd {
@@ -65,78 +140,219 @@ func (m queueListModel) Init() tea.Cmd {
 
 func (m queueListModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	var cmd tea.Cmd
+	if event, ok := msg.(daemon.Event); ok {
+		if event.Type == daemon.EventState {
+			m.state = *event.State
+			m.updateTableRows()
+		}
+		return m, nil
+	}
 	switch msg := msg.(type) {
-	case tea.KeyMsg:
+	case queueSavedMsg:
+		return m.saved(msg), nil
+	case queuesChangedMsg:
+		m.busy = false
+		if msg.err != nil {
+			m.statusMsg = "Error: " + msg.err.Error()
+			return m, nil
+		}
+		m.state = msg.state
+		m.updateTableRows()
+		if msg.cursor >= 0 {
+			m.table.SetCursor(msg.cursor)
+		}
+		m.statusMsg = msg.done
+		return m, nil
+	case globalLimitSetMsg:
+		m.busy = false
+		if msg.err != nil {
+			m.globalErr = msg.err.Error()
+			return m, nil
+		}
+		m.editingGlobal = false
+		m.state = msg.state
+		return m, nil
+	}
+	switch {
+	case m.editingGlobal:
+		return m.updateGlobalLimit(msg)
+	case m.editing:
+		return m.updateEdit(msg)
+	case m.deleting != "":
+		return m.updateDelete(msg)
+	}
+
+	if msg, ok := msg.(tea.KeyMsg); ok && !m.busy {
 		switch msg.String() {
-		case "up", "down": // Handle Up and Down keys
-			if !m.editing { // Only navigate queues if not in edit mode
-				m.table, cmd = m.table.Update(msg)
-				return m, cmd
+		case "N": // Create a queue
+			m.editName = ""
+			queue := queues.Default()
+			queue.Name = ""
+			m.initEditInputs(queue)
+			return m, nil
+		case "E", "e": // Edit the queue under the cursor
+			if queue, ok := m.selectedQueue(); ok {
+				m.editName = queue.Name
+				m.initEditInputs(queue)
 			}
-		case "tab", "shift+tab": // Handle Tab and Shift+Tab
-			if m.editing { // Only navigate fields if in edit mode
-				// Get the currently focused input field index
-				currentIndex := -1
-				for i, input := range m.editInputs {
-					if input.Focused() {
-						currentIndex = i
-						break
-					}
+			return m, nil
+		case "D": // Delete the queue under the cursor, once it is known what happens to its downloads
+			if queue, ok := m.selectedQueue(); ok {
+				m.statusMsg = ""
+				if queue.Name == config.DefaultQueueName {
+					m.statusMsg = fmt.Sprintf("Error: the %s queue cannot be deleted", queue.Name)
+				} else {
+					m.deleting = queue.Name
 				}
+			}
+			return m, nil
+		case "K", "shift+up":
+			return m.moveQueue(-1)
+		case "J", "shift+down":
+			return m.moveQueue(1)
+		case "g": // Edit the global speed limit
+			m.editingGlobal = true
+			m.globalErr = ""
+			m.globalInput = textinput.New()
+			m.globalInput.Placeholder = "Global speed limit (KB/s, 0 = unlimited)"
+			m.globalInput.SetValue(fmt.Sprintf("%d", m.state.GlobalBandwidthLimit))
+			m.globalInput.Focus()
+			return m, nil
+		case "v": // Toggle looking for published checksum files
+			m.statusMsg = ""
+			m.busy = true
+			client, discover := m.client, !m.state.DiscoverChecksums
+			return m, func() tea.Msg {
+				state, err := client.SetChecksumDiscovery(discover)
+				return queuesChangedMsg{cursor: -1, state: state, err: err}
+			}
+		}
+	}
 
-				// Determine the next input field index
-				if msg.String() == "tab" {
-					currentIndex = (currentIndex + 1) % len(m.editInputs) // Move to the next field
-				} else if msg.String() == "shift+tab" {
-					currentIndex = (currentIndex - 1 + len(m.editInputs)) % len(m.editInputs) // Move to the previous field
-				}
+	m.table, cmd = m.table.Update(msg)
+	return m, cmd
+}
 
-				// Update focus
-				for i := range m.editInputs {
-					if i == currentIndex {
-						m.editInputs[i].Focus()
-					} else {
-						m.editInputs[i].Blur()
-					}
-				}
-				return m, nil
-			}
+// updateEdit handles input while the queue form is open. The queue is only
+// handed to the daemon once every field is valid.
+func (m queueListModel) updateEdit(msg tea.Msg) (tea.Model, tea.Cmd) {
+	if msg, ok := msg.(tea.KeyMsg); ok {
+		switch msg.String() {
+		case "ctrl+x": // Discard the changes
+			m.editing = false
+			return m, nil
+		case "tab", "down":
+			m.focusInput(m.focusedInput() + 1)
+			return m, nil
+		case "shift+tab", "up":
+			m.focusInput(m.focusedInput() - 1)
+			return m, nil
 		case "enter":
-			if m.editing {
-				idx := m.table.Cursor()
-				if idx >= 0 && idx < len(m.state.Queues) {
-					m.applyEditInputs(idx)
-					m.editing = false
-					m.updateTableRows()
-					if err := m.saveQueuesToFile(); err != nil {
-						return m, tea.Printf("Error saving queues: %v", err)
-					}
-				}
+			if m.busy {
+				return m, nil
 			}
-		case "e": // Enter edit mode
-			if !m.editing && len(m.state.Queues) > 0 {
-				m.editing = true
-				m.initEditInputs(m.table.Cursor())
+			queue, ok := m.validateEditInputs()
+			if !ok {
+				m.focusInput(slices.IndexFunc(m.editErrs, func(err string) bool { return err != "" }))
+				return m, nil
 			}
-		case "esc": // Exit edit mode
-			if m.editing {
-				m.editing = false
+			m.busy = true
+			client, editName := m.client, m.editName
+			return m, func() tea.Msg {
+				state, err := client.SaveQueue(editName, queue)
+				return queueSavedMsg{editName: editName, name: queue.Name, state: state, err: err}
 			}
-			// Other key bindings...
 		}
 	}
 
-	if m.editing {
-		var cmds []tea.Cmd
-		for i := range m.editInputs {
-			m.editInputs[i], cmd = m.editInputs[i].Update(msg)
-			cmds = append(cmds, cmd)
+	var cmds []tea.Cmd
+	for i := range m.editInputs {
+		var cmd tea.Cmd
+		m.editInputs[i], cmd = m.editInputs[i].Update(msg)
+		cmds = append(cmds, cmd)
+	}
+	return m, tea.Batch(cmds...)
+}
+
+// saved closes the form once the daemon saved its queue. A storage folder
+// the daemon cannot write to is reported next to the Folder input.
+func (m queueListModel) saved(msg queueSavedMsg) queueListModel {
+	m.busy = false
+	if !m.editing || msg.editName != m.editName {
+		return m
+	}
+	if msg.err != nil {
+		if queues.IsFolderError(msg.err.Error()) {
+			m.editErrs[fieldFolder] = msg.err.Error()
+			m.focusInput(fieldFolder)
+		} else {
+			m.formErr = msg.err.Error()
 		}
-		return m, tea.Batch(cmds...)
+		return m
+	}
+	m.editing = false
+	m.state = msg.state
+	m.updateTableRows()
+	if i := slices.IndexFunc(m.state.Queues, func(q models.Queue) bool { return q.Name == msg.name }); i >= 0 {
+		m.table.SetCursor(i)
 	}
+	if msg.editName == "" {
+		m.statusMsg = "Created queue " + msg.name
+	} else {
+		m.statusMsg = "Saved queue " + msg.name
+	}
+	return m
+}
 
-	m.table, cmd = m.table.Update(msg)
-	return m, cmd
+// updateDelete waits for the choice of what happens to the downloads of the
+// queue being deleted: m moves them to the Default queue, c cancels them and
+// any other key keeps the queue.
+func (m queueListModel) updateDelete(msg tea.Msg) (tea.Model, tea.Cmd) {
+	keyMsg, ok := msg.(tea.KeyMsg)
+	if !ok {
+		return m, nil
+	}
+	name := m.deleting
+	m.deleting = ""
+	var cancel bool
+	switch keyMsg.String() {
+	case "m":
+	case "c":
+		cancel = true
+	default:
+		return m, nil
+	}
+	m.busy = true
+	client := m.client
+	return m, func() tea.Msg {
+		state, err := client.DeleteQueue(name, cancel)
+		return queuesChangedMsg{done: "Deleted queue " + name, cursor: -1, state: state, err: err}
+	}
+}
+
+// moveQueue moves the queue under the cursor by offset rows, and the cursor
+// along with it.
+func (m queueListModel) moveQueue(offset int) (tea.Model, tea.Cmd) {
+	queue, ok := m.selectedQueue()
+	position := m.table.Cursor() + offset
+	if !ok || position < 0 || position >= len(m.state.Queues) {
+		return m, nil
+	}
+	m.statusMsg = ""
+	m.busy = true
+	client := m.client
+	return m, func() tea.Msg {
+		state, err := client.MoveQueue(queue.Name, position)
+		return queuesChangedMsg{cursor: position, state: state, err: err}
+	}
+}
+
+func (m queueListModel) selectedQueue() (models.Queue, bool) {
+	idx := m.table.Cursor()
+	if idx < 0 || idx >= len(m.state.Queues) {
+		return models.Queue{}, false
+	}
+	return m.state.Queues[idx], true
 }
 
 func (m queueListModel) View() string {
@@ -146,87 +362,240 @@ func (m queueListModel) View() string {
 
 	renderedTable := baseStyle.Render(m.table.View())
 
+	globalLimit := "Global speed limit: " + formatSpeedLimit(m.state.GlobalBandwidthLimit)
+	if m.state.DiscoverChecksums {
+		globalLimit += "   Checksum discovery: on"
+	} else {
+		globalLimit += "   Checksum discovery: off"
+	}
+
 	if m.editing {
-		editView := lipgloss.JoinVertical(lipgloss.Left,
-			"Edit Queue:",
-			m.editInputs[0].View(),
-			m.editInputs[1].View(),
-			m.editInputs[2].View(),
-			m.editInputs[3].View(),
-			m.editInputs[4].View(),
-			m.editInputs[5].View(),
-		)
-		return lipgloss.JoinVertical(lipgloss.Left, renderedTable, editView)
+		title := "Edit Queue " + m.editName + ":"
+		if m.editName == "" {
+			title = "New Queue:"
+		}
+		lines := []string{title}
+		for i, input := range m.editInputs {
+			line := fieldLabelStyle.Render(queueFieldLabels[i]) + input.View()
+			if m.editErrs[i] != "" {
+				line += "  " + fieldErrorStyle.Render(m.editErrs[i])
+			}
+			lines = append(lines, line)
+		}
+		if m.formErr != "" {
+			lines = append(lines, fieldErrorStyle.Render("Error: "+m.formErr))
+		}
+		lines = append(lines, "enter: save • ctrl+x: discard")
+		editView := lipgloss.JoinVertical(lipgloss.Left, lines...)
+		return lipgloss.JoinVertical(lipgloss.Left, renderedTable, globalLimit, editView)
 	}
 
-	return lipgloss.JoinVertical(lipgloss.Left, renderedTable)
+	if m.editingGlobal {
+		lines := []string{renderedTable, "Edit Global Speed Limit:", m.globalInput.View()}
+		if m.globalErr != "" {
+			lines = append(lines, fieldErrorStyle.Render(m.globalErr))
+		}
+		lines = append(lines, "enter: save • ctrl+x: discard")
+		return lipgloss.JoinVertical(lipgloss.Left, lines...)
+	}
+
+	lines := []string{renderedTable, globalLimit}
+	if m.deleting != "" {
+		lines = append(lines, fmt.Sprintf("Delete queue %s? m: move its downloads to %s • c: cancel them • esc: keep the queue",
+			m.deleting, config.DefaultQueueName))
+	} else if m.statusMsg != "" {
+		style := lipgloss.NewStyle().Foreground(lipgloss.Color("#00FF00"))
+		if strings.HasPrefix(m.statusMsg, "Error") {
+			style = fieldErrorStyle
+		}
+		lines = append(lines, style.Render(m.statusMsg))
+	}
+	return lipgloss.JoinVertical(lipgloss.Left, lines...)
+}
+
+// updateGlobalLimit handles input while the global speed limit is edited.
+// The new limit applies to running transfers as soon as it is confirmed.
+func (m queueListModel) updateGlobalLimit(msg tea.Msg) (tea.Model, tea.Cmd) {
+	if msg, ok := msg.(tea.KeyMsg); ok {
+		switch msg.String() {
+		case "ctrl+x":
+			m.editingGlobal = false
+			return m, nil
+		case "enter":
+			if m.busy {
+				return m, nil
+			}
+			limit, err := parseLimit(m.globalInput.Value())
+			if err != nil {
+				m.globalErr = err.Error()
+				return m, nil
+			}
+			m.busy = true
+			client := m.client
+			return m, func() tea.Msg {
+				state, err := client.SetGlobalLimit(limit)
+				return globalLimitSetMsg{state: state, err: err}
+			}
+		}
+	}
+
+	var cmd tea.Cmd
+	m.globalInput, cmd = m.globalInput.Update(msg)
+	return m, cmd
 }
 
 func (m *queueListModel) updateTableRows() {
 	var rows []table.Row
 	for _, q := range m.state.Queues {
-		rows = append(rows, table.Row{q.Name, q.StorageFolder, fmt.Sprintf("%d", q.MaxSimultaneous), fmt.Sprintf("%d", q.MaxDownloadSpeed), q.ActiveTimeStart, q.ActiveTimeEnd})
+		rows = append(rows, queueRow(q))
 	}
 	m.table.SetRows(rows)
 }
 
-func (m *queueListModel) saveQueuesToFile() error {
-	data, err := json.MarshalIndent(m.state, "", "  ")
-	if err != nil {
-		return fmt.Errorf("error marshaling state: %w", err)
+// queueRow renders a queue as a table row. Speeds are shown in KB/s.
+func queueRow(q models.Queue) table.Row {
+	return table.Row{
+		q.Name,
+		q.StorageFolder,
+		fmt.Sprintf("%d", q.MaxSimultaneous),
+		formatSpeedLimit(q.MaxDownloadSpeed),
+		formatSpeedLimit(q.BandwidthLimit),
+		q.ActiveTimeStart,
+		q.ActiveTimeEnd,
+		fmt.Sprintf("%d", q.MaxRetryAttempts),
 	}
-	if err := os.WriteFile("state.json", data, 0644); err != nil {
-		return fmt.Errorf("error writing to file: %w", err)
+}
+
+func formatSpeedLimit(kbps int64) string {
+	if kbps <= 0 {
+		return "unlimited"
 	}
-	return nil
+	return fmt.Sprintf("%d KB/s", kbps)
 }
 
-func (m *queueListModel) initEditInputs(idx int) {
-	queue := m.state.Queues[idx]
-	m.editInputs = make([]textinput.Model, 6)
+// initEditInputs opens the queue form filled in with queue.
+func (m *queueListModel) initEditInputs(queue models.Queue) {
+	values := []string{
+		queue.Name,
+		queue.StorageFolder,
+		strconv.Itoa(queue.MaxSimultaneous),
+		strconv.FormatInt(queue.MaxDownloadSpeed, 10),
+		strconv.FormatInt(queue.BandwidthLimit, 10),
+		queue.ActiveTimeStart,
+		queue.ActiveTimeEnd,
+		strconv.Itoa(queue.MaxRetryAttempts),
+	}
+	placeholders := []string{
+		"Name",
+		config.DefaultDownloadFolder,
+		fmt.Sprintf("0 = %d", config.DefaultMaxSimultaneous),
+		"KB/s for each download, 0 = unlimited",
+		"KB/s shared by the queue, 0 = unlimited",
+		"HH:MM, empty for always",
+		"HH:MM, empty for always",
+		"Retry attempts of failing downloads",
+	}
 
-	m.editInputs[0] = textinput.New()
-	m.editInputs[0].Placeholder = "Name"
-	m.editInputs[0].SetValue(queue.Name)
+	m.editInputs = make([]textinput.Model, len(values))
+	for i := range m.editInputs {
+		m.editInputs[i] = textinput.New()
+		m.editInputs[i].Placeholder = placeholders[i]
+		m.editInputs[i].Width = 40
+		m.editInputs[i].SetValue(values[i])
+	}
+	m.editErrs = make([]string, len(values))
+	m.formErr = ""
+	m.statusMsg = ""
+	m.editing = true
+	m.focusInput(fieldName)
+}
 
-	m.editInputs[1] = textinput.New()
-	m.editInputs[1].Placeholder = "Folder"
-	m.editInputs[1].SetValue(queue.StorageFolder)
+func (m queueListModel) focusedInput() int {
+	return slices.IndexFunc(m.editInputs, func(input textinput.Model) bool { return input.Focused() })
+}
 
-	m.editInputs[2] = textinput.New()
-	m.editInputs[2].Placeholder = "Max DL"
-	m.editInputs[2].SetValue(fmt.Sprintf("%d", queue.MaxSimultaneous))
+// focusInput moves the focus to input i, wrapping around at either end.
+func (m *queueListModel) focusInput(i int) {
+	i = (i + len(m.editInputs)) % len(m.editInputs)
+	for j := range m.editInputs {
+		if j == i {
+			m.editInputs[j].Focus()
+		} else {
+			m.editInputs[j].Blur()
+		}
+	}
+}
 
-	m.editInputs[3] = textinput.New()
-	m.editInputs[3].Placeholder = "Speed"
-	m.editInputs[3].SetValue(fmt.Sprintf("%d", queue.MaxDownloadSpeed))
+// validateEditInputs reads the queue off the form. It records why each
+// invalid field cannot be saved and reports whether all of them can.
+func (m *queueListModel) validateEditInputs() (models.Queue, bool) {
+	value := func(field int) string {
+		return strings.TrimSpace(m.editInputs[field].Value())
+	}
+	clear(m.editErrs)
+	m.formErr = ""
+	fail := func(field int, err error) {
+		if err != nil {
+			m.editErrs[field] = err.Error()
+		}
+	}
 
-	m.editInputs[4] = textinput.New()
-	m.editInputs[4].Placeholder = "Time Start"
-	m.editInputs[4].SetValue(queue.ActiveTimeStart)
+	queue := models.Queue{
+		Name:            value(fieldName),
+		StorageFolder:   value(fieldFolder),
+		ActiveTimeStart: value(fieldActiveTimeStart),
+		ActiveTimeEnd:   value(fieldActiveTimeEnd),
+	}
+	switch {
+	case queue.Name == "":
+		m.editErrs[fieldName] = "enter a name"
+	case queue.Name != m.editName && slices.ContainsFunc(m.state.Queues, func(q models.Queue) bool { return q.Name == queue.Name }):
+		m.editErrs[fieldName] = "a queue with this name exists"
+	}
+	// The daemon checks the folder on its own filesystem when it saves.
+
+	maxSimultaneous, err := parseLimit(value(fieldMaxSimultaneous))
+	fail(fieldMaxSimultaneous, err)
+	queue.MaxSimultaneous = int(maxSimultaneous)
+	queue.MaxDownloadSpeed, err = parseLimit(value(fieldMaxDownloadSpeed))
+	fail(fieldMaxDownloadSpeed, err)
+	queue.BandwidthLimit, err = parseLimit(value(fieldBandwidthLimit))
+	fail(fieldBandwidthLimit, err)
+	retries, err := parseLimit(value(fieldMaxRetryAttempts))
+	fail(fieldMaxRetryAttempts, err)
+	queue.MaxRetryAttempts = int(retries)
+
+	for _, field := range []int{fieldActiveTimeStart, fieldActiveTimeEnd} {
+		if v := value(field); v != "" {
+			if _, err := time.Parse("15:04", v); err != nil {
+				m.editErrs[field] = "write the time as HH:MM"
+			}
+		}
+	}
+	if (queue.ActiveTimeStart == "") != (queue.ActiveTimeEnd == "") && m.editErrs[fieldActiveTimeEnd] == "" {
+		empty := fieldActiveTimeStart
+		if queue.ActiveTimeEnd == "" {
+			empty = fieldActiveTimeEnd
+		}
+		m.editErrs[empty] = "set both ends of the active time, or neither"
+	}
 
-	m.editInputs[5] = textinput.New()
-	m.editInputs[5].Placeholder = "Time End"
-	m.editInputs[5].SetValue(queue.ActiveTimeEnd)
+	return queue, !slices.ContainsFunc(m.editErrs, func(err string) bool { return err != "" })
 }
 
-func (m *queueListModel) applyEditInputs(idx int) {
-	queue := &m.state.Queues[idx]
-	queue.Name = m.editInputs[0].Value()
-	queue.StorageFolder = m.editInputs[1].Value()
-
-	maxSimultaneous, err := strconv.Atoi(m.editInputs[2].Value())
-	if err != nil {
-		maxSimultaneous = 3
+// parseLimit reads a limit or count, which cannot be negative. An empty
+// value is 0.
+func parseLimit(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
 	}
-	queue.MaxSimultaneous = maxSimultaneous
-
-	maxDownloadSpeed, err := strconv.ParseInt(m.editInputs[3].Value(), 10, 64)
+	n, err := strconv.ParseInt(value, 10, 32)
 	if err != nil {
-		maxDownloadSpeed = 1
+		return 0, fmt.Errorf("%q is not a whole number", value)
 	}
-	queue.MaxDownloadSpeed = maxDownloadSpeed
-
-	queue.ActiveTimeStart = m.editInputs[4].Value()
-	queue.ActiveTimeEnd = m.editInputs[5].Value()
+	if n < 0 {
+		return 0, fmt.Errorf("cannot be negative")
+	}
+	return n, nil
 }